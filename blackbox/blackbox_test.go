@@ -10,6 +10,7 @@ import (
 	"net/smtp"
 	"os"
 	"path/filepath"
+	"regexp"
 	"testing"
 	"time"
 
@@ -23,6 +24,11 @@ example.net`)
 var defaulthost = []byte(`example.org`)
 var tempdirs = make(chan string, 1024)
 
+// received matches the Received header of a message from the proxied
+// client to nobody@example.com.
+var received = regexp.MustCompile(`^Received: from localhost \(\[198\.51\.100\.1\]\)\n` +
+	`\tby example\.org with ESMTP id [^\s;]+\n\tfor <nobody@example\.com>;\n\t[^\n]+\n`)
+
 func randbytes() []byte {
 	rand.Seed(time.Now().UnixNano())
 	buf := make([]byte, 64)
@@ -89,16 +95,28 @@ func TestBlackBox(t *testing.T) {
 				t.Fatal(err)
 			}
 			serveraddr = l.Addr().String()
+			_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+			pl := server.ProxyListener(l, []*net.IPNet{loopback})
 			go func() {
-				if err := server.Serve(conf, mdir, l); err != nil {
-					t.Fatal("server Serve ", err)
+				// Not t.Fatal, whose FailNow must be called from the
+				// test's goroutine, not this one.
+				if err := server.Serve(conf, mdir, pl); err != nil {
+					t.Error("server Serve ", err)
 				}
 			}()
 		})
 	}
 	if next {
 		next = t.Run("Client", func(t *testing.T) {
-			client, err := smtp.Dial(serveraddr)
+			// As from a load balancer, passing on its client's address.
+			c, err := net.Dial("tcp4", serveraddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = io.WriteString(c, "PROXY TCP4 198.51.100.1 127.0.0.1 53764 25\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			client, err := smtp.NewClient(c, "127.0.0.1")
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -145,10 +163,15 @@ func TestBlackBox(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
-				if c := bytes.Compare(bytes.TrimSpace(mail), bytes.TrimSpace(b)); c != 0 {
-					t.Logf(`b: "%s"`, string(b))
+				// The message is stored as sent, after one Received header.
+				loc := received.FindIndex(b)
+				if loc == nil || loc[0] != 0 {
+					t.Fatalf("no Received header for the proxied client: %q", b)
+				}
+				if rest := b[loc[1]:]; !bytes.Equal(rest, append(mail, '\n')) {
+					t.Logf(`b: "%s"`, string(rest))
 					t.Logf(`mail: "%s"`, string(mail))
-					t.Fatalf("unexpected compare mail to file, got %v want 0", c)
+					t.Fatal("stored message differs from the mail sent")
 				}
 			})
 		})
@@ -0,0 +1,265 @@
+// Package cdb reads and writes D. J. Bernstein's constant database
+// format, as used by qmail for morercpthosts.cdb and friends.
+// See https://cr.yp.to/cdb/cdb.txt
+package cdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// ErrNotFound is returned by Get for keys not in the database.
+var ErrNotFound = errors.New("cdb: key not found")
+
+const headersize = 256 * 8
+
+func hash(key []byte) uint32 {
+	h := uint32(5381)
+	for _, c := range key {
+		h = ((h << 5) + h) ^ uint32(c)
+	}
+	return h
+}
+
+// CDB is a read-only constant database.
+type CDB struct {
+	r io.ReaderAt
+}
+
+// New returns a CDB reading from r.
+func New(r io.ReaderAt) *CDB {
+	return &CDB{r: r}
+}
+
+// Load reads the database at path into memory.
+func Load(path string) (*CDB, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(b)
+	if err != nil {
+		return nil, errors.New("cdb: short file: " + path)
+	}
+	return c, nil
+}
+
+// ErrShort is returned by Parse for data too short to be a database.
+var ErrShort = errors.New("cdb: short file")
+
+// Parse returns the database held in b.
+func Parse(b []byte) (*CDB, error) {
+	if len(b) < headersize {
+		return nil, ErrShort
+	}
+	return New(bytes.NewReader(b)), nil
+}
+
+func (c *CDB) pair(off uint32) (a, b uint32, err error) {
+	var buf [8]byte
+	if _, err = c.r.ReadAt(buf[:], int64(off)); err != nil {
+		return
+	}
+	return binary.LittleEndian.Uint32(buf[:4]), binary.LittleEndian.Uint32(buf[4:]), nil
+}
+
+// Get returns the data of the first record stored under key.
+func (c *CDB) Get(key []byte) ([]byte, error) {
+	h := hash(key)
+	tpos, tlen, err := c.pair(h % 256 * 8)
+	if err != nil {
+		return nil, err
+	}
+	if tlen == 0 {
+		return nil, ErrNotFound
+	}
+	slot := (h >> 8) % tlen
+	for i := uint32(0); i < tlen; i++ {
+		shash, rpos, err := c.pair(tpos + slot*8)
+		if err != nil {
+			return nil, err
+		}
+		if rpos == 0 {
+			break
+		}
+		if shash == h {
+			klen, dlen, err := c.pair(rpos)
+			if err != nil {
+				return nil, err
+			}
+			if int(klen) == len(key) {
+				buf := make([]byte, int(klen)+int(dlen))
+				if _, err = c.r.ReadAt(buf, int64(rpos)+8); err != nil {
+					return nil, err
+				}
+				if bytes.Equal(buf[:klen], key) {
+					return buf[klen:], nil
+				}
+			}
+		}
+		slot = (slot + 1) % tlen
+	}
+	return nil, ErrNotFound
+}
+
+// Has reports whether key is in the database.
+func (c *CDB) Has(key []byte) bool {
+	_, err := c.Get(key)
+	return err == nil
+}
+
+type slot struct {
+	hash, pos uint32
+}
+
+// Writer builds a constant database. Records are written as they are
+// Put; the hash tables and header are written by Close.
+type Writer struct {
+	ws    io.WriteSeeker
+	w     *bufio.Writer
+	pos   uint32
+	slots [256][]slot
+	f     *os.File // temporary file, when made by Create
+	path  string
+}
+
+// NewWriter returns a Writer that writes a database to ws.
+func NewWriter(ws io.WriteSeeker) (*Writer, error) {
+	if _, err := ws.Seek(headersize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &Writer{ws: ws, w: bufio.NewWriter(ws), pos: headersize}, nil
+}
+
+// Create returns a Writer for a new database at path. The database is
+// built in a temporary file and renamed into place by Close, so readers
+// of path never see a partial database.
+func Create(path string) (*Writer, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(f)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	w.f, w.path = f, path
+	return w, nil
+}
+
+// Abort discards a database made by Create, leaving path untouched.
+func (w *Writer) Abort() {
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+	}
+}
+
+func (w *Writer) commit() (err error) {
+	if err = w.f.Sync(); err == nil {
+		err = w.f.Chmod(0644)
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(w.f.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.f.Name())
+	}
+	return
+}
+
+var errtoolarge = errors.New("cdb: database exceeds 4GB")
+
+func (w *Writer) advance(n uint64) error {
+	if uint64(w.pos)+n > math.MaxUint32 {
+		return errtoolarge
+	}
+	w.pos += uint32(n)
+	return nil
+}
+
+func (w *Writer) put32(a, b uint32) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[:4], a)
+	binary.LittleEndian.PutUint32(buf[4:], b)
+	_, err := w.w.Write(buf[:])
+	return err
+}
+
+// Put adds a record. Duplicate keys are allowed; Get returns the first.
+func (w *Writer) Put(key, data []byte) error {
+	pos := w.pos
+	if err := w.advance(8 + uint64(len(key)) + uint64(len(data))); err != nil {
+		return err
+	}
+	if err := w.put32(uint32(len(key)), uint32(len(data))); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(key); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	h := hash(key)
+	w.slots[h%256] = append(w.slots[h%256], slot{hash: h, pos: pos})
+	return nil
+}
+
+// Close writes the hash tables and header, completing the database.
+func (w *Writer) Close() (err error) {
+	if w.f != nil {
+		defer func() {
+			if err != nil {
+				w.Abort()
+				return
+			}
+			err = w.commit()
+		}()
+	}
+	var header [256][2]uint32 // table position and length
+	for i, slots := range w.slots {
+		tlen := uint32(len(slots) * 2)
+		header[i] = [2]uint32{w.pos, tlen}
+		if err = w.advance(uint64(tlen) * 8); err != nil {
+			return
+		}
+		table := make([]slot, tlen)
+		for _, s := range slots {
+			n := (s.hash >> 8) % tlen
+			for table[n].pos != 0 {
+				n = (n + 1) % tlen
+			}
+			table[n] = s
+		}
+		for _, s := range table {
+			if err = w.put32(s.hash, s.pos); err != nil {
+				return
+			}
+		}
+	}
+	if err = w.w.Flush(); err != nil {
+		return
+	}
+	if _, err = w.ws.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	for _, h := range header {
+		if err = w.put32(h[0], h[1]); err != nil {
+			return
+		}
+	}
+	return w.w.Flush()
+}
@@ -0,0 +1,89 @@
+package cdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "test.cdb")
+	w, err := Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 10000
+	for i := 0; i < n; i++ {
+		if err = w.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Put([]byte("key0"), []byte("duplicate")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Put([]byte("empty"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("database visible before Close:", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatalf("key%d: %v", i, err)
+		}
+		if want := fmt.Sprintf("value%d", i); string(v) != want {
+			t.Fatalf("key%d: want %s got %s", i, want, v)
+		}
+	}
+	if v, err := db.Get([]byte("empty")); err != nil || len(v) != 0 {
+		t.Fatalf("empty: got %q, %v", v, err)
+	}
+	if db.Has([]byte("nokey")) || db.Has([]byte("")) {
+		t.Fatal("found missing key")
+	}
+	names, err := filepath.Glob(filepath.Join(td, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("temporary files left behind: %v", names)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	w, err := NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	db, err := Load(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Has([]byte("key")) {
+		t.Fatal("found key in empty database")
+	}
+}
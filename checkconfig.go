@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lvgophers/smtpd/config"
+)
+
+// checkconfig implements the check-config subcommand, reporting every
+// problem with the configuration and optionally printing the effective
+// configuration. It returns the exit status.
+func checkconfig(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	dump := fs.Bool("dump", false, "Print the effective configuration")
+	fs.Parse(args)
+	file, dir := sources()
+	errs, warnings := config.Check(file, dir)
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "error:", err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d error(s)\n", len(errs))
+		return 1
+	}
+	if *dump {
+		conf, err := loadconfig()
+		if err == nil {
+			err = config.Dump(os.Stdout, conf)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+	}
+	return 0
+}
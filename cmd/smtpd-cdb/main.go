@@ -0,0 +1,80 @@
+// Command smtpd-cdb compiles a text control file into a cdb, like
+// qmail-newmrh. Each non-empty line is a key, optionally followed by
+// whitespace and a value; "#" starts a comment. Keys are lowercased
+// unless -keepcase is given. The output is replaced atomically.
+//
+//	smtpd-cdb ~/.smtpd/morercpthosts ~/.smtpd/morercpthosts.cdb
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lvgophers/smtpd/cdb"
+	"github.com/lvgophers/smtpd/logging"
+)
+
+var log = logging.Logger
+
+var keepcase = flag.Bool("keepcase", false, "Don't lowercase keys")
+
+func compile(in, out string) (n int, err error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	w, err := cdb.Create(out)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value := strings.TrimSpace(line), ""
+		if key == "" {
+			continue
+		}
+		if i := strings.IndexAny(key, " \t"); i >= 0 {
+			key, value = key[:i], strings.TrimSpace(key[i:])
+		}
+		if !*keepcase {
+			key = strings.ToLower(key)
+		}
+		if err = w.Put([]byte(key), []byte(value)); err != nil {
+			break
+		}
+		n++
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err != nil {
+		w.Abort()
+		return
+	}
+	return n, w.Close()
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: smtpd-cdb [-keepcase] input output.cdb")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	n, err := compile(flag.Arg(0), flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s: %d records", flag.Arg(1), n)
+}
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AccessRule is a tcprules entry: whether to accept connections from
+// matching clients, and environment settings for their sessions, such as
+// RELAYCLIENT to permit relaying or DATABYTES to override the maximum
+// message size.
+type AccessRule struct {
+	Pattern string
+	Deny    bool
+	Env     map[string]string
+}
+
+// accessrules is a parsed tcprules file. Lines look like
+//
+//	1.2.3.4:deny
+//	10.0.0.0/8:allow,RELAYCLIENT=""
+//	192.168.:allow,RELAYCLIENT="",DATABYTES="20000000"
+//	2001:db8::/32:allow,RELAYCLIENT=""
+//	=mx.example.com:allow,RELAYCLIENT=""
+//	=.dialup.example.net:deny
+//	:allow
+//
+// As with tcpserver, the most specific rule wins: the client address,
+// then its reverse hostname, then address prefixes and CIDR blocks from
+// longest to shortest, then hostname suffixes from longest to shortest,
+// then the default rule with an empty pattern.
+type accessrules struct {
+	path     string
+	lines    []string
+	addrs    map[string]AccessRule
+	hosts    map[string]AccessRule
+	nets     []accessnet // longest prefix first
+	suffixes []string    // longest first, keys of hosts
+	def      *AccessRule
+}
+
+type accessnet struct {
+	net  *net.IPNet
+	rule AccessRule
+}
+
+var rulere = regexp.MustCompile(`^(.*?):(allow|deny)(,.*)?$`)
+
+// parseenv parses tcprules environment settings: VAR="value",VAR=value
+func parseenv(s string) (env map[string]string, err error) {
+	env = make(map[string]string)
+	for s != "" {
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("bad environment setting %q", s)
+		}
+		name, value := s[:i], ""
+		s = s[i+1:]
+		if strings.HasPrefix(s, `"`) {
+			j := strings.IndexByte(s[1:], '"')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated value for %s", name)
+			}
+			value, s = s[1:j+1], s[j+2:]
+		} else if j := strings.IndexByte(s, ','); j >= 0 {
+			value, s = s[:j], s[j:]
+		} else {
+			value, s = s, ""
+		}
+		env[name] = value
+		if s != "" {
+			if s[0] != ',' {
+				return nil, fmt.Errorf("expected , after %s", name)
+			}
+			s = s[1:]
+		}
+	}
+	return
+}
+
+// parsenet parses CIDR blocks and tcprules-style dotted prefixes such as
+// "192.168." into a network.
+func parsenet(pattern string) (*net.IPNet, bool) {
+	if _, n, err := net.ParseCIDR(pattern); err == nil {
+		return n, true
+	}
+	if !strings.HasSuffix(pattern, ".") {
+		return nil, false
+	}
+	octets := strings.Split(strings.TrimSuffix(pattern, "."), ".")
+	if len(octets) > 3 {
+		return nil, false
+	}
+	ip := make(net.IP, 4)
+	for i, o := range octets {
+		n, err := strconv.ParseUint(o, 10, 8)
+		if err != nil {
+			return nil, false
+		}
+		ip[i] = byte(n)
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(octets), 32)}, true
+}
+
+// loadaccessrules reads an optional tcprules file.
+func loadaccessrules(path string) (accessrules, errlist) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newaccessrules(path, nil)
+	}
+	if err != nil {
+		return accessrules{}, errlist{err}
+	}
+	a, errs := newaccessrules(path, strings.Split(string(b), "\n"))
+	a.path = path
+	return a, errs
+}
+
+// newaccessrules parses the lines of a tcprules file. Errors are reported
+// by line number in name, counting comments and blank lines.
+func newaccessrules(name string, lines []string) (a accessrules, errs errlist) {
+	a = accessrules{addrs: make(map[string]AccessRule), hosts: make(map[string]AccessRule)}
+	for i, line := range lines {
+		if j := strings.IndexByte(line, '#'); j >= 0 {
+			line = line[:j]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		a.lines = append(a.lines, line)
+		errorf := func(format string, args ...interface{}) {
+			errs.add(fmt.Errorf("%s:%d: %s", name, i+1, fmt.Sprintf(format, args...)))
+		}
+		m := rulere.FindStringSubmatch(line)
+		if m == nil {
+			errorf("expected pattern:allow or pattern:deny")
+			continue
+		}
+		rule := AccessRule{Pattern: m[1], Deny: m[2] == "deny"}
+		var err error
+		if rule.Env, err = parseenv(strings.TrimPrefix(m[3], ",")); err != nil {
+			errorf("%v", err)
+			continue
+		}
+		p := rule.Pattern
+		switch {
+		case p == "":
+			if a.def == nil {
+				a.def = &rule
+			}
+		case strings.HasPrefix(p, "="):
+			host := canonhost(p[1:])
+			if !validhost(strings.TrimPrefix(host, ".")) {
+				errorf("bad hostname %q", p[1:])
+				continue
+			}
+			if _, dup := a.hosts[host]; dup {
+				continue
+			}
+			a.hosts[host] = rule
+			if strings.HasPrefix(host, ".") {
+				a.suffixes = append(a.suffixes, host)
+			}
+		case net.ParseIP(p) != nil:
+			ip := net.ParseIP(p).String()
+			if _, dup := a.addrs[ip]; !dup {
+				a.addrs[ip] = rule
+			}
+		default:
+			n, ok := parsenet(p)
+			if !ok {
+				errorf("bad address pattern %q", p)
+				continue
+			}
+			a.nets = append(a.nets, accessnet{net: n, rule: rule})
+		}
+	}
+	// Stable sorts keep the first of equally specific rules first.
+	sort.SliceStable(a.nets, func(i, j int) bool {
+		oi, _ := a.nets[i].net.Mask.Size()
+		oj, _ := a.nets[j].net.Mask.Size()
+		return oi > oj
+	})
+	sort.SliceStable(a.suffixes, func(i, j int) bool {
+		return len(a.suffixes[i]) > len(a.suffixes[j])
+	})
+	return
+}
+
+// match returns the rule for a client at ip, calling lookup for its
+// reverse hostname only if there are hostname rules. With no matching
+// rule, the client is allowed.
+func (a accessrules) match(ip net.IP, lookup func() string) AccessRule {
+	if ip != nil {
+		if r, ok := a.addrs[ip.String()]; ok {
+			return r
+		}
+	}
+	var host string
+	if len(a.hosts) > 0 && lookup != nil {
+		host = canonhost(lookup())
+		if r, ok := a.hosts[host]; ok && host != "" {
+			return r
+		}
+	}
+	if ip != nil {
+		for _, n := range a.nets {
+			if n.net.Contains(ip) {
+				return n.rule
+			}
+		}
+	}
+	for _, suffix := range a.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return a.hosts[suffix]
+		}
+	}
+	if a.def != nil {
+		return *a.def
+	}
+	return AccessRule{}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const tcprules = `# trusted networks
+127.0.0.1:allow,RELAYCLIENT=""
+10.0.0.0/8:allow,RELAYCLIENT="",DATABYTES="20000000"
+10.1.:deny
+2001:db8::/32:allow,RELAYCLIENT=""
+=mx.example.com:allow,RELAYCLIENT=""
+=.dialup.example.net:deny
+:allow,DATABYTES=1000
+`
+
+func TestAccess(t *testing.T) {
+	a, errs := newaccessrules("tcprules", strings.Split(tcprules, "\n"))
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	host := func(name string) func() string {
+		return func() string { return name }
+	}
+	for _, tt := range []struct {
+		ip      string
+		host    string
+		pattern string
+		deny    bool
+	}{
+		{"127.0.0.1", "", "127.0.0.1", false},
+		{"10.2.3.4", "", "10.0.0.0/8", false},
+		{"10.1.3.4", "", "10.1.", true},
+		{"2001:db8::25", "", "2001:db8::/32", false},
+		{"2001:db9::25", "", "", false},
+		{"192.0.2.1", "mx.example.com.", "=mx.example.com", false},
+		{"192.0.2.2", "ppp1.Dialup.example.net", "=.dialup.example.net", true},
+		{"10.1.3.4", "mx.example.com", "=mx.example.com", false},
+		{"192.0.2.3", "example.net", "", false},
+	} {
+		r := a.match(net.ParseIP(tt.ip), host(tt.host))
+		if r.Pattern != tt.pattern || r.Deny != tt.deny {
+			t.Errorf("%s (%s): got %q deny %v want %q deny %v", tt.ip, tt.host, r.Pattern, r.Deny, tt.pattern, tt.deny)
+		}
+	}
+	r := a.match(net.ParseIP("10.2.3.4"), nil)
+	if v, ok := r.Env["RELAYCLIENT"]; !ok || v != "" || r.Env["DATABYTES"] != "20000000" {
+		t.Error("unexpected environment", r.Env)
+	}
+	if r = a.match(net.ParseIP("192.0.2.4"), nil); r.Env["DATABYTES"] != "1000" {
+		t.Error("unexpected default environment", r.Env)
+	}
+
+	called := false
+	a, _ = newaccessrules("tcprules", []string{"10.0.0.0/8:deny"})
+	if r = a.match(net.ParseIP("192.0.2.1"), func() string { called = true; return "" }); r.Deny || called {
+		t.Error("expected allow without a hostname lookup, got", r, called)
+	}
+}
+
+func TestAccessErrors(t *testing.T) {
+	_, errs := newaccessrules("tcprules", []string{
+		"# comment",
+		"127.0.0.1:allow",
+		"127.0.0.1:maybe",
+		"300.1.:deny",
+		`10.0.0.0/8:allow,RELAYCLIENT="`,
+		"=bad_host:deny",
+	})
+	want := []string{
+		"tcprules:3: expected pattern:allow or pattern:deny",
+		`tcprules:4: bad address pattern "300.1."`,
+		"tcprules:5: unterminated value for RELAYCLIENT",
+		`tcprules:6: bad hostname "bad_host"`,
+	}
+	if len(errs) != len(want) {
+		t.Fatal("unexpected errors", errs)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), want[i]) {
+			t.Errorf("got %q want %q", err, want[i])
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// addrlist is a qmail badmailfrom-style list of addresses. Entries are
+// full addresses, "@domain" to match every address at domain, or shell
+// patterns such as "*@*.example.com". Matching is case-insensitive.
+type addrlist struct {
+	entries  []string
+	exact    map[string]bool
+	patterns []string
+}
+
+func newaddrlist(name string, entries []string) (l addrlist, err error) {
+	l = addrlist{entries: entries, exact: make(map[string]bool)}
+	for _, e := range entries {
+		e = strings.ToLower(e)
+		if !strings.ContainsAny(e, "*?[") {
+			l.exact[e] = true
+			continue
+		}
+		if _, err = path.Match(e, ""); err != nil {
+			return l, fmt.Errorf("%s: bad pattern %q: %v", name, e, err)
+		}
+		l.patterns = append(l.patterns, e)
+	}
+	return
+}
+
+// match returns the entry matching addr.
+func (l addrlist) match(addr string) (entry string, ok bool) {
+	addr = strings.ToLower(addr)
+	if l.exact[addr] {
+		return addr, true
+	}
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 && l.exact[addr[i:]] {
+		return addr[i:], true
+	}
+	for _, p := range l.patterns {
+		if ok, _ = path.Match(p, addr); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// authusers holds SMTP AUTH credentials, one user:password per line.
+// Passwords are stored in Dovecot's scheme syntax, one of
+//
+//	alice:{SSHA256}base64(sha256(password+salt)+salt)
+//	bob:{SHA256}base64(sha256(password))
+//	carol:{PLAIN}password
+//
+// as produced by "doveadm pw -s SSHA256".
+type authusers struct {
+	path  string
+	names []string
+	users map[string]string
+}
+
+var schemes = []string{"{PLAIN}", "{SHA256}", "{SSHA256}"}
+
+// loadauthusers reads an optional authusers file.
+func loadauthusers(path string) (authusers, errlist) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newauthusers(path, nil)
+	}
+	if err != nil {
+		return authusers{}, errlist{err}
+	}
+	a, errs := newauthusers(path, strings.Split(string(b), "\n"))
+	a.path = path
+	return a, errs
+}
+
+func newauthusers(name string, lines []string) (a authusers, errs errlist) {
+	a.users = make(map[string]string)
+	for i, line := range lines {
+		if line = strings.TrimSpace(line); line == "" || line[0] == '#' {
+			continue
+		}
+		errorf := func(format string, args ...interface{}) {
+			errs.add(fmt.Errorf("%s:%d: %s", name, i+1, fmt.Sprintf(format, args...)))
+		}
+		j := strings.IndexByte(line, ':')
+		if j <= 0 {
+			errorf("expected user:password")
+			continue
+		}
+		user, pass := line[:j], line[j+1:]
+		if _, dup := a.users[user]; dup {
+			errorf("user %q listed twice", user)
+			continue
+		}
+		if err := checkscheme(pass); err != nil {
+			errorf("%s: %v", user, err)
+			continue
+		}
+		a.names = append(a.names, user)
+		a.users[user] = pass
+	}
+	return
+}
+
+func checkscheme(stored string) error {
+	for _, scheme := range schemes {
+		if !strings.HasPrefix(stored, scheme) {
+			continue
+		}
+		if scheme == "{PLAIN}" {
+			return nil
+		}
+		b, err := base64.StdEncoding.DecodeString(stored[len(scheme):])
+		switch {
+		case err != nil:
+			return fmt.Errorf("bad %s password: %v", scheme, err)
+		case scheme == "{SHA256}" && len(b) != sha256.Size,
+			scheme == "{SSHA256}" && len(b) <= sha256.Size:
+			return fmt.Errorf("bad %s password length", scheme)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown password scheme")
+}
+
+// check reports whether password matches the stored password of user.
+func (a authusers) check(user, password string) bool {
+	stored, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(stored, "{PLAIN}"):
+		return subtle.ConstantTimeCompare([]byte(stored[len("{PLAIN}"):]), []byte(password)) == 1
+	case strings.HasPrefix(stored, "{SHA256}"):
+		b, _ := base64.StdEncoding.DecodeString(stored[len("{SHA256}"):])
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare(b, sum[:]) == 1
+	case strings.HasPrefix(stored, "{SSHA256}"):
+		b, _ := base64.StdEncoding.DecodeString(stored[len("{SSHA256}"):])
+		digest, salt := b[:sha256.Size], b[sha256.Size:]
+		sum := sha256.Sum256(bytes.Join([][]byte{[]byte(password), salt}, nil))
+		return subtle.ConstantTimeCompare(digest, sum[:]) == 1
+	}
+	return false
+}
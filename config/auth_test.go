@@ -0,0 +1,62 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestAuthUsers(t *testing.T) {
+	salt := []byte("NaCl")
+	ssha := sha256.Sum256([]byte("s3cret" + string(salt)))
+	sha := sha256.Sum256([]byte("hunter2"))
+	a, errs := newauthusers("authusers", []string{
+		"# users",
+		"alice:{SSHA256}" + base64.StdEncoding.EncodeToString(append(ssha[:], salt...)),
+		"bob:{SHA256}" + base64.StdEncoding.EncodeToString(sha[:]),
+		"carol:{PLAIN}pass:word",
+		"",
+	})
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	for _, tt := range []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"alice", "s3cret", true},
+		{"alice", "s3cretNaCl", false},
+		{"bob", "hunter2", true},
+		{"bob", "hunter3", false},
+		{"carol", "pass:word", true},
+		{"carol", "pass", false},
+		{"dave", "", false},
+	} {
+		if a.check(tt.user, tt.pass) != tt.ok {
+			t.Errorf("%s/%s: want %v", tt.user, tt.pass, tt.ok)
+		}
+	}
+
+	_, errs = newauthusers("authusers", []string{
+		"carol:{PLAIN}a",
+		"carol:{PLAIN}b",
+		"dave",
+		"erin:{MD5}x",
+		"frank:{SHA256}c2hvcnQ=",
+	})
+	want := []string{
+		`authusers:2: user "carol" listed twice`,
+		"authusers:3: expected user:password",
+		"authusers:4: erin: unknown password scheme",
+		"authusers:5: frank: bad {SHA256} password length",
+	}
+	if len(errs) != len(want) {
+		t.Fatal("unexpected errors", errs)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), want[i]) {
+			t.Errorf("got %q want %q", err, want[i])
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Check loads the configuration as NewFile would, returning every problem
+// found instead of just the first, and warnings about settings that are
+// probably mistakes. Either file or configdir may be empty.
+func Check(file, configdir string) (errs []error, warnings []string) {
+	s, el := build(configdir, file)
+	return el, s.warnings
+}
+
+func quote(list []string) string {
+	q := make([]string, len(list))
+	for i, v := range list {
+		q[i] = strconv.Quote(v)
+	}
+	return "[" + strings.Join(q, ", ") + "]"
+}
+
+// Dump writes the effective configuration of i in config file syntax.
+func Dump(w io.Writer, i Interface) error {
+	d, ok := i.(*dir)
+	if !ok {
+		return fmt.Errorf("config: can't dump %T", i)
+	}
+	s := d.current()
+	p := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\n", args...)
+	}
+	p("# effective configuration, from %s", strings.Join(d.sources(), " and "))
+	p("defaulthost = %q", d.DefaultHost())
+	hosts := s.rcpthosts
+	if s.defaulthost != "" {
+		hosts = hosts[1:] // added by build
+	}
+	p("rcpthosts = %s", quote(hosts))
+	if s.morercpthosts != nil {
+		p("morercpthosts = %q", s.morercpthosts.path)
+	}
+	if s.recipients != nil {
+		p("recipients = %q", s.recipients.path)
+	}
+	if s.maildir != "" {
+		p("maildir = %q", s.maildir)
+	}
+	if s.queue != "" {
+		p("queue = %q", s.queue)
+	}
+	if s.access.path != "" {
+		p("tcprules = %q", s.access.path)
+	}
+	if s.auth.path != "" {
+		p("authusers = %q", s.auth.path)
+	}
+	if s.routes.path != "" {
+		p("smtproutes = %q", s.routes.path)
+	}
+	p("doublebounceto = %q", s.bounceto)
+	if s.bouncehost != "" {
+		p("doublebouncehost = %q", s.bouncehost)
+	}
+	p("\n[limits]")
+	p("timeout = %q", s.timeout)
+	p("maxrcpt = %d", s.maxrcpt)
+	p("maxsize = %d", s.maxsize)
+	p("concurrency = %d", s.concurrency)
+	p("concurrencyperip = %d", s.perip)
+	p("queuelifetime = %q", s.queuelifetime)
+	if s.tls != nil {
+		p("\n[tls]")
+		p("cert = %q", s.tls.certfile)
+		p("key = %q", s.tls.keyfile)
+	}
+	p("\n[policy]")
+	p("badmailfrom = %s", quote(s.badmailfrom.entries))
+	p("badrcptto = %s", quote(s.badrcptto.entries))
+	p("bounceonercpt = %v", s.bounceonercpt)
+	p("xclient = %s", quote(s.xclient.entries))
+	p("checkfrom = %v", s.checkfrom)
+	if s.spf.on {
+		p("spf = %s", quote(s.spf.entries))
+	}
+	for _, l := range s.listeners {
+		p("\n[[listener]]")
+		p("network = %q", l.Network)
+		p("addr = %q", l.Addr)
+		if l.Protocol != "smtp" {
+			p("protocol = %q", l.Protocol)
+		}
+		if l.Profile != "mx" {
+			p("profile = %q", l.Profile)
+		}
+		if l.TLS {
+			p("tls = true")
+		}
+		if len(l.Proxy) > 0 {
+			var nets []string
+			for _, n := range l.Proxy {
+				nets = append(nets, n.String())
+			}
+			p("proxy = %s", quote(nets))
+		}
+	}
+	return nil
+}
+
+func (d *dir) sources() (sources []string) {
+	if d.file != "" {
+		sources = append(sources, d.file)
+	}
+	if d.configdir != "" {
+		sources = append(sources, d.configdir)
+	}
+	return
+}
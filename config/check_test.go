@@ -0,0 +1,92 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	for name, content := range map[string]string{
+		"rcpthosts":      "example.com\nbad_host.example\n",
+		"databytes":      "lots\n",
+		"maxrcpt":        "10\n",
+		"servercert.pem": "not a certificate\n",
+		"smtpd.conf":     "[limits]\nmaxrcpt = 20\nmaxsize = -1\n",
+	} {
+		if err = ioutil.WriteFile(filepath.Join(td, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs, warnings := Check(filepath.Join(td, "smtpd.conf"), td)
+	want := []string{
+		`databytes:1: not a non-negative number`,
+		`servercert.pem: tls: failed to find any PEM data`,
+		`smtpd.conf:3: limits.maxsize: must be at least 0`,
+		`rcpthosts: bad hostname "bad_host.example"`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("want %d errors got %d: %v", len(want), len(errs), errs)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), want[i]) {
+			t.Errorf("error %d: want %q got %q", i, want[i], err)
+		}
+	}
+	if len(warnings) != 2 ||
+		!strings.Contains(warnings[0], "smtpd.conf:2: limits.maxrcpt overrides control file maxrcpt") ||
+		!strings.Contains(warnings[1], "smtpd.conf:3: limits.maxsize overrides control file databytes") {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+}
+
+func TestDump(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	writecert(t, td)
+	file := filepath.Join(td, "smtpd.conf")
+	if err = ioutil.WriteFile(file, conffile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := NewFile(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = Dump(&buf, conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`maxsize = 10485760`, `timeout = "30s"`, `badmailfrom = ["@spam.example"]`, `addr = "/run/smtpd.sock"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("dump missing %s:\n%s", want, buf.String())
+		}
+	}
+	dumped := filepath.Join(td, "dumped.conf")
+	if err = ioutil.WriteFile(dumped, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewFile(dumped, "")
+	if err != nil {
+		t.Fatal("dumped config doesn't load: ", err)
+	}
+	var buf2 bytes.Buffer
+	if err = Dump(&buf2, again); err != nil {
+		t.Fatal(err)
+	}
+	first := buf.String()[strings.Index(buf.String(), "\n"):]
+	second := buf2.String()[strings.Index(buf2.String(), "\n"):]
+	if first != second {
+		t.Fatalf("dump doesn't round trip:\n%s\n---\n%s", first, second)
+	}
+}
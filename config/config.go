@@ -1,13 +1,23 @@
+// Package config reads the server configuration from a qmail-style
+// control directory, a config file, or both. Settings in the config
+// file take precedence over the control directory, which takes
+// precedence over the defaults.
 package config
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/lvgophers/smtpd/cdb"
 	"github.com/lvgophers/smtpd/logging"
 )
 
@@ -16,143 +26,586 @@ const (
 	DefaultTimeout = 10 * time.Second
 	DefaultMaxRcpt = 10
 	DefaultMaxSize = 1 * 1024 * 1024 // mpegabyte
+
+	DefaultConcurrencyIncoming = 40 // as with tcpserver
+	DefaultConcurrencyPerIP    = 0  // no limit
+
+	DefaultQueueLifetime = 7 * 24 * time.Hour // as with qmail
 )
 
 // START OMIT
-// Interface is the method set for parsed config files.
+// Interface is the method set for parsed config files. Packages that
+// only need part of it take the narrower interfaces it's made of.
 type Interface interface {
-	Host(name string) bool
+	Hosts
+	Limits
+	Access
+	Policy
+	SPF
+	TLS
+	Routing
+	Concurrency
+	Service
 	Reload() (err error)
+}
+
+// END OMIT
+
+// Hosts tells which domains and addresses mail is accepted for.
+type Hosts interface {
+	Host(name string) bool
+	Recipient(addr string) bool
 	DefaultHost() string
+}
+
+// Limits bounds each session.
+type Limits interface {
 	Timeout() time.Duration
 	MaxRcpt() int
 	MaxSize() int64
 }
 
-// END OMIT
+// Access decides which clients may connect, relay and speak for others.
+type Access interface {
+	Access(ip net.IP, lookup func() string) AccessRule
+	Authenticate(user, password string) bool
+	XClient(ip net.IP) bool
+}
+
+// Policy screens senders, recipients and messages.
+type Policy interface {
+	BadMailFrom(addr string) (entry string, ok bool)
+	BadRcptTo(addr string) (entry string, ok bool)
+	BounceOneRcpt() bool
+	CheckFrom() bool
+}
+
+// SPF gives the action for each result of SPF checks.
+type SPF interface {
+	SPF(result string) string
+}
+
+// TLS gives the server's TLS settings.
+type TLS interface {
+	TLSConfig() *tls.Config
+}
+
+// Routing tells how outbound mail is queued and where it goes.
+type Routing interface {
+	Route(domain string) (route Route, ok bool)
+	Queue() string
+	QueueLifetime() time.Duration
+	DoubleBounceTo() string
+}
+
+// Concurrency bounds the clients served at once.
+type Concurrency interface {
+	ConcurrencyIncoming() int
+	ConcurrencyPerIP() int
+}
+
+// Service tells where the server listens and delivers.
+type Service interface {
+	Listeners() []Listener
+	Maildir() string
+}
+
+// Listener is an address to accept connections on, and how to treat
+// the clients that connect.
+type Listener struct {
+	Network  string // "tcp", "tcp4", "tcp6" or "unix"
+	Addr     string
+	Protocol string // "smtp" or "lmtp"
+	Profile  string // "mx" for mail exchange, or "submission" (RFC 6409)
+	TLS      bool   // implicit TLS, as on port 465
+	// Proxy lists the load balancers trusted to send the client's
+	// address in a PROXY protocol header.
+	Proxy []*net.IPNet
+}
+
+func (l Listener) String() string {
+	s := l.Network + ":" + l.Addr
+	if l.Protocol != "smtp" {
+		s = l.Protocol + "+" + s
+	}
+	if l.TLS {
+		s += " tls"
+	}
+	if l.Profile != "mx" {
+		s += " " + l.Profile
+	}
+	if len(l.Proxy) > 0 {
+		s += fmt.Sprintf(" proxy%v", l.Proxy)
+	}
+	return s
+}
+
+// snapshot is an immutable, fully parsed configuration. Reload builds a
+// new snapshot and swaps it in, so readers never see a partially loaded
+// configuration.
+type snapshot struct {
+	defaulthost   string
+	rcpthosts     []string
+	hosts         hostset
+	morercpthosts *cdbtable
+	recipients    *cdbtable
+	badmailfrom   addrlist
+	badrcptto     addrlist
+	access        accessrules
+	auth          authusers
+	routes        routes
+	timeout       time.Duration
+	maxrcpt       int
+	maxsize       int64 // 0 for no limit, as with qmail's databytes
+	concurrency   int
+	perip         int // 0 for no limit
+	tls           *tlsinfo
+	listeners     []Listener
+	maildir       string
+	queue         string
+	queuelifetime time.Duration
+	bouncehost    string // doublebouncehost, or empty for the default
+	bounceto      string // doublebounceto, or empty to discard double bounces
+	bounceonercpt bool
+	xclient       netlist // clients allowed XCLIENT and XFORWARD
+	checkfrom     bool
+	spf           spfrules
+	fromdir       map[string]string // config file setting to control file
+	warnings      []string
+}
+
+// errlist is every problem found loading a configuration.
+type errlist []error
+
+func (l *errlist) add(err error) {
+	if err != nil {
+		*l = append(*l, err)
+	}
+}
+
+func (l errlist) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// cdbtable is an optional control file in cdb format.
+type cdbtable struct {
+	*cdb.CDB
+	path string
+	sum  [sha256.Size]byte
+}
+
+// loadcdb returns the database at path, or nil if it doesn't exist.
+func loadcdb(path string) (*cdbtable, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+	c, err := cdb.Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: not a cdb file", filepath.Base(path))
+	}
+	return &cdbtable{CDB: c, path: path, sum: sha256.Sum256(b)}, nil
+}
+
+func (t *cdbtable) has(key string) bool {
+	return t != nil && t.Has([]byte(key))
+}
+
+func (t *cdbtable) String() string {
+	if t == nil {
+		return "none"
+	}
+	return fmt.Sprintf("sha256:%x", t.sum[:8])
+}
 
 type dir struct {
-	l           sync.RWMutex
-	configdir   string
-	defaulthost string
-	rcpthosts   []string
+	l         sync.RWMutex
+	configdir string
+	file      string
+	snap      *snapshot
 }
 
 func (d *dir) Timeout() time.Duration {
-	return DefaultTimeout
+	return d.current().timeout
 }
 
 func (d *dir) MaxRcpt() int {
-	return DefaultMaxRcpt
+	return d.current().maxrcpt
 }
 
+// MaxSize returns the maximum message size in bytes.
 func (d *dir) MaxSize() int64 {
-	return DefaultMaxSize
+	if n := d.current().maxsize; n > 0 {
+		return n
+	}
+	return math.MaxInt64
 }
 
-func (d *dir) lock() {
-	d.l.Lock()
+// ConcurrencyIncoming returns the maximum number of simultaneous
+// connections.
+func (d *dir) ConcurrencyIncoming() int {
+	return d.current().concurrency
 }
 
-func (d *dir) unlock() {
-	d.l.Unlock()
+// ConcurrencyPerIP returns the maximum number of simultaneous
+// connections from one client address, or 0 for no limit.
+func (d *dir) ConcurrencyPerIP() int {
+	return d.current().perip
 }
 
-func (d *dir) rlock() {
-	d.l.RLock()
+// TLSConfig returns the server TLS configuration, or nil if no
+// certificate is configured.
+func (d *dir) TLSConfig() *tls.Config {
+	return d.current().tls.config()
 }
 
-func (d *dir) runlock() {
-	d.l.RUnlock()
+// Listeners returns the listeners from the config file.
+func (d *dir) Listeners() []Listener {
+	return d.current().listeners
 }
 
-func (d *dir) rhosts() (err error) {
-	d.lock()
-	defer d.unlock()
-	conffile := filepath.Join(d.configdir, "rcpthosts")
-	f, err := os.Open(conffile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return fmt.Errorf("rcpthosts not found")
+// Maildir returns the maildir from the config file.
+func (d *dir) Maildir() string {
+	return d.current().maildir
+}
+
+// Queue returns the outbound queue directory from the config file.
+func (d *dir) Queue() string {
+	return d.current().queue
+}
+
+// QueueLifetime returns how long undeliverable mail stays queued.
+func (d *dir) QueueLifetime() time.Duration {
+	return d.current().queuelifetime
+}
+
+// DoubleBounceTo returns the address that gets bounces which couldn't
+// be delivered, or an empty string if they are discarded. As with
+// qmail, it is doublebounceto at doublebouncehost, which defaults to
+// the first of rcpthosts.
+func (d *dir) DoubleBounceTo() string {
+	return d.current().doublebounceto()
+}
+
+func (s *snapshot) doublebounceto() string {
+	if s.bounceto == "" {
+		return ""
+	}
+	host := s.bouncehost
+	for _, h := range s.rcpthosts {
+		if host != "" {
+			break
 		}
-		return err
+		if !strings.HasPrefix(h, ".") {
+			host = h
+		}
+	}
+	return s.bounceto + "@" + host
+}
+
+// BounceOneRcpt reports whether mail from the null reverse-path is
+// limited to a single recipient.
+func (d *dir) BounceOneRcpt() bool {
+	return d.current().bounceonercpt
+}
+
+// XClient reports whether the client at ip is a mail proxy trusted to
+// pass on its own clients' details with XCLIENT and XFORWARD.
+func (d *dir) XClient(ip net.IP) bool {
+	return ip != nil && d.current().xclient.contains(ip)
+}
+
+// CheckFrom reports whether submitted messages must be From the
+// authenticated user.
+func (d *dir) CheckFrom() bool {
+	return d.current().checkfrom
+}
+
+// SPF returns the action for mail whose sender's SPF check has result,
+// such as "fail": accept, tag, reject or tempfail. It returns an empty
+// string if SPF isn't checked.
+func (d *dir) SPF(result string) string {
+	return d.current().spf.action(result)
+}
+
+func (d *dir) current() *snapshot {
+	d.l.RLock()
+	defer d.l.RUnlock()
+	return d.snap
+}
+
+func (d *dir) swap(s *snapshot) (old *snapshot) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	old, d.snap = d.snap, s
+	return
+}
+
+// build parses the control directory and config file into a new
+// snapshot, collecting every problem found. Either may be empty.
+func build(configdir, file string) (s *snapshot, errs errlist) {
+	s = &snapshot{
+		timeout:     DefaultTimeout,
+		maxrcpt:     DefaultMaxRcpt,
+		maxsize:     DefaultMaxSize,
+		concurrency: DefaultConcurrencyIncoming,
+		perip:       DefaultConcurrencyPerIP,
+
+		queuelifetime: DefaultQueueLifetime,
+		bounceto:      "postmaster",
+	}
+	if configdir != "" {
+		s.loaddir(configdir, &errs)
 	}
-	defer f.Close()
-	d.rcpthosts = nil
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		if scanner.Text() != "" {
-			d.rcpthosts = append(d.rcpthosts, scanner.Text())
+	if file != "" {
+		s.loadfile(file, &errs)
+	}
+	if s.defaulthost != "" && !validhost(s.defaulthost) {
+		errs.add(fmt.Errorf("defaulthost: bad hostname %q", s.defaulthost))
+	}
+	for _, h := range s.rcpthosts {
+		if !validhost(strings.TrimPrefix(h, ".")) {
+			errs.add(fmt.Errorf("rcpthosts: bad hostname %q", h))
 		}
 	}
-	l := len(d.rcpthosts)
-	if l == 0 {
-		return fmt.Errorf("no rctphosts")
+	if strings.ContainsAny(s.bounceto, "@<> \t") {
+		errs.add(fmt.Errorf("doublebounceto: bad mailbox %q", s.bounceto))
+	}
+	if s.bouncehost != "" && !validhost(s.bouncehost) {
+		errs.add(fmt.Errorf("doublebouncehost: bad hostname %q", s.bouncehost))
 	}
-	if err = scanner.Err(); err == nil {
-		if d.defaulthost != "" {
-			d.rcpthosts = append(d.rcpthosts, d.defaulthost)
-			d.rcpthosts[0], d.rcpthosts[l] = d.rcpthosts[l], d.rcpthosts[0]
+	if s.perip > s.concurrency {
+		s.warnings = append(s.warnings, fmt.Sprintf("concurrencyperip %d exceeds concurrency %d", s.perip, s.concurrency))
+	}
+	if len(s.rcpthosts) == 0 {
+		if file == "" && !exists(filepath.Join(configdir, "rcpthosts")) {
+			errs.add(fmt.Errorf("rcpthosts not found"))
+		} else {
+			errs.add(fmt.Errorf("no rctphosts"))
 		}
+		return
 	}
+	if s.defaulthost != "" {
+		s.rcpthosts = append([]string{s.defaulthost}, s.rcpthosts...)
+	}
+	s.hosts = newhostset(s.rcpthosts)
 	return
 }
 
-func (d *dir) defaulthosts() (err error) {
-	d.lock()
-	defer d.unlock()
-	f, err := os.Open(filepath.Join(d.configdir, "defaulthost"))
-	if err != nil {
-		return
+// load is build returning only valid snapshots.
+func load(configdir, file string) (*snapshot, error) {
+	s, errs := build(configdir, file)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	for _, w := range s.warnings {
+		logging.Logger.Println("config warning:", w)
+	}
+	return s, nil
+}
+
+// diff describes what changed from old to s, one line per change.
+func (s *snapshot) diff(old *snapshot) (changes []string) {
+	if s.defaulthost != old.defaulthost {
+		changes = append(changes, fmt.Sprintf("defaulthost: %q -> %q", old.defaulthost, s.defaulthost))
+	}
+	changes = append(changes, setdiff("rcpthosts", old.rcpthosts, s.rcpthosts)...)
+	if s.morercpthosts.String() != old.morercpthosts.String() {
+		changes = append(changes, fmt.Sprintf("morercpthosts.cdb: %s -> %s", old.morercpthosts, s.morercpthosts))
+	}
+	if s.recipients.String() != old.recipients.String() {
+		changes = append(changes, fmt.Sprintf("recipients.cdb: %s -> %s", old.recipients, s.recipients))
+	}
+	changes = append(changes, setdiff("badmailfrom", old.badmailfrom.entries, s.badmailfrom.entries)...)
+	changes = append(changes, setdiff("badrcptto", old.badrcptto.entries, s.badrcptto.entries)...)
+	changes = append(changes, setdiff("tcprules", old.access.lines, s.access.lines)...)
+	changes = append(changes, setdiff("authusers", old.auth.names, s.auth.names)...)
+	changes = append(changes, setdiff("smtproutes", old.routes.lines, s.routes.lines)...)
+	if s.queuelifetime != old.queuelifetime {
+		changes = append(changes, fmt.Sprintf("queuelifetime: %v -> %v (restart to apply)", old.queuelifetime, s.queuelifetime))
+	}
+	if s.doublebounceto() != old.doublebounceto() {
+		changes = append(changes, fmt.Sprintf("doublebounceto: %q -> %q", old.doublebounceto(), s.doublebounceto()))
+	}
+	if s.bounceonercpt != old.bounceonercpt {
+		changes = append(changes, fmt.Sprintf("bounceonercpt: %v -> %v", old.bounceonercpt, s.bounceonercpt))
+	}
+	if s.checkfrom != old.checkfrom {
+		changes = append(changes, fmt.Sprintf("checkfrom: %v -> %v", old.checkfrom, s.checkfrom))
+	}
+	changes = append(changes, setdiff("xclienthosts", old.xclient.entries, s.xclient.entries)...)
+	if s.spf.on != old.spf.on {
+		changes = append(changes, fmt.Sprintf("spf: %v -> %v", old.spf.on, s.spf.on))
+	}
+	changes = append(changes, setdiff("spf", old.spf.entries, s.spf.entries)...)
+	if s.timeout != old.timeout {
+		changes = append(changes, fmt.Sprintf("timeout: %v -> %v", old.timeout, s.timeout))
+	}
+	if s.maxrcpt != old.maxrcpt {
+		changes = append(changes, fmt.Sprintf("maxrcpt: %d -> %d", old.maxrcpt, s.maxrcpt))
+	}
+	if s.maxsize != old.maxsize {
+		changes = append(changes, fmt.Sprintf("maxsize: %d -> %d", old.maxsize, s.maxsize))
+	}
+	if s.concurrency != old.concurrency {
+		changes = append(changes, fmt.Sprintf("concurrency: %d -> %d", old.concurrency, s.concurrency))
+	}
+	if s.perip != old.perip {
+		changes = append(changes, fmt.Sprintf("concurrencyperip: %d -> %d", old.perip, s.perip))
+	}
+	if s.tls.String() != old.tls.String() {
+		changes = append(changes, fmt.Sprintf("tls: %s -> %s", old.tls, s.tls))
+	}
+	if fmt.Sprint(s.listeners) != fmt.Sprint(old.listeners) {
+		changes = append(changes, fmt.Sprintf("listeners: %v -> %v (restart to apply)", old.listeners, s.listeners))
+	}
+	if s.maildir != old.maildir {
+		changes = append(changes, fmt.Sprintf("maildir: %q -> %q (restart to apply)", old.maildir, s.maildir))
+	}
+	if s.queue != old.queue {
+		changes = append(changes, fmt.Sprintf("queue: %q -> %q (restart to apply)", old.queue, s.queue))
+	}
+	return
+}
+
+func setdiff(name string, old, new []string) (changes []string) {
+	seen := make(map[string]bool, len(old))
+	for _, v := range old {
+		seen[v] = true
+	}
+	for _, v := range new {
+		if !seen[v] {
+			changes = append(changes, fmt.Sprintf("%s: +%s", name, v))
+		}
+		delete(seen, v)
 	}
-	scanner := bufio.NewScanner(f)
-	if scanner.Scan() {
-		if host := scanner.Text(); host != "" {
-			d.defaulthost = host
+	for _, v := range old {
+		if seen[v] {
+			changes = append(changes, fmt.Sprintf("%s: -%s", name, v))
 		}
 	}
 	return
 }
 
+// Reload re-reads the configuration. If the new configuration is
+// invalid, the current one is kept and the error is returned.
 func (d *dir) Reload() error {
-	d.defaulthosts()
-	return d.rhosts()
+	s, err := load(d.configdir, d.file)
+	if err != nil {
+		return err
+	}
+	old := d.swap(s)
+	changes := s.diff(old)
+	if len(changes) == 0 {
+		logging.Logger.Println("config reloaded, no changes")
+	}
+	for _, c := range changes {
+		logging.Logger.Println("config reloaded,", c)
+	}
+	return nil
 }
 
+// Host reports whether name is listed in rcpthosts or morercpthosts.cdb.
 func (d *dir) Host(name string) bool {
-	d.rlock()
-	defer d.runlock()
-	for _, h := range d.rcpthosts {
-		if h == name {
-			return true
-		}
+	s := d.current()
+	if s.hosts.match(name) {
+		return true
+	}
+	if s.morercpthosts == nil {
+		return false
+	}
+	return hostkeys(name, func(key string, wild bool) bool {
+		return s.morercpthosts.has(key)
+	})
+}
+
+// Recipient reports whether addr is a known recipient. Keys in
+// recipients.cdb are lowercase addresses, or "@domain" to accept every
+// mailbox in a domain. Without recipients.cdb every address is known.
+func (d *dir) Recipient(addr string) bool {
+	s := d.current()
+	if s.recipients == nil {
+		return true
+	}
+	addr = strings.ToLower(addr)
+	if s.recipients.has(addr) {
+		return true
+	}
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return s.recipients.has(addr[i:])
 	}
 	return false
 }
 
+// BadMailFrom returns the badmailfrom entry matching the sender addr.
+func (d *dir) BadMailFrom(addr string) (entry string, ok bool) {
+	return d.current().badmailfrom.match(addr)
+}
+
+// BadRcptTo returns the badrcptto entry matching the recipient addr.
+func (d *dir) BadRcptTo(addr string) (entry string, ok bool) {
+	return d.current().badrcptto.match(addr)
+}
+
+// Access returns the tcprules entry for a client at ip. lookup returns
+// the client's reverse hostname, and is only called if a rule needs it.
+func (d *dir) Access(ip net.IP, lookup func() string) AccessRule {
+	return d.current().access.match(ip, lookup)
+}
+
+// Authenticate reports whether password is correct for user in
+// authusers.
+func (d *dir) Authenticate(user, password string) bool {
+	return d.current().auth.check(user, password)
+}
+
+// Route returns the smtproutes entry for mail to domain.
+func (d *dir) Route(domain string) (route Route, ok bool) {
+	return d.current().routes.match(domain)
+}
+
 func (d *dir) DefaultHost() string {
-	if d.defaulthost != "" {
-		return d.defaulthost
+	s := d.current()
+	if s.defaulthost != "" {
+		return s.defaulthost
 	}
-	return d.rcpthosts[0]
+	return strings.TrimPrefix(s.rcpthosts[0], ".")
 }
 
-// New returns a config interface.
-func New(configdir string) (i Interface, err error) {
-	fi, err := os.Stat(configdir)
+func open(configdir, file string) (i Interface, err error) {
+	if configdir != "" {
+		fi, err := os.Stat(configdir)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("not a directory: %s", configdir)
+		}
+	}
+	s, err := load(configdir, file)
 	if err != nil {
 		return
 	}
-	if !fi.IsDir() {
-		return nil, fmt.Errorf("not a directory: %s", configdir)
-	}
-	d := dir{configdir: configdir}
-	err = d.defaulthosts()
-	if err != nil {
+	if s.defaulthost == "" {
 		logging.Logger.Println("Defaulthost not found, will use first rcpthost in greeting.")
 	}
-	if err = d.rhosts(); err != nil {
-		return
-	}
-	return &d, nil
+	return &dir{configdir: configdir, file: file, snap: s}, nil
+}
+
+// New returns a config interface.
+func New(configdir string) (i Interface, err error) {
+	return open(configdir, "")
+}
+
+// NewFile returns a config interface reading the config file, with
+// settings it lacks read from configdir if configdir isn't empty.
+func NewFile(file, configdir string) (i Interface, err error) {
+	return open(configdir, file)
 }
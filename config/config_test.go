@@ -4,9 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/lvgophers/smtpd/cdb"
 )
 
 var hostlist = []byte(`example.com
@@ -29,7 +33,7 @@ func TestConfig(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	d := conf.(*dir)
+	d := conf.(*dir).current()
 	if conf.DefaultHost() != string(defaulthost) {
 		t.Fatalf("defaulthost wrong: want %s got %s", string(defaulthost), conf.DefaultHost())
 	}
@@ -48,4 +52,254 @@ func TestConfig(t *testing.T) {
 	if d.rcpthosts[0] != string(defaulthost) {
 		t.Fatal("first rcpthost isn't default")
 	}
+	if conf.DoubleBounceTo() != "postmaster@"+string(defaulthost) || conf.BounceOneRcpt() {
+		t.Fatalf("bounce defaults wrong: %q %v", conf.DoubleBounceTo(), conf.BounceOneRcpt())
+	}
+	if conf.SPF("fail") != "" {
+		t.Fatal("SPF checked by default")
+	}
+	for name, content := range map[string]string{
+		"doublebounceto": "hostmaster\n", "doublebouncehost": "example.net\n", "bounceonercpt": "1\n",
+		"xclienthosts": "192.0.2.0/24\n127.0.0.1\n", "checkfrom": "1\n",
+		"spf": "fail:reject\nsoftfail : tag # mark it\n",
+	} {
+		if err = ioutil.WriteFile(filepath.Join(td, name), []byte(content), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = conf.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.DoubleBounceTo() != "hostmaster@example.net" || !conf.BounceOneRcpt() {
+		t.Fatalf("bounce settings wrong: %q %v", conf.DoubleBounceTo(), conf.BounceOneRcpt())
+	}
+	if !conf.XClient(net.ParseIP("192.0.2.7")) || !conf.XClient(net.ParseIP("127.0.0.1")) || conf.XClient(net.ParseIP("127.0.0.2")) {
+		t.Fatal("xclienthosts wrong")
+	}
+	if !conf.CheckFrom() {
+		t.Fatal("checkfrom not set")
+	}
+	if conf.SPF("fail") != "reject" || conf.SPF("softfail") != "tag" || conf.SPF("pass") != "accept" {
+		t.Fatalf("spf wrong: %q %q %q", conf.SPF("fail"), conf.SPF("softfail"), conf.SPF("pass"))
+	}
+	// An empty doublebounceto discards double bounces.
+	if err = ioutil.WriteFile(filepath.Join(td, "doublebounceto"), nil, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.DoubleBounceTo() != "" {
+		t.Fatalf("double bounces not discarded: %q", conf.DoubleBounceTo())
+	}
+	if err = ioutil.WriteFile(filepath.Join(td, "timeoutsmtpd"), []byte("0\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.Reload(); err == nil || !strings.Contains(err.Error(), "timeoutsmtpd:1: must be at least 1") {
+		t.Fatalf("zero timeoutsmtpd: got %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	if err = ioutil.WriteFile(filepath.Join(td, "rcpthosts"), hostlist, 0777); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := New(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DefaultHost() != "example.com" {
+		t.Fatalf("defaulthost wrong: want example.com got %s", conf.DefaultHost())
+	}
+	if err = ioutil.WriteFile(filepath.Join(td, "rcpthosts"), []byte("example.edu\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(td, "defaulthost"), defaulthost, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Host("example.com") || !conf.Host("example.edu") {
+		t.Fatal("rcpthosts not reloaded")
+	}
+	if conf.DefaultHost() != string(defaulthost) {
+		t.Fatalf("defaulthost wrong: want %s got %s", string(defaulthost), conf.DefaultHost())
+	}
+	if err = ioutil.WriteFile(filepath.Join(td, "rcpthosts"), nil, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.Reload(); err == nil {
+		t.Fatal("expected error reloading empty rcpthosts")
+	}
+	if !conf.Host("example.edu") {
+		t.Fatal("old config not kept after failed reload")
+	}
+}
+
+var wildhostlist = []byte(`# hosted domains
+Example.COM
+.example.com   # and all subdomains
+.mail.example.net
+example.org.
+`)
+
+func TestHostMatch(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	if err = ioutil.WriteFile(filepath.Join(td, "rcpthosts"), wildhostlist, 0777); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := New(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"example.com":           true,
+		"EXAMPLE.com":           true,
+		"www.example.com":       true,
+		"a.b.example.com":       true,
+		"example.com.":          true,
+		"badexample.com":        false,
+		"example.net":           false,
+		"mail.example.net":      false,
+		"smtp.mail.example.net": true,
+		"example.org":           true,
+		"www.example.org":       false,
+		"# hosted domains":      false,
+		"":                      false,
+	} {
+		if got := conf.Host(name); got != want {
+			t.Errorf("Host(%q): want %v got %v", name, want, got)
+		}
+	}
+	if conf.DefaultHost() != "Example.COM" {
+		t.Fatalf("defaulthost wrong: want Example.COM got %s", conf.DefaultHost())
+	}
+}
+
+func writecdb(t *testing.T, path string, keys ...string) {
+	w, err := cdb.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if err = w.Put([]byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCDB(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	if err = ioutil.WriteFile(filepath.Join(td, "rcpthosts"), hostlist, 0777); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := New(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Host("example.edu") {
+		t.Fatal("bogus host OK")
+	}
+	if !conf.Recipient("anybody@example.com") {
+		t.Fatal("recipient rejected without recipients.cdb")
+	}
+	writecdb(t, filepath.Join(td, "morercpthosts.cdb"), "example.edu", ".example.info")
+	writecdb(t, filepath.Join(td, "recipients.cdb"), "postmaster@example.com", "@example.net")
+	if err = conf.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"example.com":      true,
+		"Example.EDU":      true,
+		"www.example.edu":  false,
+		"www.example.info": true,
+		"example.info":     false,
+	} {
+		if got := conf.Host(name); got != want {
+			t.Errorf("Host(%q): want %v got %v", name, want, got)
+		}
+	}
+	for addr, want := range map[string]bool{
+		"postmaster@example.com": true,
+		"Postmaster@Example.com": true,
+		"nobody@example.com":     false,
+		"anybody@example.net":    true,
+		"example.net":            false,
+	} {
+		if got := conf.Recipient(addr); got != want {
+			t.Errorf("Recipient(%q): want %v got %v", addr, want, got)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(td, "recipients.cdb"), []byte("junk"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.Reload(); err == nil {
+		t.Fatal("expected error reloading bad recipients.cdb")
+	}
+	if conf.Recipient("nobody@example.com") {
+		t.Fatal("old config not kept after failed reload")
+	}
+}
+
+func TestBadMailFromRcptTo(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	if err = ioutil.WriteFile(filepath.Join(td, "rcpthosts"), hostlist, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(td, "badmailfrom"), []byte("spammer@example.net\n@Spam.example\n*@*.dialup.example\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(td, "badrcptto"), []byte("honeypot@example.com\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := New(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]string{
+		"spammer@example.net":          "spammer@example.net",
+		"Spammer@Example.NET":          "spammer@example.net",
+		"anybody@spam.example":         "@spam.example",
+		"anybody@host1.dialup.example": "*@*.dialup.example",
+		"anybody@dialup.example":       "",
+		"nobody@example.net":           "",
+	} {
+		entry, ok := conf.BadMailFrom(addr)
+		if entry != want || ok != (want != "") {
+			t.Errorf("BadMailFrom(%q): want %q got %q, %v", addr, want, entry, ok)
+		}
+	}
+	if _, ok := conf.BadRcptTo("honeypot@example.com"); !ok {
+		t.Fatal("badrcptto not matched")
+	}
+	if _, ok := conf.BadRcptTo("postmaster@example.com"); ok {
+		t.Fatal("unexpected badrcptto match")
+	}
+	if err = ioutil.WriteFile(filepath.Join(td, "badrcptto"), []byte("[bad@example.com\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.Reload(); err == nil {
+		t.Fatal("expected error reloading bad pattern")
+	}
 }
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readlines returns the non-empty lines of a control file with
+// surrounding whitespace and "#" comments removed.
+func readlines(path string) (lines []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// readline returns the first line of an optional control file, or an
+// empty string if it doesn't exist.
+func readline(configdir, name string) (line string, err error) {
+	f, err := os.Open(filepath.Join(configdir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() {
+		line = strings.TrimSpace(scanner.Text())
+	}
+	return line, scanner.Err()
+}
+
+// readint returns the number in an optional control file; ok is false
+// if the file doesn't exist or is empty.
+func readint(configdir, name string) (n int64, ok bool, err error) {
+	line, err := readline(configdir, name)
+	if err != nil || line == "" {
+		return
+	}
+	if n, err = strconv.ParseInt(line, 10, 64); err != nil || n < 0 {
+		return 0, false, fmt.Errorf("%s:1: not a non-negative number: %q", name, line)
+	}
+	return n, true, nil
+}
+
+// loadaddrlist reads an optional address list control file.
+func loadaddrlist(configdir, name string) (addrlist, error) {
+	lines, err := readlines(filepath.Join(configdir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return addrlist{}, err
+	}
+	return newaddrlist(name, lines)
+}
+
+// loadnetlist reads an optional network list control file.
+func loadnetlist(configdir, name string) (netlist, error) {
+	lines, err := readlines(filepath.Join(configdir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return netlist{}, err
+	}
+	return newnetlist(name, lines)
+}
+
+// dirsettings maps config file settings to the control files they
+// override.
+var dirsettings = map[string]string{
+	"defaulthost":        "defaulthost",
+	"rcpthosts":          "rcpthosts",
+	"morercpthosts":      "morercpthosts.cdb",
+	"recipients":         "recipients.cdb",
+	"policy.badmailfrom": "badmailfrom",
+	"policy.badrcptto":   "badrcptto",
+	"tcprules":           "tcprules",
+	"authusers":          "authusers",
+	"smtproutes":         "smtproutes",
+	"doublebounceto":     "doublebounceto",
+	"doublebouncehost":   "doublebouncehost",
+	"limits.timeout":     "timeoutsmtpd",
+	"limits.maxsize":     "databytes",
+	"limits.maxrcpt":     "maxrcpt",
+
+	"limits.concurrency":      "concurrencyincoming",
+	"limits.concurrencyperip": "concurrencyperip",
+	"limits.queuelifetime":    "queuelifetime",
+	"policy.bounceonercpt":    "bounceonercpt",
+	"policy.xclient":          "xclienthosts",
+	"policy.checkfrom":        "checkfrom",
+	"policy.spf":              "spf",
+	"tls.cert":                "servercert.pem",
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// loaddir reads a qmail-style control directory into s. Every control
+// file is optional, though rcpthosts must come from somewhere.
+func (s *snapshot) loaddir(configdir string, errs *errlist) {
+	var err error
+	s.fromdir = make(map[string]string)
+	for setting, name := range dirsettings {
+		if exists(filepath.Join(configdir, name)) {
+			s.fromdir[setting] = name
+		}
+	}
+	s.defaulthost, err = readline(configdir, "defaulthost")
+	errs.add(err)
+	s.rcpthosts, err = readlines(filepath.Join(configdir, "rcpthosts"))
+	if !os.IsNotExist(err) {
+		errs.add(err)
+	}
+	s.morercpthosts, err = loadcdb(filepath.Join(configdir, "morercpthosts.cdb"))
+	errs.add(err)
+	s.recipients, err = loadcdb(filepath.Join(configdir, "recipients.cdb"))
+	errs.add(err)
+	s.badmailfrom, err = loadaddrlist(configdir, "badmailfrom")
+	errs.add(err)
+	s.badrcptto, err = loadaddrlist(configdir, "badrcptto")
+	errs.add(err)
+	var aerrs errlist
+	s.access, aerrs = loadaccessrules(filepath.Join(configdir, "tcprules"))
+	*errs = append(*errs, aerrs...)
+	s.auth, aerrs = loadauthusers(filepath.Join(configdir, "authusers"))
+	*errs = append(*errs, aerrs...)
+	s.routes, aerrs = loadroutes(filepath.Join(configdir, "smtproutes"))
+	*errs = append(*errs, aerrs...)
+	// An empty doublebounceto discards double bounces.
+	if exists(filepath.Join(configdir, "doublebounceto")) {
+		s.bounceto, err = readline(configdir, "doublebounceto")
+		errs.add(err)
+	}
+	s.bouncehost, err = readline(configdir, "doublebouncehost")
+	errs.add(err)
+	s.xclient, err = loadnetlist(configdir, "xclienthosts")
+	errs.add(err)
+	if lines, err := readlines(filepath.Join(configdir, "spf")); err == nil {
+		s.spf, err = newspfrules("spf", lines)
+		errs.add(err)
+	} else if !os.IsNotExist(err) {
+		errs.add(err)
+	}
+	if n, ok, err := readint(configdir, "checkfrom"); ok {
+		s.checkfrom = n != 0
+	} else {
+		errs.add(err)
+	}
+	if n, ok, err := readint(configdir, "bounceonercpt"); ok {
+		s.bounceonercpt = n != 0
+	} else {
+		errs.add(err)
+	}
+	if n, ok, err := readint(configdir, "timeoutsmtpd"); ok && n > 0 {
+		s.timeout = time.Duration(n) * time.Second
+	} else if ok {
+		errs.add(fmt.Errorf("timeoutsmtpd:1: must be at least 1"))
+	} else {
+		errs.add(err)
+	}
+	if n, ok, err := readint(configdir, "queuelifetime"); ok && n > 0 {
+		s.queuelifetime = time.Duration(n) * time.Second
+	} else if ok {
+		errs.add(fmt.Errorf("queuelifetime:1: must be at least 1"))
+	} else {
+		errs.add(err)
+	}
+	if n, ok, err := readint(configdir, "databytes"); ok {
+		s.maxsize = n
+	} else {
+		errs.add(err)
+	}
+	if n, ok, err := readint(configdir, "maxrcpt"); ok && n > 0 {
+		s.maxrcpt = int(n)
+	} else if ok {
+		errs.add(fmt.Errorf("maxrcpt:1: must be at least 1"))
+	} else {
+		errs.add(err)
+	}
+	if n, ok, err := readint(configdir, "concurrencyincoming"); ok && n > 0 {
+		s.concurrency = int(n)
+	} else if ok {
+		errs.add(fmt.Errorf("concurrencyincoming:1: must be at least 1"))
+	} else {
+		errs.add(err)
+	}
+	if n, ok, err := readint(configdir, "concurrencyperip"); ok {
+		s.perip = int(n)
+	} else {
+		errs.add(err)
+	}
+	certfile := filepath.Join(configdir, "servercert.pem")
+	pem, err := ioutil.ReadFile(certfile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			errs.add(err)
+		}
+		return
+	}
+	// As with qmail-tls, servercert.pem holds both certificate and key.
+	s.tls, err = newtlsinfo(certfile, certfile, pem, pem)
+	errs.add(err)
+}
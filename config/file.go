@@ -0,0 +1,349 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A config file is an alternative to the control directory, written in
+// a subset of TOML:
+//
+//	defaulthost = "mx.example.com"
+//	rcpthosts = ["example.com", ".example.com"]
+//	morercpthosts = "morercpthosts.cdb"  # relative to this file
+//	recipients = "recipients.cdb"
+//	maildir = "/var/mail/smtpd"
+//	tcprules = "tcp.smtp"  # access rules, see accessrules
+//	authusers = "users"    # AUTH credentials, see authusers
+//	smtproutes = "routes"  # smarthosts for outbound mail, see routes
+//	queue = "/var/spool/smtpd"  # outbound queue for relayed mail
+//	doublebounceto = "postmaster"  # "" to discard double bounces
+//	doublebouncehost = "example.com"
+//
+//	[limits]
+//	timeout = "30s"       # or a number of seconds
+//	maxrcpt = 100
+//	maxsize = 10_485_760  # bytes, 0 for no limit
+//	concurrency = 40      # simultaneous connections
+//	concurrencyperip = 5  # 0 for no limit
+//	queuelifetime = "168h"  # or a number of seconds
+//
+//	[tls]
+//	cert = "/etc/smtpd/cert.pem"
+//	key = "/etc/smtpd/key.pem"
+//
+//	[policy]
+//	badmailfrom = ["@spam.example"]
+//	badrcptto = ["honeypot@example.com"]
+//	bounceonercpt = true  # bounces may have only one recipient
+//	xclient = ["10.0.0.0/8"]  # mail proxies allowed XCLIENT and XFORWARD
+//	checkfrom = true  # submitted mail must be From the authenticated user
+//	spf = ["fail:reject", "softfail:tag"]  # check SPF, acting on these results
+//
+//	[[listener]]
+//	addr = ":25"
+//
+//	[[listener]]
+//	addr = ":587"
+//	profile = "submission"  # or "mx", the default
+//
+//	[[listener]]
+//	addr = ":465"
+//	profile = "submission"
+//	tls = true  # implicit TLS, using the [tls] certificate
+//	proxy = ["10.0.0.0/8"]  # load balancers sending PROXY headers
+//
+//	[[listener]]
+//	network = "unix"
+//	addr = "/run/smtpd/lmtp.sock"
+//	protocol = "lmtp"  # or "smtp", the default
+//
+// Each setting in the file replaces the corresponding control file.
+
+func (e entry) str() (string, error) {
+	if v, ok := e.value.(string); ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("expected a string")
+}
+
+func (e entry) list() ([]string, error) {
+	if v, ok := e.value.([]string); ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("expected an array of strings")
+}
+
+func (e entry) boolean() (bool, error) {
+	if v, ok := e.value.(bool); ok {
+		return v, nil
+	}
+	return false, fmt.Errorf("expected true or false")
+}
+
+func (e entry) num(min int64) (int64, error) {
+	v, ok := e.value.(int64)
+	if !ok {
+		return 0, fmt.Errorf("expected a number")
+	}
+	if v < min {
+		return 0, fmt.Errorf("must be at least %d", min)
+	}
+	return v, nil
+}
+
+func (e entry) duration() (d time.Duration, err error) {
+	switch v := e.value.(type) {
+	case int64:
+		d = time.Duration(v) * time.Second
+	case string:
+		if d, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	default:
+		return 0, fmt.Errorf("expected a duration")
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return
+}
+
+// fileloader applies config file entries to a snapshot.
+type fileloader struct {
+	s        *snapshot
+	file     string
+	dir      string // relative paths are relative to dir
+	cert     entry
+	key      entry
+	listener []int // line of each [[listener]]
+}
+
+func (f *fileloader) path(e entry) (string, error) {
+	p, err := e.str()
+	if err != nil || p == "" || filepath.IsAbs(p) {
+		return p, err
+	}
+	return filepath.Join(f.dir, p), nil
+}
+
+func (f *fileloader) apply(e entry) (err error) {
+	s := f.s
+	if name, ok := s.fromdir[e.name()]; ok {
+		s.warnings = append(s.warnings, fmt.Sprintf("%s:%d: %s overrides control file %s", f.file, e.line, e.name(), name))
+	}
+	switch e.name() {
+	case "limits", "tls", "policy":
+	case "defaulthost":
+		s.defaulthost, err = e.str()
+	case "rcpthosts":
+		s.rcpthosts, err = e.list()
+	case "morercpthosts", "recipients":
+		var p string
+		var t *cdbtable
+		if p, err = f.path(e); err != nil {
+			return
+		}
+		if t, err = loadcdb(p); err == nil && t == nil {
+			err = fmt.Errorf("%s: no such file", p)
+		}
+		if e.key == "morercpthosts" {
+			s.morercpthosts = t
+		} else {
+			s.recipients = t
+		}
+	case "maildir":
+		s.maildir, err = f.path(e)
+	case "queue":
+		s.queue, err = f.path(e)
+	case "doublebounceto":
+		s.bounceto, err = e.str()
+	case "doublebouncehost":
+		s.bouncehost, err = e.str()
+	case "tcprules", "authusers", "smtproutes":
+		var p string
+		var errs errlist
+		if p, err = f.path(e); err != nil {
+			return
+		}
+		if !exists(p) {
+			return fmt.Errorf("%s: no such file", p)
+		}
+		switch e.key {
+		case "tcprules":
+			s.access, errs = loadaccessrules(p)
+		case "authusers":
+			s.auth, errs = loadauthusers(p)
+		default:
+			s.routes, errs = loadroutes(p)
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+	case "limits.timeout":
+		s.timeout, err = e.duration()
+	case "limits.queuelifetime":
+		s.queuelifetime, err = e.duration()
+	case "limits.maxrcpt":
+		var n int64
+		n, err = e.num(1)
+		s.maxrcpt = int(n)
+	case "limits.maxsize":
+		s.maxsize, err = e.num(0)
+	case "limits.concurrency":
+		var n int64
+		n, err = e.num(1)
+		s.concurrency = int(n)
+	case "limits.concurrencyperip":
+		var n int64
+		n, err = e.num(0)
+		s.perip = int(n)
+	case "tls.cert":
+		f.cert = e
+	case "tls.key":
+		f.key = e
+	case "policy.bounceonercpt":
+		s.bounceonercpt, err = e.boolean()
+	case "policy.checkfrom":
+		s.checkfrom, err = e.boolean()
+	case "policy.xclient":
+		var l []string
+		if l, err = e.list(); err == nil {
+			s.xclient, err = newnetlist(e.key, l)
+		}
+	case "policy.spf":
+		var l []string
+		if l, err = e.list(); err == nil {
+			s.spf, err = newspfrules(e.key, l)
+		}
+	case "policy.badmailfrom", "policy.badrcptto":
+		var l []string
+		var al addrlist
+		if l, err = e.list(); err != nil {
+			return
+		}
+		if al, err = newaddrlist(e.key, l); err != nil {
+			return
+		}
+		if e.key == "badmailfrom" {
+			s.badmailfrom = al
+		} else {
+			s.badrcptto = al
+		}
+	case "listener":
+		s.listeners = append(s.listeners, Listener{Network: "tcp", Protocol: "smtp", Profile: "mx"})
+		f.listener = append(f.listener, e.line)
+	case "listener.network":
+		s.listeners[e.index].Network, err = e.str()
+	case "listener.addr":
+		s.listeners[e.index].Addr, err = e.str()
+	case "listener.protocol":
+		s.listeners[e.index].Protocol, err = e.str()
+	case "listener.profile":
+		s.listeners[e.index].Profile, err = e.str()
+	case "listener.tls":
+		s.listeners[e.index].TLS, err = e.boolean()
+	case "listener.proxy":
+		var l []string
+		var nl netlist
+		if l, err = e.list(); err == nil {
+			nl, err = newnetlist(e.key, l)
+			s.listeners[e.index].Proxy = nl.nets
+		}
+	default:
+		if e.key == "" {
+			return fmt.Errorf("unknown table")
+		}
+		return fmt.Errorf("unknown setting")
+	}
+	return
+}
+
+func (f *fileloader) errorf(line int, format string, args ...interface{}) error {
+	return &fileerror{file: f.file, line: line, msg: fmt.Sprintf(format, args...)}
+}
+
+// finish checks settings that depend on more than one entry.
+func (f *fileloader) finish(errs *errlist) {
+	s := f.s
+	f.loadtls(errs)
+	seen := make(map[string]bool)
+	for i, l := range s.listeners {
+		addr := l.Network + ":" + l.Addr
+		switch {
+		case l.Addr == "":
+			errs.add(f.errorf(f.listener[i], "listener: missing addr"))
+		case l.Network != "tcp" && l.Network != "tcp4" && l.Network != "tcp6" && l.Network != "unix":
+			errs.add(f.errorf(f.listener[i], "listener: unknown network %q", l.Network))
+		case l.Protocol != "smtp" && l.Protocol != "lmtp":
+			errs.add(f.errorf(f.listener[i], "listener: unknown protocol %q", l.Protocol))
+		case l.Profile != "mx" && l.Profile != "submission":
+			errs.add(f.errorf(f.listener[i], "listener: unknown profile %q", l.Profile))
+		case l.Protocol == "lmtp" && l.Profile == "submission":
+			errs.add(f.errorf(f.listener[i], "listener: submission is not for lmtp"))
+		case l.Network == "unix" && len(l.Proxy) > 0:
+			errs.add(f.errorf(f.listener[i], "listener: proxy is for tcp"))
+		case l.TLS && s.tls == nil && f.cert.key == "":
+			errs.add(f.errorf(f.listener[i], "listener: tls without a certificate"))
+		case l.Profile == "submission" && s.tls == nil && f.cert.key == "":
+			errs.add(f.errorf(f.listener[i], "listener: submission without a certificate for STARTTLS"))
+		case seen[addr]:
+			errs.add(f.errorf(f.listener[i], "listener: %s listed twice", addr))
+		case l.Network != "unix":
+			if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+				errs.add(f.errorf(f.listener[i], "listener: %v", err))
+			}
+		}
+		seen[addr] = true
+	}
+}
+
+// loadtls loads the certificate and key from the [tls] table.
+func (f *fileloader) loadtls(errs *errlist) {
+	s := f.s
+	switch {
+	case f.cert.key == "" && f.key.key == "":
+		return
+	case f.cert.key == "":
+		errs.add(f.errorf(f.key.line, "tls: key set without cert"))
+		return
+	case f.key.key == "":
+		errs.add(f.errorf(f.cert.line, "tls: cert set without key"))
+		return
+	}
+	certfile, err := f.path(f.cert)
+	if err != nil {
+		errs.add(f.errorf(f.cert.line, "tls.cert: %v", err))
+		return
+	}
+	keyfile, err := f.path(f.key)
+	if err != nil {
+		errs.add(f.errorf(f.key.line, "tls.key: %v", err))
+		return
+	}
+	if s.tls, err = loadtlsinfo(certfile, keyfile); err != nil {
+		errs.add(f.errorf(f.cert.line, "tls: %v", err))
+	}
+}
+
+// loadfile reads the config file at path into s.
+func (s *snapshot) loadfile(path string, errs *errlist) {
+	fh, err := os.Open(path)
+	if err != nil {
+		errs.add(err)
+		return
+	}
+	defer fh.Close()
+	entries, perrs := parsetoml(path, fh)
+	*errs = append(*errs, perrs...)
+	f := &fileloader{s: s, file: path, dir: filepath.Dir(path)}
+	for _, e := range entries {
+		if err = f.apply(e); err != nil {
+			errs.add(f.errorf(e.line, "%s: %v", e.name(), err))
+		}
+	}
+	f.finish(errs)
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writecert writes a self-signed certificate and key into dir.
+func writecert(t *testing.T, dir string) (certfile, keyfile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.org"},
+		DNSNames:     []string{"example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certfile, keyfile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+var conffile = []byte(`# smtpd.conf
+defaulthost = "example.org"
+rcpthosts = [
+	"example.com",   # primary
+	'.example.com',
+]
+maildir = "mail"
+
+[limits]
+timeout = "30s"
+maxrcpt = 100
+maxsize = 10_485_760
+queuelifetime = "48h"
+
+[tls]
+cert = "cert.pem"
+key = "key.pem"
+
+[policy]
+badmailfrom = ["@spam.example"]
+bounceonercpt = true
+xclient = ["10.0.0.0/8", "::1"]
+checkfrom = true
+spf = ["fail:reject", "permerror:tempfail"]
+
+[[listener]]
+addr = ":25"
+proxy = ["10.0.0.0/8", "192.0.2.1"]
+
+[[listener]]
+addr = ":465"
+profile = "submission"
+tls = true
+
+[[listener]]
+network = "unix"
+addr = "/run/smtpd.sock"
+protocol = "lmtp"
+`)
+
+func TestFile(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	writecert(t, td)
+	file := filepath.Join(td, "smtpd.conf")
+	if err = ioutil.WriteFile(file, conffile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := NewFile(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DefaultHost() != "example.org" {
+		t.Fatalf("defaulthost wrong: want example.org got %s", conf.DefaultHost())
+	}
+	if !conf.Host("example.com") || !conf.Host("www.example.com") || conf.Host("example.net") {
+		t.Fatal("rcpthosts wrong")
+	}
+	if conf.Timeout() != 30*time.Second || conf.MaxRcpt() != 100 || conf.MaxSize() != 10485760 {
+		t.Fatalf("limits wrong: %v %v %v", conf.Timeout(), conf.MaxRcpt(), conf.MaxSize())
+	}
+	if conf.QueueLifetime() != 48*time.Hour {
+		t.Fatalf("queuelifetime wrong: %v", conf.QueueLifetime())
+	}
+	if conf.TLSConfig() == nil {
+		t.Fatal("no TLS config")
+	}
+	if _, ok := conf.BadMailFrom("nobody@spam.example"); !ok {
+		t.Fatal("badmailfrom not applied")
+	}
+	if !conf.BounceOneRcpt() || conf.DoubleBounceTo() != "postmaster@example.org" {
+		t.Fatalf("bounce settings wrong: %v %q", conf.BounceOneRcpt(), conf.DoubleBounceTo())
+	}
+	if !conf.XClient(net.ParseIP("10.1.2.3")) || !conf.XClient(net.IPv6loopback) || conf.XClient(net.ParseIP("192.0.2.1")) {
+		t.Fatal("xclient hosts wrong")
+	}
+	if !conf.CheckFrom() {
+		t.Fatal("checkfrom not set")
+	}
+	if conf.SPF("fail") != "reject" || conf.SPF("permerror") != "tempfail" || conf.SPF("softfail") != "accept" {
+		t.Fatal("spf rules wrong")
+	}
+	if conf.Maildir() != filepath.Join(td, "mail") {
+		t.Fatalf("maildir not relative to config file: %s", conf.Maildir())
+	}
+	want := []Listener{
+		{Network: "tcp", Addr: ":25", Protocol: "smtp", Profile: "mx", Proxy: []*net.IPNet{
+			{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+			{IP: net.IP{192, 0, 2, 1}, Mask: net.CIDRMask(32, 32)},
+		}},
+		{Network: "tcp", Addr: ":465", Protocol: "smtp", Profile: "submission", TLS: true},
+		{Network: "unix", Addr: "/run/smtpd.sock", Protocol: "lmtp", Profile: "mx"},
+	}
+	if l := conf.Listeners(); !reflect.DeepEqual(l, want) {
+		t.Fatalf("listeners wrong: %v", l)
+	}
+}
+
+func TestFilePrecedence(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	if err = ioutil.WriteFile(filepath.Join(td, "rcpthosts"), hostlist, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(td, "defaulthost"), defaulthost, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(td, "databytes"), []byte("2048\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(td, "smtpd.conf")
+	if err = ioutil.WriteFile(file, []byte("defaulthost = \"mx.example.net\"\n[limits]\nmaxrcpt = 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := NewFile(file, td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.DefaultHost() != "mx.example.net" {
+		t.Fatalf("file defaulthost not preferred: %s", conf.DefaultHost())
+	}
+	if !conf.Host("example.net") {
+		t.Fatal("rcpthosts not read from control dir")
+	}
+	if conf.MaxRcpt() != 5 || conf.MaxSize() != 2048 || conf.Timeout() != DefaultTimeout {
+		t.Fatalf("limits wrong: %v %v %v", conf.MaxRcpt(), conf.MaxSize(), conf.Timeout())
+	}
+	if _, err = NewFile(file, ""); err == nil || err.Error() != "no rctphosts" {
+		t.Fatal("expected missing rcpthosts error, got", err)
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	file := filepath.Join(td, "smtpd.conf")
+	for _, c := range []struct {
+		conf, err string
+	}{
+		{"rcpthosts = [\"example.com\"\n\n", ":1: rcpthosts: unterminated array"},
+		{"rcpthosts = [\"a\"]\nfoo = 1\n", ":2: foo: unknown setting"},
+		{"rcpthosts = [\"a\"]\n[bogus]\n", ":2: bogus: unknown table"},
+		{"rcpthosts = [\"a\"]\nrcpthosts = [\"b\"]\n", ":2: rcpthosts already set on line 1"},
+		{"rcpthosts = \"a\"\n", ":1: rcpthosts: expected an array of strings"},
+		{"rcpthosts = [\"a\"]\n[limits]\nmaxrcpt = 0\n", ":3: limits.maxrcpt: must be at least 1"},
+		{"rcpthosts = [\"a\"]\n[limits]\n\ntimeout = \"soon\"\n", ":4: limits.timeout: time: invalid duration"},
+		{"rcpthosts = [\"a\"]\n[[listener]]\nnetwork = \"udp\"\naddr = \":25\"", ":2: listener: unknown network"},
+		{"rcpthosts = [\"a\"]\n[[listener]]\n[[listener]]\naddr = \":25\"", ":2: listener: missing addr"},
+		{"rcpthosts = [\"a\"]\n[[listener]]\naddr = \":24\"\nprotocol = \"qmqp\"", ":2: listener: unknown protocol"},
+		{"rcpthosts = [\"a\"]\n[[listener]]\naddr = \":587\"\nprofile = \"msa\"", ":2: listener: unknown profile"},
+		{"rcpthosts = [\"a\"]\n[[listener]]\naddr = \":465\"\ntls = true", ":2: listener: tls without a certificate"},
+		{"rcpthosts = [\"a\"]\n[[listener]]\naddr = \":587\"\nprofile = \"submission\"", ":2: listener: submission without a certificate"},
+		{"rcpthosts = [\"a\"]\n[[listener]]\naddr = \":25\"\nproxy = [\"10.0.0\"]", ":4: listener.proxy: proxy: bad network"},
+		{"rcpthosts = [\"a\"]\n[[listener]]\nnetwork = \"unix\"\naddr = \"s\"\nproxy = [\"::1\"]", ":2: listener: proxy is for tcp"},
+		{"rcpthosts = [\"a\"]\n[tls]\ncert = \"nope.pem\"\nkey = \"nope.pem\"\n", ":3: tls: open"},
+		{"rcpthosts = [\"a\"]\n[tls]\nkey = \"nope.pem\"\n", ":3: tls: key set without cert"},
+		{"rcpthosts = [\"a\"]\n[policy]\nbadrcptto = [\"[x\"]\n", ":3: policy.badrcptto: badrcptto: bad pattern"},
+		{"rcpthosts = [\"a\"]\n[policy]\nxclient = [\"proxy\"]\n", ":3: policy.xclient: xclient: bad network"},
+		{"rcpthosts = [\"a\"]\n[policy]\nbounceonercpt = \"yes\"\n", ":3: policy.bounceonercpt: expected true or false"},
+		{"rcpthosts = [\"a\"]\n[policy]\nspf = [\"fail:bounce\"]\n", ":3: policy.spf: spf: bad rule"},
+		{"defaulthost = \"a\" \"b\"\n", ":1: defaulthost: unexpected"},
+		{"just words\n", ":1: expected key = value"},
+	} {
+		if err = ioutil.WriteFile(file, []byte(c.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := NewFile(file, "")
+		if err == nil || !strings.Contains(err.Error(), file+c.err) {
+			t.Errorf("%q: want error containing %q, got %v", c.conf, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package config
+
+import "strings"
+
+// hostset is an index of rcpthosts entries. As in qmail, an entry with a
+// leading dot, such as ".example.com", matches every subdomain of
+// example.com but not example.com itself. Matching is case-insensitive.
+type hostset struct {
+	exact map[string]bool
+	wild  map[string]bool // keys keep their leading dot
+}
+
+func newhostset(hosts []string) hostset {
+	h := hostset{exact: make(map[string]bool), wild: make(map[string]bool)}
+	for _, host := range hosts {
+		host = canonhost(host)
+		if strings.HasPrefix(host, ".") {
+			h.wild[host] = true
+		} else {
+			h.exact[host] = true
+		}
+	}
+	return h
+}
+
+func canonhost(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// hostkeys calls fn with name and then each of its parent domains with a
+// leading dot, stopping when fn returns true. It costs one call per label.
+func hostkeys(name string, fn func(key string, wild bool) bool) bool {
+	name = canonhost(name)
+	if fn(name, false) {
+		return true
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; {
+		if fn(name[i:], true) {
+			return true
+		}
+		j := strings.IndexByte(name[i+1:], '.')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return false
+}
+
+func (h hostset) match(name string) bool {
+	return hostkeys(name, func(key string, wild bool) bool {
+		if wild {
+			return h.wild[key]
+		}
+		return h.exact[key]
+	})
+}
+
+// validhost reports whether name is a syntactically valid hostname.
+func validhost(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
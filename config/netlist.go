@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// netlist is a list of networks, given in CIDR notation or as single
+// addresses.
+type netlist struct {
+	entries []string
+	nets    []*net.IPNet
+}
+
+func newnetlist(name string, entries []string) (l netlist, err error) {
+	l.entries = entries
+	for _, e := range entries {
+		n, ok := parsehostnet(e)
+		if !ok {
+			return l, fmt.Errorf("%s: bad network %q", name, e)
+		}
+		l.nets = append(l.nets, n)
+	}
+	return
+}
+
+// contains reports whether ip is in one of the networks.
+func (l netlist) contains(ip net.IP) bool {
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsehostnet parses a network, or a single address as a network of
+// one.
+func parsehostnet(s string) (*net.IPNet, bool) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}, true
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Route is an smtproutes entry: a smarthost to send mail for matching
+// domains through.
+type Route struct {
+	Pattern  string
+	Host     string // empty to deliver to the domain's mail exchangers
+	Port     int
+	TLS      bool // require STARTTLS
+	User     string
+	Password string
+}
+
+// routes is a parsed smtproutes file. As with qmail, lines look like
+//
+//	example.com:relay.example.net
+//	.example.com:relay.example.net:2525
+//	internal.example.com:
+//	:smarthost.example.net:587 tls auth=alice:s3cret
+//
+// A domain, or with a leading dot its subdomains, is sent through the
+// relay, or to its own exchangers if the relay is empty. The empty
+// pattern is the default route. After the relay, "tls" requires STARTTLS
+// and "auth=user:password" logs in with AUTH PLAIN, which needs "tls" unless
+// the relay is localhost.
+type routes struct {
+	path   string
+	lines  []string // passwords masked
+	byname map[string]Route
+	def    *Route
+}
+
+// loadroutes reads an optional smtproutes file.
+func loadroutes(path string) (routes, errlist) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newroutes(path, nil)
+	}
+	if err != nil {
+		return routes{}, errlist{err}
+	}
+	r, errs := newroutes(path, strings.Split(string(b), "\n"))
+	r.path = path
+	return r, errs
+}
+
+func newroutes(name string, lines []string) (r routes, errs errlist) {
+	r.byname = make(map[string]Route)
+	for i, line := range lines {
+		if j := strings.IndexByte(line, '#'); j >= 0 {
+			line = line[:j]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		errorf := func(format string, args ...interface{}) {
+			errs.add(fmt.Errorf("%s:%d: %s", name, i+1, fmt.Sprintf(format, args...)))
+		}
+		route, masked, err := parseroute(line)
+		if err != nil {
+			errorf("%v", err)
+			continue
+		}
+		r.lines = append(r.lines, masked)
+		if route.Pattern == "" {
+			if r.def == nil {
+				r.def = &route
+			}
+			continue
+		}
+		key := canonhost(route.Pattern)
+		if _, dup := r.byname[key]; !dup {
+			r.byname[key] = route
+		}
+	}
+	return
+}
+
+// parseroute parses an smtproutes line, also returning it with any
+// password masked.
+func parseroute(line string) (r Route, masked string, err error) {
+	fields := strings.Fields(line)
+	parts := strings.SplitN(fields[0], ":", 3)
+	if len(parts) < 2 {
+		return r, "", fmt.Errorf("expected domain:relay")
+	}
+	r.Pattern, r.Host, r.Port = parts[0], parts[1], 25
+	if r.Pattern != "" && !validhost(strings.TrimPrefix(r.Pattern, ".")) {
+		return r, "", fmt.Errorf("bad domain %q", r.Pattern)
+	}
+	if ip := strings.Trim(r.Host, "[]"); net.ParseIP(ip) != nil {
+		r.Host = ip
+	} else if r.Host != "" && !validhost(r.Host) {
+		return r, "", fmt.Errorf("bad relay %q", r.Host)
+	}
+	if len(parts) == 3 {
+		if r.Port, err = strconv.Atoi(parts[2]); err != nil || r.Port < 1 || r.Port > 65535 {
+			return r, "", fmt.Errorf("bad port %q", parts[2])
+		}
+	}
+	masked = fields[0]
+	for _, opt := range fields[1:] {
+		switch {
+		case opt == "tls":
+			r.TLS = true
+			masked += " tls"
+		case strings.HasPrefix(opt, "auth="):
+			i := strings.IndexByte(opt, ':')
+			if i < 0 || i == len("auth=") {
+				return r, "", fmt.Errorf("expected auth=user:password")
+			}
+			r.User, r.Password = opt[len("auth="):i], opt[i+1:]
+			masked += " auth=" + r.User + ":*"
+		default:
+			return r, "", fmt.Errorf("unknown option %q", opt)
+		}
+	}
+	if r.Host == "" && (r.TLS || r.User != "") {
+		return r, "", fmt.Errorf("options need a relay")
+	}
+	// As net/smtp's PlainAuth, which would refuse to send it, passwords
+	// only go in the clear to this host.
+	if r.User != "" && !r.TLS && r.Host != "localhost" && r.Host != "127.0.0.1" && r.Host != "::1" {
+		return r, "", fmt.Errorf("auth needs tls")
+	}
+	return
+}
+
+// match returns the route for mail to domain.
+func (r routes) match(domain string) (route Route, ok bool) {
+	hostkeys(domain, func(key string, wild bool) bool {
+		route, ok = r.byname[key]
+		return ok
+	})
+	if !ok && r.def != nil {
+		route, ok = *r.def, true
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	r, errs := newroutes("smtproutes", strings.Split(`# routes
+example.com:relay.example.net
+.example.com:relay.example.net:2525
+internal.example.com:
+literal.example.org:[192.0.2.25]
+local.example.org:localhost:2525 auth=bob:pw
+:smarthost.example.net:587 tls auth=alice:pass:word
+`, "\n"))
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	for _, tt := range []struct {
+		domain, host string
+		port         int
+	}{
+		{"example.com", "relay.example.net", 25},
+		{"Mail.Example.com", "relay.example.net", 2525},
+		{"internal.example.com", "", 25},
+		{"literal.example.org", "192.0.2.25", 25},
+		{"local.example.org", "localhost", 2525},
+		{"other.example.org", "smarthost.example.net", 587},
+	} {
+		route, ok := r.match(tt.domain)
+		if !ok || route.Host != tt.host || route.Port != tt.port {
+			t.Errorf("%s: got %+v want %s:%d", tt.domain, route, tt.host, tt.port)
+		}
+	}
+	route, _ := r.match("example.org")
+	if !route.TLS || route.User != "alice" || route.Password != "pass:word" {
+		t.Errorf("default route options wrong: %+v", route)
+	}
+	if got := strings.Join(r.lines, "\n"); strings.Contains(got, "pass:word") {
+		t.Error("password not masked:", got)
+	}
+
+	if _, ok := (routes{}).match("example.com"); ok {
+		t.Error("unexpected route without smtproutes")
+	}
+
+	_, errs = newroutes("smtproutes", []string{
+		"example.com",
+		"bad_domain:relay",
+		"example.com:relay:99999",
+		"example.com:relay starttls",
+		"example.com: tls",
+		"example.com:relay auth=alice",
+		"example.com:relay auth=alice:pw",
+	})
+	want := []string{
+		"smtproutes:1: expected domain:relay",
+		`smtproutes:2: bad domain "bad_domain"`,
+		`smtproutes:3: bad port "99999"`,
+		`smtproutes:4: unknown option "starttls"`,
+		"smtproutes:5: options need a relay",
+		"smtproutes:6: expected auth=user:password",
+		"smtproutes:7: auth needs tls",
+	}
+	if len(errs) != len(want) {
+		t.Fatal("unexpected errors", errs)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), want[i]) {
+			t.Errorf("got %q want %q", err, want[i])
+		}
+	}
+}
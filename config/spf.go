@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// spfrules are the actions taken on the results of SPF checks, given as
+// lines such as "fail:reject". SPF is checked only if there are rules,
+// if only an empty list of them.
+type spfrules struct {
+	on      bool
+	entries []string
+	actions map[string]string
+}
+
+var spfresults = map[string]bool{
+	"none": true, "neutral": true, "pass": true, "fail": true,
+	"softfail": true, "temperror": true, "permerror": true,
+}
+
+var spfactions = map[string]bool{"accept": true, "tag": true, "reject": true, "tempfail": true}
+
+func newspfrules(name string, entries []string) (r spfrules, err error) {
+	r.on, r.entries, r.actions = true, entries, make(map[string]string)
+	for _, e := range entries {
+		i := strings.IndexByte(e, ':')
+		if i < 0 {
+			return r, fmt.Errorf("%s: bad rule %q: want result:action", name, e)
+		}
+		result := strings.ToLower(strings.TrimSpace(e[:i]))
+		action := strings.ToLower(strings.TrimSpace(e[i+1:]))
+		if !spfresults[result] || !spfactions[action] {
+			return r, fmt.Errorf("%s: bad rule %q", name, e)
+		}
+		r.actions[result] = action
+	}
+	return
+}
+
+// action returns the action for result, or an empty string if SPF
+// isn't checked.
+func (r spfrules) action(result string) string {
+	if !r.on {
+		return ""
+	}
+	if a, ok := r.actions[result]; ok {
+		return a
+	}
+	return "accept"
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+)
+
+// tlsinfo is a loaded server certificate.
+type tlsinfo struct {
+	certfile string
+	keyfile  string
+	cert     tls.Certificate
+	sum      [sha256.Size]byte
+}
+
+func newtlsinfo(certfile, keyfile string, certpem, keypem []byte) (*tlsinfo, error) {
+	cert, err := tls.X509KeyPair(certpem, keypem)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", certfile, err)
+	}
+	return &tlsinfo{certfile: certfile, keyfile: keyfile, cert: cert, sum: sha256.Sum256(cert.Certificate[0])}, nil
+}
+
+func loadtlsinfo(certfile, keyfile string) (*tlsinfo, error) {
+	certpem, err := ioutil.ReadFile(certfile)
+	if err != nil {
+		return nil, err
+	}
+	keypem, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	return newtlsinfo(certfile, keyfile, certpem, keypem)
+}
+
+func (t *tlsinfo) config() *tls.Config {
+	if t == nil {
+		return nil
+	}
+	return &tls.Config{Certificates: []tls.Certificate{t.cert}}
+}
+
+func (t *tlsinfo) String() string {
+	if t == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s sha256:%x", t.certfile, t.sum[:8])
+}
@@ -0,0 +1,254 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// This file parses the subset of TOML used by the config file: comments,
+// [tables], [[arrays of tables]], and key = value pairs whose values are
+// strings, integers, booleans, or arrays of strings, which may span
+// lines. Dotted keys and inline tables are not supported.
+
+// entry is one key = value pair, or with an empty key, a table header.
+type entry struct {
+	line  int
+	table string // "" for top-level keys
+	index int    // element number within an array of tables
+	key   string
+	value interface{} // string, int64, bool or []string
+}
+
+func (e entry) name() string {
+	if e.table == "" || e.key == "" {
+		return e.table + e.key
+	}
+	return e.table + "." + e.key
+}
+
+// fileerror is an error at a line of a config file.
+type fileerror struct {
+	file string
+	line int
+	msg  string
+}
+
+func (e *fileerror) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.file, e.line, e.msg)
+}
+
+func barekey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// scanline removes any comment from line and returns the change in
+// bracket nesting outside of strings.
+func scanline(line string) (code string, depth int) {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '#':
+			return line[:i], depth
+		}
+	}
+	return line, depth
+}
+
+// parsestring parses the string at the start of s.
+func parsestring(s string) (v, rest string, err error) {
+	if s[0] == '\'' {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			v, err = strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("bad string %s", s[:i+1])
+			}
+			return v, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+func parsearray(s string) (list []string, err error) {
+	s = strings.TrimSpace(s[1:])
+	list = []string{}
+	for {
+		if s == "" {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		if s[0] == ']' {
+			break
+		}
+		if s[0] != '"' && s[0] != '\'' {
+			return nil, fmt.Errorf("arrays may only contain strings")
+		}
+		var v string
+		if v, s, err = parsestring(s); err != nil {
+			return
+		}
+		list = append(list, v)
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if !strings.HasPrefix(s, "]") {
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+	if rest := strings.TrimSpace(s[1:]); rest != "" {
+		return nil, fmt.Errorf("unexpected %q after array", rest)
+	}
+	return
+}
+
+func parsevalue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case s[0] == '[':
+		return parsearray(s)
+	case s[0] == '"' || s[0] == '\'':
+		v, rest, err := parsestring(s)
+		if err == nil && strings.TrimSpace(rest) != "" {
+			err = fmt.Errorf("unexpected %q after string", strings.TrimSpace(rest))
+		}
+		return v, err
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad value %q", s)
+	}
+	return n, nil
+}
+
+// parsetoml returns the key = value pairs in r, and an error for each
+// line that couldn't be parsed. Keys under a bad table header are
+// skipped.
+func parsetoml(file string, r io.Reader) (entries []entry, errs errlist) {
+	errorf := func(line int, format string, args ...interface{}) {
+		errs.add(&fileerror{file: file, line: line, msg: fmt.Sprintf(format, args...)})
+	}
+	var (
+		table  string
+		index  int
+		skip   bool
+		lineno int
+		tables = make(map[string]bool) // [table] headers seen
+		arrays = make(map[string]int)  // [[table]] element counts
+		keys   = make(map[string]int)  // line each key was set on
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineno++
+		code, depth := scanline(scanner.Text())
+		line := strings.TrimSpace(code)
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "[["):
+			table, skip = strings.TrimSpace(strings.TrimSuffix(line[2:], "]]")), true
+			switch {
+			case !strings.HasSuffix(line, "]]"):
+				errorf(lineno, "bad table header %s", line)
+			case !barekey(table):
+				errorf(lineno, "bad table name %q", table)
+			case tables[table]:
+				errorf(lineno, "[[%s]] conflicts with [%s]", table, table)
+			default:
+				index, skip = arrays[table], false
+				arrays[table]++
+				entries = append(entries, entry{line: lineno, table: table, index: index})
+			}
+			continue
+		case strings.HasPrefix(line, "["):
+			table, index, skip = strings.TrimSpace(strings.TrimSuffix(line[1:], "]")), 0, true
+			switch {
+			case !strings.HasSuffix(line, "]"):
+				errorf(lineno, "bad table header %s", line)
+			case !barekey(table):
+				errorf(lineno, "bad table name %q", table)
+			case tables[table] || arrays[table] > 0:
+				errorf(lineno, "duplicate table [%s]", table)
+			default:
+				skip = false
+				tables[table] = true
+				entries = append(entries, entry{line: lineno, table: table})
+			}
+			continue
+		}
+		start := lineno
+		for depth > 0 && scanner.Scan() {
+			lineno++
+			code, d := scanline(scanner.Text())
+			line += " " + strings.TrimSpace(code)
+			depth += d
+		}
+		if skip {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			errorf(start, "expected key = value")
+			continue
+		}
+		key, raw := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if !barekey(key) {
+			errorf(start, "bad key %q", key)
+			continue
+		}
+		value, err := parsevalue(raw)
+		if err != nil {
+			errorf(start, "%s: %v", key, err)
+			continue
+		}
+		e := entry{line: start, table: table, index: index, key: key, value: value}
+		id := fmt.Sprintf("%s.%d.%s", table, index, key)
+		if prev, ok := keys[id]; ok {
+			errorf(start, "%s already set on line %d", e.name(), prev)
+			continue
+		}
+		keys[id] = start
+		entries = append(entries, e)
+	}
+	errs.add(scanner.Err())
+	return
+}
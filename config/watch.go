@@ -0,0 +1,116 @@
+package config
+
+import (
+	"os"
+	"time"
+
+	"github.com/lvgophers/smtpd/logging"
+)
+
+// Watch timings.
+const (
+	debounce     = 500 * time.Millisecond
+	pollinterval = 2 * time.Second
+)
+
+// Watch reloads i whenever a file in configdir is created, changed or
+// removed, until done is closed. Bursts of writes are coalesced into a
+// single reload. Change notification uses inotify where available and
+// falls back to polling the directory.
+func Watch(i Interface, configdir string, done <-chan struct{}) {
+	watch(i, configdir, debounce, done)
+}
+
+// watch is Watch, coalescing writes that come within wait of each other.
+func watch(i Interface, configdir string, wait time.Duration, done <-chan struct{}) {
+	events, err := notify(configdir, done)
+	if err != nil {
+		logging.Logger.Println("config watch: polling, notify unavailable:", err)
+		events = poll(configdir, pollinterval, done)
+	}
+	coalesce(events, wait, done, func() {
+		if err := i.Reload(); err != nil {
+			logging.Logger.Println("config reload failed, keeping current config:", err)
+		}
+	})
+}
+
+// coalesce calls fn once events have been quiet for wait.
+func coalesce(events <-chan struct{}, wait time.Duration, done <-chan struct{}, fn func()) {
+	timer := time.NewTimer(wait)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			fn()
+		}
+	}
+}
+
+type fileinfo struct {
+	size  int64
+	mtime time.Time
+}
+
+func dirstate(configdir string) map[string]fileinfo {
+	state := make(map[string]fileinfo)
+	f, err := os.Open(configdir)
+	if err != nil {
+		return state
+	}
+	defer f.Close()
+	fis, _ := f.Readdir(-1)
+	for _, fi := range fis {
+		state[fi.Name()] = fileinfo{size: fi.Size(), mtime: fi.ModTime()}
+	}
+	return state
+}
+
+// poll sends an event whenever the listing of configdir differs from the
+// previous one.
+func poll(configdir string, interval time.Duration, done <-chan struct{}) <-chan struct{} {
+	events := make(chan struct{}, 1)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := dirstate(configdir)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			cur := dirstate(configdir)
+			if changed(last, cur) {
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+			last = cur
+		}
+	}()
+	return events
+}
+
+func changed(a, b map[string]fileinfo) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for name, fa := range a {
+		fb, ok := b[name]
+		if !ok || fa.size != fb.size || !fa.mtime.Equal(fb.mtime) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package config
+
+import "errors"
+
+func notify(configdir string, done <-chan struct{}) (<-chan struct{}, error) {
+	return nil, errors.New("inotify not supported on this platform")
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitfor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testwatch(t *testing.T, watch func(Interface, string, <-chan struct{})) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	if err = ioutil.WriteFile(filepath.Join(td, "rcpthosts"), hostlist, 0777); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := New(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go watch(conf, td, done)
+	time.Sleep(50 * time.Millisecond)
+	if err = ioutil.WriteFile(filepath.Join(td, "rcpthosts"), []byte("example.edu\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	waitfor(t, "rcpthosts reload", func() bool {
+		return conf.Host("example.edu") && !conf.Host("example.com")
+	})
+	if err = ioutil.WriteFile(filepath.Join(td, "defaulthost"), defaulthost, 0777); err != nil {
+		t.Fatal(err)
+	}
+	waitfor(t, "defaulthost reload", func() bool {
+		return conf.DefaultHost() == string(defaulthost) && conf.Host(string(defaulthost))
+	})
+	if err = ioutil.WriteFile(filepath.Join(td, "rcpthosts"), nil, 0777); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !conf.Host("example.edu") {
+		t.Fatal("old config not kept after invalid edit")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	testwatch(t, func(i Interface, configdir string, done <-chan struct{}) {
+		watch(i, configdir, 20*time.Millisecond, done)
+	})
+}
+
+func TestWatchPoll(t *testing.T) {
+	testwatch(t, func(i Interface, configdir string, done <-chan struct{}) {
+		events := poll(configdir, 20*time.Millisecond, done)
+		coalesce(events, 20*time.Millisecond, done, func() { i.Reload() })
+	})
+}
+
+func TestCoalesce(t *testing.T) {
+	events := make(chan struct{})
+	done := make(chan struct{})
+	calls := make(chan struct{}, 10)
+	go coalesce(events, 50*time.Millisecond, done, func() { calls <- struct{}{} })
+	for i := 0; i < 5; i++ {
+		events <- struct{}{}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(150 * time.Millisecond)
+	close(done)
+	if n := len(calls); n != 1 {
+		t.Fatalf("burst of events: want 1 reload got %d", n)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/lvgophers/smtpd/config"
+	"github.com/lvgophers/smtpd/server"
+	"github.com/lvgophers/smtpd/server/session"
+)
+
+// listener is an open listener and its configuration.
+type listener struct {
+	net.Listener
+	conf config.Listener
+}
+
+// options returns the session options for the listener's protocol and
+// profile.
+func (l *listener) options() (opts []session.Option) {
+	if l.conf.Protocol == "lmtp" {
+		opts = append(opts, session.WithLMTP())
+	}
+	if l.conf.Profile == "submission" {
+		opts = append(opts, session.WithSubmission())
+	}
+	return
+}
+
+// sdlistenfdsstart is the first descriptor systemd passes.
+const sdlistenfdsstart = 3
+
+// inherited returns the listening sockets passed by systemd or another
+// supervisor following its LISTEN_FDS protocol, and clears the protocol's
+// variables so they aren't passed on.
+func inherited() (ls []net.Listener, err error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("LISTEN_FDS: bad count %q", os.Getenv("LISTEN_FDS"))
+	}
+	for fd := sdlistenfdsstart; fd < sdlistenfdsstart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("LISTEN_FDS: descriptor %d: %v", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return
+}
+
+// sameaddr reports whether the configured listener c is bound to a.
+func sameaddr(c config.Listener, a net.Addr) bool {
+	if c.Network == "unix" {
+		return a.Network() == "unix" && a.String() == c.Addr
+	}
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ca, err := net.ResolveTCPAddr(c.Network, c.Addr)
+	if err != nil || ca.Port != ta.Port {
+		return false
+	}
+	if ca.IP == nil || ca.IP.IsUnspecified() {
+		return ta.IP.IsUnspecified()
+	}
+	return ca.IP.Equal(ta.IP)
+}
+
+// listen opens the configured listeners, or those from -addr, taking
+// over inherited sockets bound to their addresses. Without configured
+// listeners, inherited sockets are served as plain SMTP.
+func listen(conf config.Interface) (ls []*listener, err error) {
+	confs := conf.Listeners()
+	if flagset("addr") || len(confs) == 0 {
+		confs = nil
+		for _, addr := range strings.Split(*listenaddr, ",") {
+			confs = append(confs, config.Listener{Network: "tcp", Addr: addr, Protocol: "smtp", Profile: "mx"})
+		}
+	}
+	fds, err := inherited()
+	if err != nil {
+		return
+	}
+	if len(fds) > 0 && !flagset("addr") && len(conf.Listeners()) == 0 {
+		for _, l := range fds {
+			a := l.Addr()
+			ls = append(ls, &listener{l, config.Listener{Network: a.Network(), Addr: a.String(), Protocol: "smtp", Profile: "mx"}})
+		}
+		return
+	}
+	for _, c := range confs {
+		var l net.Listener
+		for i, fd := range fds {
+			if fd != nil && sameaddr(c, fd.Addr()) {
+				l, fds[i] = fd, nil
+				break
+			}
+		}
+		if l == nil {
+			if l, err = open(c); err != nil {
+				return nil, err
+			}
+		}
+		if len(c.Proxy) > 0 {
+			l = server.ProxyListener(l, c.Proxy)
+		}
+		if c.TLS {
+			// The certificate may change on reload.
+			l = tls.NewListener(l, &tls.Config{
+				GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+					return conf.TLSConfig(), nil
+				},
+			})
+		}
+		ls = append(ls, &listener{l, c})
+	}
+	for _, fd := range fds {
+		if fd != nil {
+			log.Printf("inherited socket %s matches no listener, closing it", fd.Addr())
+			fd.Close()
+		}
+	}
+	return
+}
+
+// open listens on the address c, replacing a Unix socket left behind by
+// an earlier run.
+func open(c config.Listener) (net.Listener, error) {
+	if c.Network == "unix" {
+		if fi, err := os.Lstat(c.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(c.Addr)
+		}
+	}
+	return net.Listen(c.Network, c.Addr)
+}
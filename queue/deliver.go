@@ -0,0 +1,204 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lvgophers/smtpd/config"
+)
+
+// sessiontimeout bounds a whole SMTP transaction with a mail exchanger.
+var sessiontimeout = 10 * time.Minute
+
+var (
+	nullmx   = &textproto.Error{Code: 556, Msg: "5.1.10 domain does not accept mail"}
+	nodomain = &textproto.Error{Code: 550, Msg: "5.1.2 domain not found"}
+)
+
+// permanent reports whether err is a permanent failure: a 5xx reply.
+func permanent(err error) bool {
+	tpe, ok := err.(*textproto.Error)
+	return ok && tpe.Code >= 500
+}
+
+// settle sets the status of r from the result of delivering to it.
+func settle(r *recipient, err error) {
+	switch {
+	case err == nil:
+		r.status, r.reason = delivered, ""
+	case permanent(err):
+		r.status, r.reason = failed, reason(err)
+	default:
+		r.reason = reason(err)
+	}
+}
+
+// reason describes err for a DSN. SMTP replies keep their wire format,
+// which textproto.Error's Error method doesn't.
+func reason(err error) string {
+	if tpe, ok := err.(*textproto.Error); ok {
+		return fmt.Sprintf("%03d %s", tpe.Code, tpe.Msg)
+	}
+	return err.Error()
+}
+
+// exchangers returns the hosts accepting mail for domain, most preferred
+// first. A domain without MX records is its own exchanger (RFC 5321
+// section 5.1), and a null MX (RFC 7505) accepts no mail. Nor does a
+// domain that doesn't exist, or has no address either.
+func (q *queue) exchangers(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := q.resolver.LookupMX(ctx, domain)
+	if notfound(err) || err == nil && len(mxs) == 0 {
+		// The resolver doesn't tell NXDOMAIN from NODATA, so the
+		// domain's address tells whether it exists.
+		if _, err = q.resolver.LookupIPAddr(ctx, domain); notfound(err) {
+			return nil, nodomain
+		} else if err != nil {
+			return nil, err
+		}
+		return []string{domain}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, nullmx
+	}
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+// notfound reports whether err is a DNS lookup finding no records.
+func notfound(err error) bool {
+	dnserr, ok := err.(*net.DNSError)
+	return ok && dnserr.IsNotFound
+}
+
+// deliver sends the message in body to the recipients at domain, through
+// its smarthost if it has one, or else trying each of its exchangers in
+// turn until one gives an answer.
+func (q *queue) deliver(m *message, domain string, rcpts []*recipient, body io.ReadSeeker) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessiontimeout)
+	defer cancel()
+	var hosts []config.Route
+	route, ok := q.routes(domain)
+	if ok && route.Host != "" {
+		hosts = append(hosts, route)
+	} else {
+		names, err := q.exchangers(ctx, domain)
+		if err != nil {
+			for _, r := range rcpts {
+				settle(r, err)
+			}
+			return
+		}
+		for _, name := range names {
+			hosts = append(hosts, config.Route{Host: name, Port: 25})
+		}
+	}
+	var err error
+	for _, host := range hosts {
+		if err = q.send(ctx, host, m.from, rcpts, body); err == nil || permanent(err) {
+			break
+		}
+		log.Printf("queue: message %s: %s: %v", m.id, host.Host, err)
+	}
+	if err != nil {
+		for _, r := range rcpts {
+			settle(r, err)
+		}
+	}
+}
+
+// send runs an SMTP transaction with host, settling each recipient it
+// gets a reply for. An error means none were settled.
+func (q *queue) send(ctx context.Context, host config.Route, from string, rcpts []*recipient, body io.ReadSeeker) error {
+	conn, err := q.dialer.DialContext(ctx, "tcp", net.JoinHostPort(host.Host, strconv.Itoa(host.Port)))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err = c.Hello(q.hostname); err != nil {
+		return err
+	}
+	if err = q.login(c, host); err != nil {
+		return err
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	var accepted []*recipient
+	for _, r := range rcpts {
+		if err = c.Rcpt(r.Addr); err != nil {
+			settle(r, err)
+			continue
+		}
+		accepted = append(accepted, r)
+	}
+	if len(accepted) > 0 {
+		err = data(c, body)
+		for _, r := range accepted {
+			settle(r, err)
+		}
+	}
+	c.Quit()
+	return nil
+}
+
+// login starts TLS and authenticates as the route requires. Failures
+// are temporary, since they're likely fixed by changing the route.
+func (q *queue) login(c *smtp.Client, route config.Route) error {
+	if route.TLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("STARTTLS required but not offered")
+		}
+		tc := q.tls.Clone()
+		tc.ServerName = route.Host
+		if err := c.StartTLS(tc); err != nil {
+			return fmt.Errorf("STARTTLS: %v", err)
+		}
+	}
+	if route.User == "" {
+		return nil
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return fmt.Errorf("AUTH required but not offered")
+	}
+	if err := c.Auth(smtp.PlainAuth("", route.User, route.Password, route.Host)); err != nil {
+		return fmt.Errorf("AUTH: %v", err)
+	}
+	return nil
+}
+
+func data(c *smtp.Client, body io.ReadSeeker) error {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
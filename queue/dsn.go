@@ -0,0 +1,239 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lvgophers/smtpd/types"
+)
+
+// DSN actions (RFC 3464 section 2.3.3).
+const (
+	Failed    = "failed"
+	Delayed   = "delayed"
+	Delivered = "delivered"
+	Relayed   = "relayed"
+)
+
+// Report is a delivery status notification about one message.
+type Report struct {
+	Envelope *types.Envelope // the message's envelope
+	Arrival  time.Time
+	Results  []Result
+}
+
+// Result is the delivery status of one recipient.
+type Result struct {
+	Rcpt   types.Recipient
+	Action string
+	Status string    // such as "5.1.1"; derived from Reply if empty
+	Reply  string    // the remote server's reply, if any
+	Detail string    // otherwise, what went wrong
+	Until  time.Time // for delayed recipients, when retries stop
+}
+
+var replyre = regexp.MustCompile(`^([245])\d\d[ -](?:([245]\.\d{1,3}\.\d{1,3})\b)?`)
+
+func (r Result) status() string {
+	if r.Status != "" {
+		return r.Status
+	}
+	m := replyre.FindStringSubmatch(r.Reply)
+	switch {
+	case m != nil && m[2] != "":
+		return m[2]
+	case m != nil:
+		return m[1] + ".0.0"
+	case r.Action == Failed:
+		return "5.0.0"
+	case r.Action == Delayed:
+		return "4.0.0"
+	}
+	return "2.0.0"
+}
+
+// event returns the NOTIFY keyword asking for a result with action.
+func event(action string) string {
+	switch action {
+	case Failed:
+		return "FAILURE"
+	case Delayed:
+		return "DELAY"
+	}
+	return "SUCCESS"
+}
+
+// xtext decodes an RFC 3461 xtext, in which "+" and two hex digits
+// stand for a byte.
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// WriteDSN writes rep as an RFC 3464 multipart/report from hostname to
+// the address to. It includes the message read from r, or only its
+// headers unless the sender asked for RET=FULL.
+func WriteDSN(w io.Writer, hostname, to string, rep *Report, r io.Reader) error {
+	env := rep.Envelope
+	boundary := fmt.Sprintf("%x/%s", rand.Int63(), hostname)
+	now := time.Now()
+	subject := "Successful Mail Delivery Report"
+	for _, res := range rep.Results {
+		if res.Action == Delayed {
+			subject = "Delayed Mail (still being retried)"
+		}
+	}
+	for _, res := range rep.Results {
+		if res.Action == Failed {
+			subject = "Undelivered Mail Returned to Sender"
+		}
+	}
+	bw := bufio.NewWriter(w)
+	p := func(format string, args ...interface{}) {
+		fmt.Fprintf(bw, format+"\n", args...)
+	}
+	p("From: Mail Delivery System <MAILER-DAEMON@%s>", hostname)
+	p("To: <%s>", to)
+	p("Subject: %s", subject)
+	p("Date: %s", now.Format(time.RFC1123Z))
+	p("Message-ID: <%d.%x@%s>", now.UnixNano(), rand.Int63(), hostname)
+	p("Auto-Submitted: auto-replied")
+	p("MIME-Version: 1.0")
+	p("Content-Type: multipart/report; report-type=delivery-status;\n\tboundary=\"%s\"", boundary)
+	p("")
+	p("This is a MIME-encapsulated message.")
+	p("")
+	p("--%s", boundary)
+	p("Content-Type: text/plain; charset=us-ascii")
+	p("")
+	p("This is the mail system at %s.", hostname)
+	for _, res := range rep.Results {
+		p("")
+		detail := res.Reply
+		if detail == "" {
+			detail = res.Detail
+		}
+		switch res.Action {
+		case Failed:
+			p("Your message could not be delivered to <%s>:", res.Rcpt.Addr)
+		case Delayed:
+			p("Your message has not yet been delivered to <%s>.", res.Rcpt.Addr)
+			p("Delivery will be retried until %s.", res.Until.Format(time.RFC1123Z))
+		case Relayed:
+			p("Your message was relayed to <%s>, which may not report on its", res.Rcpt.Addr)
+			p("final delivery.")
+		default:
+			p("Your message was delivered to <%s>.", res.Rcpt.Addr)
+		}
+		if detail != "" {
+			p("    %s", detail)
+		}
+	}
+	p("")
+	p("--%s", boundary)
+	p("Content-Type: message/delivery-status")
+	p("")
+	p("Reporting-MTA: dns; %s", hostname)
+	if env.EnvID != "" {
+		p("Original-Envelope-Id: %s", xtext(env.EnvID))
+	}
+	p("Arrival-Date: %s", rep.Arrival.Format(time.RFC1123Z))
+	for _, res := range rep.Results {
+		p("")
+		p("Final-Recipient: rfc822; %s", res.Rcpt.Addr)
+		if res.Rcpt.ORcpt != "" {
+			p("Original-Recipient: %s", xtext(res.Rcpt.ORcpt))
+		}
+		p("Action: %s", res.Action)
+		p("Status: %s", res.status())
+		if res.Reply != "" {
+			p("Diagnostic-Code: smtp; %s", res.Reply)
+		}
+		if res.Action == Delayed {
+			p("Will-Retry-Until: %s", res.Until.Format(time.RFC1123Z))
+		}
+	}
+	p("")
+	p("--%s", boundary)
+	if env.Ret == "FULL" {
+		p("Content-Type: message/rfc822")
+		p("")
+		if _, err := io.Copy(bw, r); err != nil {
+			return err
+		}
+	} else {
+		p("Content-Type: text/rfc822-headers")
+		p("")
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if strings.TrimRight(line, "\r\n") == "" {
+				break
+			}
+			bw.WriteString(line)
+			if err == io.EOF {
+				bw.WriteString("\n")
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	p("")
+	p("--%s--", boundary)
+	return bw.Flush()
+}
+
+// Notify queues a DSN with the results rep's recipients asked for. There
+// is never a DSN for mail with the null reverse-path; if it fails, as
+// with qmail, the postmaster gets a double bounce.
+func (q *queue) Notify(rep *Report, r io.Reader) error {
+	bounce := rep.Envelope.Bounce()
+	wanted := *rep
+	wanted.Results = nil
+	for _, res := range rep.Results {
+		if bounce && res.Action == Failed || !bounce && res.Rcpt.Notifies(event(res.Action)) {
+			wanted.Results = append(wanted.Results, res)
+		}
+	}
+	if len(wanted.Results) == 0 {
+		return nil
+	}
+	to := rep.Envelope.From
+	if bounce {
+		if to = q.postmaster(); to == "" {
+			log.Printf("queue: bounce to %s not delivered, discarded", wanted.Results[0].Rcpt.Addr)
+			return nil
+		}
+	}
+	var buf bytes.Buffer
+	if err := WriteDSN(&buf, q.hostname, to, &wanted, r); err != nil {
+		return err
+	}
+	env := &types.Envelope{Rcpt: []types.Recipient{{Addr: to, Notify: []string{"NEVER"}}}}
+	id, err := q.enqueue(env, bounce, &buf)
+	if err == nil && bounce {
+		log.Printf("queue: double bounce %s to %s", id, to)
+	} else if err == nil {
+		log.Printf("queue: DSN %s to %s", id, to)
+	}
+	return err
+}
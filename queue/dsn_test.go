@@ -0,0 +1,221 @@
+package queue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lvgophers/smtpd/types"
+)
+
+// queued returns the messages in q other than skip.
+func queued(t *testing.T, q *queue, skip string) (ms []*message) {
+	fis, err := ioutil.ReadDir(q.path("mess", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if fi.Name() == skip {
+			continue
+		}
+		m, err := q.read(fi.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ms = append(ms, m)
+	}
+	return
+}
+
+func TestWriteDSN(t *testing.T) {
+	arrival := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, tc := range []struct {
+		ret          string
+		want, unwant []string
+	}{
+		{"", []string{"Content-Type: text/rfc822-headers\n\nSubject: hai\n\n--"}, []string{"Hai!"}},
+		{"HDRS", []string{"Content-Type: text/rfc822-headers\n\nSubject: hai\n\n--"}, []string{"Hai!"}},
+		{"FULL", []string{"Content-Type: message/rfc822\n\n" + email}, nil},
+	} {
+		rep := &Report{
+			Envelope: &types.Envelope{From: "a@example.com", Ret: tc.ret, EnvID: "QQ+2B314"},
+			Arrival:  arrival,
+			Results: []Result{
+				{Rcpt: types.Recipient{Addr: "b@example.net", ORcpt: "rfc822;B+40example.net"},
+					Action: Failed, Reply: "550 5.1.1 no such user"},
+				{Rcpt: types.Recipient{Addr: "c@example.net"}, Action: Delayed,
+					Detail: "connection refused", Until: arrival.Add(time.Hour)},
+			},
+		}
+		var buf bytes.Buffer
+		if err := WriteDSN(&buf, "relay.test", "a@example.com", rep, strings.NewReader(email)); err != nil {
+			t.Fatal(err)
+		}
+		dsn := buf.String()
+		want := append([]string{
+			"To: <a@example.com>\n",
+			"Subject: Undelivered Mail Returned to Sender\n",
+			"Content-Type: multipart/report; report-type=delivery-status;",
+			"Reporting-MTA: dns; relay.test\nOriginal-Envelope-Id: QQ+314\nArrival-Date: Thu, 04 Mar 2021 05:06:07 +0000\n",
+			"Final-Recipient: rfc822; b@example.net\nOriginal-Recipient: rfc822;B@example.net\n" +
+				"Action: failed\nStatus: 5.1.1\nDiagnostic-Code: smtp; 550 5.1.1 no such user\n",
+			"Final-Recipient: rfc822; c@example.net\nAction: delayed\nStatus: 4.0.0\n" +
+				"Will-Retry-Until: Thu, 04 Mar 2021 06:06:07 +0000\n",
+			"    connection refused\n",
+		}, tc.want...)
+		for _, w := range want {
+			if !strings.Contains(dsn, w) {
+				t.Errorf("RET=%s: DSN lacks %q:\n%s", tc.ret, w, dsn)
+			}
+		}
+		for _, w := range tc.unwant {
+			if strings.Contains(dsn, w) {
+				t.Errorf("RET=%s: DSN has %q:\n%s", tc.ret, w, dsn)
+			}
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	q, cleanup := tempqueue(t, WithHostname("relay.test"))
+	defer cleanup()
+	results := []Result{
+		{Rcpt: types.Recipient{Addr: "default@example.net"}, Action: Failed},
+		{Rcpt: types.Recipient{Addr: "never@example.net", Notify: []string{"NEVER"}}, Action: Failed},
+		{Rcpt: types.Recipient{Addr: "success@example.net", Notify: []string{"SUCCESS"}}, Action: Failed},
+		{Rcpt: types.Recipient{Addr: "delivered@example.net", Notify: []string{"SUCCESS"}}, Action: Delivered},
+		{Rcpt: types.Recipient{Addr: "quiet@example.net"}, Action: Delivered},
+	}
+
+	// Never a DSN for a DSN. Without a postmaster, failures are
+	// discarded.
+	rep := &Report{Envelope: &types.Envelope{}, Arrival: time.Now(), Results: results}
+	if err := q.Notify(rep, strings.NewReader(email)); err != nil {
+		t.Fatal(err)
+	}
+	if ms := queued(t, q, ""); len(ms) != 0 {
+		t.Fatalf("DSN queued for the null sender: %v", ms)
+	}
+
+	rep.Envelope.From = "a@example.com"
+	if err := q.Notify(rep, strings.NewReader(email)); err != nil {
+		t.Fatal(err)
+	}
+	ms := queued(t, q, "")
+	if len(ms) != 1 {
+		t.Fatalf("expected one DSN, got %d", len(ms))
+	}
+	m := ms[0]
+	if m.from != "" || len(m.rcpt) != 1 || m.rcpt[0].Addr != "a@example.com" ||
+		len(m.rcpt[0].Notify) != 1 || m.rcpt[0].Notify[0] != "NEVER" {
+		t.Errorf("unexpected DSN envelope: from %q to %+v", m.from, m.rcpt)
+	}
+	b, err := ioutil.ReadFile(q.path("mess", m.id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"default@example.net", "delivered@example.net"} {
+		if !strings.Contains(string(b), "Final-Recipient: rfc822; "+addr+"\n") {
+			t.Errorf("DSN lacks %s", addr)
+		}
+	}
+	for _, addr := range []string{"never@example.net", "success@example.net", "quiet@example.net"} {
+		if strings.Contains(string(b), addr) {
+			t.Errorf("DSN reports %s", addr)
+		}
+	}
+}
+
+func TestDelayWarning(t *testing.T) {
+	q, cleanup := tempqueue(t, WithResolver(fakedns{}), WithDialer(&fakedialer{}),
+		WithBackoff(time.Minute, 10*time.Minute), WithLifetime(24*time.Hour))
+	defer cleanup()
+	env := envelope("a@example.com", "b@example.net")
+	env.Rcpt[0].ORcpt = "rfc822;b@example.net"
+	id, err := q.Enqueue(env, strings.NewReader(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.flush(now).Wait()
+	if ms := queued(t, q, id); len(ms) != 0 {
+		t.Fatal("delay reported too soon")
+	}
+	q.flush(now.Add(delaywarning)).Wait()
+	ms := queued(t, q, id)
+	if len(ms) != 1 {
+		t.Fatalf("expected a delay warning, got %d messages", len(ms))
+	}
+	b, err := ioutil.ReadFile(q.path("mess", ms[0].id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Subject: Delayed Mail (still being retried)\n",
+		"Original-Recipient: rfc822;b@example.net\nAction: delayed\nStatus: 4.0.0\n",
+		"Will-Retry-Until: ",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("warning lacks %q:\n%s", want, b)
+		}
+	}
+	// The warning is sent once; the DSN itself is never reported on.
+	q.flush(now.Add(delaywarning + time.Hour)).Wait()
+	if ms = queued(t, q, id); len(ms) != 1 {
+		t.Errorf("expected one warning, got %d messages", len(ms))
+	}
+}
+
+func TestDoubleBounce(t *testing.T) {
+	zone := fakedns{
+		"example.org": {{Host: ".", Pref: 0}},
+		"relay.test":  {{Host: ".", Pref: 0}},
+	}
+	postmaster := "postmaster@relay.test"
+	q, cleanup := tempqueue(t, WithResolver(zone), WithDialer(&fakedialer{}), WithHostname("relay.test"),
+		WithDoubleBounceTo(func() string { return postmaster }))
+	defer cleanup()
+	env := envelope("", "b@example.org")
+	env.Rcpt[0].Notify = []string{"NEVER"}
+	id, err := q.Enqueue(env, strings.NewReader(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.flush(now).Wait()
+	ms := queued(t, q, "")
+	if len(ms) != 1 || ms[0].id == id {
+		t.Fatalf("expected only a double bounce, got %d messages", len(ms))
+	}
+	m := ms[0]
+	if !m.double || m.from != "" || len(m.rcpt) != 1 || m.rcpt[0].Addr != postmaster {
+		t.Errorf("unexpected double bounce: from %q to %+v", m.from, m.rcpt)
+	}
+	b, err := ioutil.ReadFile(q.path("mess", m.id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: <" + postmaster + ">\n", "Final-Recipient: rfc822; b@example.org\n"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("double bounce lacks %q:\n%s", want, b)
+		}
+	}
+	// The postmaster can't be reached either: the triple bounce is
+	// discarded.
+	q.flush(now.Add(time.Minute)).Wait()
+	if ms = queued(t, q, ""); len(ms) != 0 {
+		t.Errorf("expected an empty queue, got %d messages", len(ms))
+	}
+
+	// Without a postmaster, double bounces are discarded.
+	postmaster = ""
+	if _, err = q.Enqueue(env, strings.NewReader(email)); err != nil {
+		t.Fatal(err)
+	}
+	q.flush(now.Add(2 * time.Minute)).Wait()
+	if ms = queued(t, q, ""); len(ms) != 0 {
+		t.Errorf("expected an empty queue, got %d messages", len(ms))
+	}
+}
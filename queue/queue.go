@@ -0,0 +1,376 @@
+// Package queue is an on-disk queue of outbound mail, laid out like
+// qmail's: a message's body is in mess, its envelope in info and its
+// remote recipients in remote, each file named by the message id.
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lvgophers/smtpd/config"
+	"github.com/lvgophers/smtpd/logging"
+	"github.com/lvgophers/smtpd/types"
+)
+
+var log = logging.Logger
+
+// Default constants.
+const (
+	DefaultLifetime   = 7 * 24 * time.Hour // as with qmail's queuelifetime
+	DefaultMinBackoff = time.Minute
+	DefaultMaxBackoff = 4 * time.Hour
+	DefaultRemote     = 20 // simultaneous deliveries, as with concurrencyremote
+)
+
+// Interface is the interface to the outbound queue.
+type Interface interface {
+	// Enqueue adds the message read from r with the envelope env, and
+	// returns its id.
+	Enqueue(env *types.Envelope, r io.Reader) (id string, err error)
+	// Notify queues a delivery status notification to the sender of
+	// rep's message, read from r, for the recipients that asked for one.
+	// Failures of bounces go to the postmaster instead.
+	Notify(rep *Report, r io.Reader) error
+	// Run delivers queued messages until done is closed.
+	Run(done <-chan struct{})
+}
+
+// Resolver looks up mail exchangers. *net.Resolver is a Resolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Dialer connects to mail exchangers. *net.Dialer is a Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type queue struct {
+	dir        string
+	hostname   string
+	resolver   Resolver
+	dialer     Dialer
+	routes     func(domain string) (config.Route, bool)
+	postmaster func() string
+	tls        *tls.Config
+	lifetime   time.Duration
+	minbackoff time.Duration
+	maxbackoff time.Duration
+	remote     int
+	wake       chan struct{}
+
+	l    sync.Mutex
+	busy map[string]bool // messages being delivered
+	sem  chan struct{}
+}
+
+// Option configures a queue.
+type Option func(*queue)
+
+// WithHostname sets the name the queue greets mail exchangers with.
+func WithHostname(name string) Option {
+	return func(q *queue) {
+		q.hostname = name
+	}
+}
+
+// WithResolver sets the resolver used to find mail exchangers.
+func WithResolver(r Resolver) Option {
+	return func(q *queue) {
+		q.resolver = r
+	}
+}
+
+// WithDialer sets the dialer used to connect to mail exchangers.
+func WithDialer(d Dialer) Option {
+	return func(q *queue) {
+		q.dialer = d
+	}
+}
+
+// WithRoutes sets the smarthost lookup, such as config.Routing's
+// Route method. Unrouted mail goes to the domain's exchangers.
+func WithRoutes(routes func(domain string) (config.Route, bool)) Option {
+	return func(q *queue) {
+		q.routes = routes
+	}
+}
+
+// WithDoubleBounceTo sets the function returning the address that gets
+// bounces which couldn't be delivered, such as config.Routing's
+// DoubleBounceTo method. If it returns an empty string, or without one,
+// they are discarded.
+func WithDoubleBounceTo(postmaster func() string) Option {
+	return func(q *queue) {
+		q.postmaster = postmaster
+	}
+}
+
+// WithTLSConfig sets the client TLS configuration for STARTTLS with
+// smarthosts. The server name is set for each connection.
+func WithTLSConfig(c *tls.Config) Option {
+	return func(q *queue) {
+		q.tls = c
+	}
+}
+
+// WithLifetime sets how long messages are retried before they bounce.
+func WithLifetime(d time.Duration) Option {
+	return func(q *queue) {
+		q.lifetime = d
+	}
+}
+
+// WithBackoff sets the first and longest delays between delivery
+// attempts. The delay doubles after each attempt.
+func WithBackoff(min, max time.Duration) Option {
+	return func(q *queue) {
+		q.minbackoff, q.maxbackoff = min, max
+	}
+}
+
+var dirnames = []string{"tmp", "mess", "info", "remote"}
+
+// New returns a queue in dir, creating its subdirectories if needed.
+func New(dir string, opts ...Option) (i Interface, err error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+	for _, name := range dirnames {
+		if err = os.MkdirAll(filepath.Join(dir, name), 0700); err != nil {
+			return
+		}
+	}
+	q := &queue{
+		dir:        dir,
+		hostname:   "localhost",
+		resolver:   net.DefaultResolver,
+		dialer:     &net.Dialer{Timeout: time.Minute},
+		routes:     func(string) (config.Route, bool) { return config.Route{}, false },
+		postmaster: func() string { return "" },
+		tls:        &tls.Config{},
+		lifetime:   DefaultLifetime,
+		minbackoff: DefaultMinBackoff,
+		maxbackoff: DefaultMaxBackoff,
+		remote:     DefaultRemote,
+		wake:       make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	q.busy = make(map[string]bool)
+	q.sem = make(chan struct{}, q.remote)
+	return q, nil
+}
+
+func (q *queue) path(sub, id string) string {
+	return filepath.Join(q.dir, sub, id)
+}
+
+// write atomically writes the file sub/id with content from fn.
+func (q *queue) write(sub, id string, fn func(w io.Writer) error) (err error) {
+	tmp := q.path("tmp", sub+"."+id)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	if err = fn(w); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, q.path(sub, id))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+func (q *queue) Enqueue(env *types.Envelope, r io.Reader) (id string, err error) {
+	return q.enqueue(env, false, r)
+}
+
+// enqueue writes the envelope first and the message last, so a message
+// is only in the queue once its file is in mess.
+func (q *queue) enqueue(env *types.Envelope, double bool, r io.Reader) (id string, err error) {
+	if len(env.Rcpt) == 0 {
+		return "", fmt.Errorf("queue: no recipients")
+	}
+	id = fmt.Sprintf("%d.%x", time.Now().UnixNano(), rand.Int63())
+	m := &message{id: id, from: env.From, ret: env.Ret, envid: env.EnvID, birth: time.Now(), double: double}
+	for _, rcpt := range env.Rcpt {
+		m.rcpt = append(m.rcpt, &recipient{Recipient: rcpt, status: pending})
+	}
+	defer func() {
+		if err != nil {
+			q.remove(id)
+		}
+	}()
+	if err = q.writeinfo(m); err != nil {
+		return
+	}
+	if err = q.writeremote(m); err != nil {
+		return
+	}
+	err = q.write("mess", id, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err == nil {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return
+}
+
+func (q *queue) remove(id string) {
+	for _, sub := range []string{"mess", "info", "remote"} {
+		os.Remove(q.path(sub, id))
+	}
+}
+
+// Recipient statuses, the first byte of each line in remote.
+const (
+	pending   = 'T'
+	delivered = 'D'
+	failed    = 'P'
+)
+
+type recipient struct {
+	types.Recipient
+	status byte
+	reason string // last error, for failed and deferred recipients
+}
+
+// message is a queued message's envelope and delivery state. info holds
+// lines starting F (sender), R and E (the DSN RET and ENVID), B (time
+// queued), A (attempts so far), N (next attempt), W (delay reported)
+// and D (a double bounce);
+// remote holds a line per recipient: its status and address, then tab
+// separated the reason for failures and the DSN NOTIFY and ORCPT.
+type message struct {
+	id       string
+	from     string
+	ret      string
+	envid    string
+	birth    time.Time
+	attempts int
+	next     time.Time
+	warned   bool
+	double   bool // a bounce of a bounce, which is never reported on
+	rcpt     []*recipient
+}
+
+func (q *queue) writeinfo(m *message) error {
+	return q.write("info", m.id, func(w io.Writer) error {
+		fmt.Fprintf(w, "F%s\nB%d\nA%d\nN%d\n", m.from, m.birth.Unix(), m.attempts, m.next.Unix())
+		if m.ret != "" {
+			fmt.Fprintf(w, "R%s\n", m.ret)
+		}
+		if m.envid != "" {
+			fmt.Fprintf(w, "E%s\n", m.envid)
+		}
+		if m.warned {
+			fmt.Fprintf(w, "W\n")
+		}
+		if m.double {
+			fmt.Fprintf(w, "D\n")
+		}
+		return nil
+	})
+}
+
+func (q *queue) writeremote(m *message) error {
+	return q.write("remote", m.id, func(w io.Writer) error {
+		for _, r := range m.rcpt {
+			reason := strings.NewReplacer("\n", " ", "\t", " ").Replace(r.reason)
+			fmt.Fprintf(w, "%c%s\t%s\t%s\t%s\n", r.status, r.Addr, reason, strings.Join(r.Notify, ","), r.ORcpt)
+		}
+		return nil
+	})
+}
+
+// read returns the envelope of the message id.
+func (q *queue) read(id string) (m *message, err error) {
+	m = &message{id: id}
+	info, err := ioutil.ReadFile(q.path("info", id))
+	if err != nil {
+		return
+	}
+	for _, line := range bytes.Split(info, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		v := string(line[1:])
+		switch line[0] {
+		case 'F':
+			m.from = v
+		case 'R':
+			m.ret = v
+		case 'E':
+			m.envid = v
+		case 'W':
+			m.warned = true
+		case 'D':
+			m.double = true
+		case 'B', 'N':
+			var n int64
+			if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("%s: %v", q.path("info", id), err)
+			}
+			if line[0] == 'B' {
+				m.birth = time.Unix(n, 0)
+			} else {
+				m.next = time.Unix(n, 0)
+			}
+		case 'A':
+			if m.attempts, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("%s: %v", q.path("info", id), err)
+			}
+		}
+	}
+	remote, err := ioutil.ReadFile(q.path("remote", id))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(remote), "\n") {
+		if line == "" {
+			continue
+		}
+		f := append(strings.Split(line[1:], "\t"), "", "", "")
+		r := &recipient{status: line[0], reason: f[1]}
+		r.Addr, r.ORcpt = f[0], f[3]
+		if f[2] != "" {
+			r.Notify = strings.Split(f[2], ",")
+		}
+		m.rcpt = append(m.rcpt, r)
+	}
+	return
+}
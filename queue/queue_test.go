@@ -0,0 +1,409 @@
+package queue
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lvgophers/smtpd/config"
+	"github.com/lvgophers/smtpd/types"
+)
+
+const email = "Subject: hai\n\nHai!\n"
+
+func envelope(from string, rcpt ...string) *types.Envelope {
+	env := &types.Envelope{From: from}
+	for _, addr := range rcpt {
+		env.Rcpt = append(env.Rcpt, types.Recipient{Addr: addr})
+	}
+	return env
+}
+
+func tempqueue(t *testing.T, opts ...Option) (*queue, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := New(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q.(*queue), func() { os.RemoveAll(dir) }
+}
+
+func TestEnqueue(t *testing.T) {
+	q, cleanup := tempqueue(t)
+	defer cleanup()
+	id, err := q.Enqueue(envelope("a@example.com", "b@example.net", "c@example.org"), strings.NewReader(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(q.path("mess", id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != email {
+		t.Errorf("mess: got %q want %q", b, email)
+	}
+	m, err := q.read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.from != "a@example.com" || len(m.rcpt) != 2 || m.rcpt[1].Addr != "c@example.org" || m.rcpt[1].status != pending {
+		t.Errorf("unexpected envelope %+v", m)
+	}
+	if names, _ := filepath.Glob(q.path("tmp", "*")); len(names) != 0 {
+		t.Error("unexpected files left in tmp:", names)
+	}
+	if _, err = q.Enqueue(envelope("a@example.com"), strings.NewReader("")); err == nil {
+		t.Error("expected an error with no recipients")
+	}
+}
+
+// fakemx is an SMTP server answering RCPT TO according to the local
+// part of the recipient: "temp" gets a 451 and "perm" a 550. With a TLS
+// config it offers STARTTLS, and with a user it offers AUTH PLAIN.
+type fakemx struct {
+	l    net.Listener
+	tls  *tls.Config
+	user string
+	pass string
+	mu   sync.Mutex
+	got  []string // "from rcpt,rcpt: message" per transaction
+}
+
+func newfakemx(t *testing.T) *fakemx {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mx := &fakemx{l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go mx.serve(c)
+		}
+	}()
+	return mx
+}
+
+func (mx *fakemx) serve(c net.Conn) {
+	tp := textproto.NewConn(c)
+	defer func() { tp.Close() }()
+	tp.PrintfLine("220 fakemx")
+	var from, prefix string
+	var rcpt []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			tp.PrintfLine("250-fakemx")
+			if mx.tls != nil {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			if mx.user != "" {
+				tp.PrintfLine("250-AUTH PLAIN")
+			}
+			tp.PrintfLine("250 HELP")
+		case cmd == "STARTTLS" && mx.tls != nil:
+			tp.PrintfLine("220 go ahead")
+			c = tls.Server(c, mx.tls)
+			tp = textproto.NewConn(c)
+			prefix += "[tls] "
+		case strings.HasPrefix(cmd, "AUTH PLAIN ") && mx.user != "":
+			b, _ := base64.StdEncoding.DecodeString(line[len("AUTH PLAIN "):])
+			if string(b) != "\x00"+mx.user+"\x00"+mx.pass {
+				tp.PrintfLine("535 bad credentials")
+				continue
+			}
+			tp.PrintfLine("235 ok")
+			prefix += "[" + mx.user + "] "
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			from = strings.Trim(line[10:], "<>")
+			tp.PrintfLine("250 ok")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			addr := strings.Trim(line[8:], "<>")
+			switch {
+			case strings.HasPrefix(addr, "temp@"):
+				tp.PrintfLine("451 try later")
+			case strings.HasPrefix(addr, "perm@"):
+				tp.PrintfLine("550 no such user")
+			default:
+				rcpt = append(rcpt, addr)
+				tp.PrintfLine("250 ok")
+			}
+		case cmd == "DATA":
+			tp.PrintfLine("354 go ahead")
+			b, err := ioutil.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			mx.mu.Lock()
+			mx.got = append(mx.got, fmt.Sprintf("%s%s %s: %s", prefix, from, strings.Join(rcpt, ","), b))
+			mx.mu.Unlock()
+			tp.PrintfLine("250 queued")
+			rcpt = nil
+		case cmd == "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown")
+		}
+	}
+}
+
+func (mx *fakemx) received() []string {
+	mx.mu.Lock()
+	defer mx.mu.Unlock()
+	return append([]string(nil), mx.got...)
+}
+
+// fakedns resolves MX records from a stub zone. Every name has an
+// address except those under .invalid, which don't exist.
+type fakedns map[string][]*net.MX
+
+func (z fakedns) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mxs, ok := z[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (z fakedns) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if strings.HasSuffix(host, ".invalid") {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IPAddr{{IP: net.ParseIP("192.0.2.25")}}, nil
+}
+
+// fakedialer connects every host in hosts to addr, and refuses others.
+type fakedialer struct {
+	addr  string
+	hosts map[string]bool
+	port  string // if not 25
+}
+
+func (d *fakedialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, _ := net.SplitHostPort(addr)
+	if d.port == "" && port != "25" || d.port != "" && port != d.port || !d.hosts[host] {
+		return nil, fmt.Errorf("connection refused: %s", addr)
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, d.addr)
+}
+
+func TestDeliver(t *testing.T) {
+	mx := newfakemx(t)
+	defer mx.l.Close()
+	zone := fakedns{
+		"example.net": {{Host: "down.example.net.", Pref: 10}, {Host: "mx.example.net.", Pref: 20}},
+		"example.org": {{Host: ".", Pref: 0}},
+	}
+	dialer := &fakedialer{addr: mx.l.Addr().String(), hosts: map[string]bool{"mx.example.net": true, "example.com": true}}
+	q, cleanup := tempqueue(t, WithResolver(zone), WithDialer(dialer), WithHostname("relay.test"),
+		WithBackoff(time.Minute, 10*time.Minute), WithLifetime(time.Hour))
+	defer cleanup()
+	env := envelope("a@example.com", "b@example.net", "temp@example.net", "perm@example.net",
+		"c@example.com", "d@example.org", "e@nowhere.invalid")
+	id, err := q.Enqueue(env, strings.NewReader(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.flush(now).Wait()
+	got := mx.received()
+	want := []string{
+		"a@example.com b@example.net: " + email,
+		"a@example.com c@example.com: " + email,
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	m, err := q.read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[string]byte)
+	for _, r := range m.rcpt {
+		status[r.Addr] = r.status
+	}
+	if status["b@example.net"] != delivered || status["temp@example.net"] != pending ||
+		status["perm@example.net"] != failed || status["c@example.com"] != delivered ||
+		status["d@example.org"] != failed || status["e@nowhere.invalid"] != failed {
+		t.Errorf("unexpected statuses %q", status)
+	}
+	if m.attempts != 1 || m.next.Unix() != now.Add(time.Minute).Unix() {
+		t.Errorf("unexpected schedule: %d attempts, next %v", m.attempts, m.next)
+	}
+
+	// Not due yet.
+	q.flush(now.Add(30 * time.Second)).Wait()
+	if m, _ = q.read(id); m.attempts != 1 {
+		t.Fatal("unexpected attempt before the backoff")
+	}
+	// The delay doubles.
+	q.flush(now.Add(time.Minute)).Wait()
+	if m, _ = q.read(id); m.attempts != 2 || m.next.Unix() != now.Add(3*time.Minute).Unix() {
+		t.Errorf("unexpected schedule: %d attempts, next %v", m.attempts, m.next)
+	}
+	// The bounce for perm@example.net, d@example.org and
+	// e@nowhere.invalid went back to
+	// a@example.com from the null sender; nothing else was redelivered.
+	got = mx.received()
+	if len(got) != 3 || !strings.HasPrefix(got[2], " a@example.com: ") {
+		t.Fatalf("expected a bounce after the deliveries, got %q", got)
+	}
+	for _, want := range []string{
+		"Final-Recipient: rfc822; perm@example.net\n",
+		"Final-Recipient: rfc822; d@example.org\n",
+		"Status: 5.1.10\n",
+		"Final-Recipient: rfc822; e@nowhere.invalid\n",
+		"Status: 5.1.2\n",
+		"Content-Type: text/rfc822-headers",
+	} {
+		if !strings.Contains(got[2], want) {
+			t.Errorf("bounce lacks %q:\n%s", want, got[2])
+		}
+	}
+	if strings.Contains(got[2], "b@example.net") || strings.Contains(got[2], "temp@example.net") {
+		t.Errorf("bounce reports other recipients:\n%s", got[2])
+	}
+	// After the lifetime, the message expires and leaves the queue.
+	q.flush(now.Add(time.Hour)).Wait()
+	for _, sub := range []string{"mess", "info", "remote"} {
+		if _, err = os.Stat(q.path(sub, id)); !os.IsNotExist(err) {
+			t.Errorf("%s: expected message to be removed, got %v", sub, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	q := &queue{minbackoff: time.Minute, maxbackoff: time.Hour}
+	for n, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 3: 4 * time.Minute, 4: 8 * time.Minute} {
+		if got := q.backoff(n); got != want {
+			t.Errorf("backoff(%d): got %v want %v", n, got, want)
+		}
+	}
+	if got := q.backoff(100); got != time.Hour {
+		t.Errorf("backoff(100): got %v want %v", got, time.Hour)
+	}
+}
+
+func TestRun(t *testing.T) {
+	mx := newfakemx(t)
+	defer mx.l.Close()
+	dialer := &fakedialer{addr: mx.l.Addr().String(), hosts: map[string]bool{"example.net": true}}
+	q, cleanup := tempqueue(t, WithResolver(fakedns{}), WithDialer(dialer))
+	defer cleanup()
+	done := make(chan struct{})
+	defer close(done)
+	go q.Run(done)
+	if _, err := q.Enqueue(envelope("a@example.com", "b@example.net"), strings.NewReader(email)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mx.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message not delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// selfsigned returns a server TLS config for name and a client config
+// trusting it.
+func selfsigned(t *testing.T, name string) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: pool}
+}
+
+func TestSmarthost(t *testing.T) {
+	mx := newfakemx(t)
+	defer mx.l.Close()
+	var clienttls *tls.Config
+	mx.tls, clienttls = selfsigned(t, "smarthost.test")
+	mx.user, mx.pass = "alice", "s3cret"
+	route := config.Route{Host: "smarthost.test", Port: 587, TLS: true, User: "alice", Password: "s3cret"}
+	routes := func(domain string) (config.Route, bool) {
+		return route, domain != "direct.example"
+	}
+	dialer := &fakedialer{addr: mx.l.Addr().String(), hosts: map[string]bool{"smarthost.test": true}, port: "587"}
+	q, cleanup := tempqueue(t, WithResolver(fakedns{}), WithDialer(dialer), WithRoutes(routes), WithTLSConfig(clienttls))
+	defer cleanup()
+	id, err := q.Enqueue(envelope("a@example.com", "b@example.net", "c@direct.example"), strings.NewReader(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.flush(now).Wait()
+	if got, want := strings.Join(mx.received(), "|"), "[tls] [alice] a@example.com b@example.net: "+email; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	m, _ := q.read(id)
+	if m.rcpt[0].status != delivered || m.rcpt[1].status != pending {
+		t.Errorf("unexpected recipients %+v %+v", m.rcpt[0], m.rcpt[1])
+	}
+
+	// Failing to log in defers delivery rather than bouncing.
+	for _, tt := range []struct {
+		route  config.Route
+		reason string
+	}{
+		{config.Route{Host: "smarthost.test", Port: 587, TLS: true, User: "alice", Password: "wrong"}, "AUTH: 535"},
+		{config.Route{Host: "smarthost.test", Port: 587, User: "alice", Password: "s3cret"}, "unencrypted connection"},
+	} {
+		route = tt.route
+		id, err = q.Enqueue(envelope("a@example.com", "b@example.net"), strings.NewReader(email))
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.attempt(id, now)
+		if m, _ = q.read(id); m.rcpt[0].status != pending || !strings.Contains(m.rcpt[0].reason, tt.reason) {
+			t.Errorf("got %+v want reason %q", m.rcpt[0], tt.reason)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package queue
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lvgophers/smtpd/types"
+)
+
+// scaninterval is how often Run looks for messages due for delivery.
+var scaninterval = 30 * time.Second
+
+// Run delivers due messages, scanning the queue periodically and
+// whenever a message is queued, until done is closed.
+func (q *queue) Run(done <-chan struct{}) {
+	for {
+		q.flush(time.Now())
+		select {
+		case <-done:
+			return
+		case <-q.wake:
+		case <-time.After(scaninterval):
+		}
+	}
+}
+
+// due returns the ids of messages to attempt at now, oldest first.
+func (q *queue) due(now time.Time) (ids []string) {
+	f, err := os.Open(q.path("mess", ""))
+	if err != nil {
+		log.Println("queue:", err)
+		return
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		log.Println("queue:", err)
+	}
+	sort.Strings(names)
+	for _, id := range names {
+		m, err := q.read(id)
+		if err != nil {
+			log.Printf("queue: message %s: %v", id, err)
+			continue
+		}
+		if !m.next.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+// flush starts delivery of every due message not already being
+// delivered, at most q.remote at a time. The returned WaitGroup is done
+// when they have been attempted.
+func (q *queue) flush(now time.Time) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for _, id := range q.due(now) {
+		q.l.Lock()
+		busy := q.busy[id]
+		q.busy[id] = true
+		q.l.Unlock()
+		if busy {
+			continue
+		}
+		wg.Add(1)
+		q.sem <- struct{}{}
+		go func(id string) {
+			defer func() {
+				q.l.Lock()
+				delete(q.busy, id)
+				q.l.Unlock()
+				<-q.sem
+				wg.Done()
+			}()
+			q.attempt(id, now)
+		}(id)
+	}
+	return &wg
+}
+
+// backoff returns the delay after the nth attempt.
+func (q *queue) backoff(n int) time.Duration {
+	d := q.minbackoff
+	for i := 1; i < n && d < q.maxbackoff; i++ {
+		d *= 2
+	}
+	if d > q.maxbackoff {
+		d = q.maxbackoff
+	}
+	return d
+}
+
+func domain(addr string) string {
+	return strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+}
+
+// delaywarning is how long a message waits before its sender is told
+// of the delay, once.
+var delaywarning = 4 * time.Hour
+
+// attempt tries to deliver message id to its pending recipients, reports
+// the results to the sender, then schedules the next attempt, or removes
+// the message from the queue once no recipients are pending.
+func (q *queue) attempt(id string, now time.Time) {
+	m, err := q.read(id)
+	if err != nil {
+		log.Printf("queue: message %s: %v", id, err)
+		return
+	}
+	body, err := os.Open(q.path("mess", id))
+	if err != nil {
+		log.Printf("queue: message %s: %v", id, err)
+		return
+	}
+	defer body.Close()
+	var domains []string
+	var tried []*recipient
+	bydomain := make(map[string][]*recipient)
+	for _, r := range m.rcpt {
+		if r.status != pending {
+			continue
+		}
+		d := domain(r.Addr)
+		if bydomain[d] == nil {
+			domains = append(domains, d)
+		}
+		bydomain[d] = append(bydomain[d], r)
+		tried = append(tried, r)
+	}
+	for _, d := range domains {
+		q.deliver(m, d, bydomain[d], body)
+	}
+	m.attempts++
+	expiry := m.birth.Add(q.lifetime)
+	rep := &Report{Envelope: &types.Envelope{From: m.from, Ret: m.ret, EnvID: m.envid}, Arrival: m.birth}
+	var remaining []*recipient
+	for _, r := range tried {
+		switch {
+		case r.status == delivered:
+			rep.Results = append(rep.Results, result(r, Relayed))
+		case r.status == failed:
+			log.Printf("queue: message %s: delivery to %s failed: %s", m.id, r.Addr, r.reason)
+			rep.Results = append(rep.Results, result(r, Failed))
+		case !now.Before(expiry):
+			log.Printf("queue: message %s: delivery to %s expired: %s", m.id, r.Addr, r.reason)
+			r.status = failed
+			res := result(r, Failed)
+			res.Status = "4.4.7"
+			res.Detail = strings.TrimSuffix("message expired in queue; "+res.Detail, "; ")
+			rep.Results = append(rep.Results, res)
+		default:
+			remaining = append(remaining, r)
+		}
+	}
+	if len(remaining) > 0 && !m.warned && now.Sub(m.birth) >= delaywarning {
+		m.warned = true
+		for _, r := range remaining {
+			res := result(r, Delayed)
+			res.Until = expiry
+			rep.Results = append(rep.Results, res)
+		}
+	}
+	if len(rep.Results) > 0 && m.double {
+		log.Printf("queue: message %s: double bounce not delivered, discarded", id)
+	} else if len(rep.Results) > 0 {
+		if _, err = body.Seek(0, io.SeekStart); err == nil {
+			err = q.Notify(rep, body)
+		}
+		if err != nil {
+			log.Printf("queue: message %s: DSN: %v", id, err)
+		}
+	}
+	if len(remaining) == 0 {
+		q.remove(id)
+		return
+	}
+	m.next = now.Add(q.backoff(m.attempts))
+	if m.next.After(expiry) {
+		m.next = expiry // one last try
+	}
+	if err = q.writeremote(m); err == nil {
+		err = q.writeinfo(m)
+	}
+	if err != nil {
+		log.Printf("queue: message %s: %v", id, err)
+	}
+}
+
+// result returns r's delivery status with action.
+func result(r *recipient, action string) Result {
+	res := Result{Rcpt: r.Recipient, Action: action}
+	if replyre.MatchString(r.reason) {
+		res.Reply = r.reason
+	} else {
+		res.Detail = r.reason
+	}
+	return res
+}
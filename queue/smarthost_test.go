@@ -0,0 +1,80 @@
+package queue_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lvgophers/smtpd/config"
+	"github.com/lvgophers/smtpd/maildir"
+	"github.com/lvgophers/smtpd/queue"
+	"github.com/lvgophers/smtpd/server"
+	"github.com/lvgophers/smtpd/types"
+)
+
+// TestServerSmarthost relays through the project's own server. The queue
+// only sends once AUTH succeeds.
+func TestServerSmarthost(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	for name, content := range map[string]string{
+		"rcpthosts": "example.net\n",
+		"authusers": "relay:{PLAIN}s3cret\n",
+	} {
+		if err = ioutil.WriteFile(filepath.Join(td, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sub := range []string{"mail", "queue"} {
+		if err = os.Mkdir(filepath.Join(td, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf, err := config.New(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdir, err := maildir.New(filepath.Join(td, "mail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Serve(conf, mdir, l)
+
+	port := l.Addr().(*net.TCPAddr).Port
+	routes := func(domain string) (config.Route, bool) {
+		return config.Route{Host: "127.0.0.1", Port: port, User: "relay", Password: "s3cret"}, true
+	}
+	q, err := queue.New(filepath.Join(td, "queue"), queue.WithRoutes(routes), queue.WithHostname("client.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go q.Run(done)
+	if _, err = q.Enqueue(&types.Envelope{From: "a@example.com", Rcpt: []types.Recipient{{Addr: "b@example.net"}}}, strings.NewReader("Subject: hai\n\nHai!\n")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		names, _ := filepath.Glob(filepath.Join(mdir.NewDir(), "*"))
+		if len(names) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message not relayed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
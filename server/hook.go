@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/textproto"
+
+	"github.com/lvgophers/smtpd/server/session"
+)
+
+// A Hook sees the stages of each session, implementing at least one of
+// the interfaces below. It accepts a stage by returning nil, and rejects it
+// with the reply it returns as a *textproto.Error, such as Reject or
+// TempFail, which starts with an enhanced status code. Any other error is logged and tempfails the stage.
+type Hook interface{}
+
+// ConnectHook sees new connections. A rejected client gets the reply to
+// every command but QUIT.
+type ConnectHook interface {
+	OnConnect(c session.Conn) error
+}
+
+// HeloHook sees HELO, EHLO and LHLO.
+type HeloHook interface {
+	OnHelo(c session.Conn, name string) error
+}
+
+// MailFromHook sees the sender of each transaction.
+type MailFromHook interface {
+	OnMailFrom(c session.Conn, from string) error
+}
+
+// RcptToHook sees each recipient the config accepts.
+type RcptToHook interface {
+	OnRcptTo(c session.Conn, to string) error
+}
+
+// DataHook reads each message from r before it's delivered. The message
+// is spooled in full first, so it can't be refused before the client
+// has sent all of it.
+type DataHook interface {
+	OnData(c session.Conn, r io.Reader) error
+}
+
+// DeliveredHook is told of each message delivered or queued, as id.
+type DeliveredHook interface {
+	OnDelivered(c session.Conn, id string)
+}
+
+// Replies for hooks that don't give a reason.
+var (
+	Reject   = &textproto.Error{Code: 550, Msg: "5.7.1 rejected by policy"}
+	TempFail = &textproto.Error{Code: 451, Msg: "4.7.1 try again later"}
+)
+
+// WithHooks runs hooks at each stage of a session, in order, until one
+// rejects it. It panics if a hook implements none of the interfaces, as
+// one with a misspelt method would, rather than never running it.
+func WithHooks(hooks ...Hook) session.Option {
+	filters := make([]session.Filter, len(hooks))
+	for i, h := range hooks {
+		switch h.(type) {
+		case ConnectHook, HeloHook, MailFromHook, RcptToHook, DataHook, DeliveredHook:
+		default:
+			panic(fmt.Sprintf("server: hook %T implements no hook interface", h))
+		}
+		filters[i] = hook{h}
+	}
+	return session.WithFilter(filters...)
+}
+
+// hook is the session.Filter of a Hook.
+type hook struct {
+	h Hook
+}
+
+func (h hook) Connect(c session.Conn) error {
+	if hh, ok := h.h.(ConnectHook); ok {
+		return hh.OnConnect(c)
+	}
+	return nil
+}
+
+func (h hook) Helo(c session.Conn, name string) error {
+	if hh, ok := h.h.(HeloHook); ok {
+		return hh.OnHelo(c, name)
+	}
+	return nil
+}
+
+func (h hook) Mail(c session.Conn, from string) error {
+	if hh, ok := h.h.(MailFromHook); ok {
+		return hh.OnMailFrom(c, from)
+	}
+	return nil
+}
+
+func (h hook) Rcpt(c session.Conn, to string) error {
+	if hh, ok := h.h.(RcptToHook); ok {
+		return hh.OnRcptTo(c, to)
+	}
+	return nil
+}
+
+func (h hook) Data(c session.Conn, r io.Reader) error {
+	if hh, ok := h.h.(DataHook); ok {
+		return hh.OnData(c, r)
+	}
+	return nil
+}
+
+func (h hook) Delivered(c session.Conn, id string) {
+	if hh, ok := h.h.(DeliveredHook); ok {
+		hh.OnDelivered(c, id)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"expvar"
+	"net"
+	"sync"
+)
+
+// limiter counts open connections, in total and per client address.
+type limiter struct {
+	l     sync.Mutex
+	total int
+	perip map[string]int
+}
+
+var conns = &limiter{perip: make(map[string]int)}
+
+func init() {
+	expvar.Publish("smtpd.connections", expvar.Func(func() interface{} {
+		return Connections()
+	}))
+}
+
+// Connections returns the number of connections being handled by all
+// servers in the process.
+func Connections() int {
+	conns.l.Lock()
+	defer conns.l.Unlock()
+	return conns.total
+}
+
+// clientip returns the IP address of c's peer, or an empty string for
+// connections without one, such as Unix sockets.
+func clientip(c net.Conn) string {
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	return ""
+}
+
+// acquire counts a connection from ip unless that would exceed max
+// connections in total or maxip from ip. A maxip of 0 means no limit.
+func (l *limiter) acquire(ip string, max, maxip int) bool {
+	l.l.Lock()
+	defer l.l.Unlock()
+	if l.total >= max {
+		return false
+	}
+	if ip != "" && maxip > 0 && l.perip[ip] >= maxip {
+		return false
+	}
+	l.total++
+	if ip != "" {
+		l.perip[ip]++
+	}
+	return true
+}
+
+func (l *limiter) release(ip string) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.total--
+	if ip == "" {
+		return
+	}
+	if l.perip[ip]--; l.perip[ip] == 0 {
+		delete(l.perip, ip)
+	}
+}
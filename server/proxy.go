@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxytimeout bounds the wait for a PROXY protocol header.
+var proxytimeout = 10 * time.Second
+
+// proxysig starts a PROXY protocol version 2 header.
+var proxysig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errproxy = errors.New("bad PROXY protocol header")
+
+// proxylistener reads the HAProxy PROXY protocol header, version 1 or 2,
+// from connections accepted from trusted proxies, whose connections then
+// have the addresses of the proxied client. Other connections are passed
+// through as they are.
+type proxylistener struct {
+	net.Listener
+	trusted []*net.IPNet
+	once    sync.Once
+	conns   chan net.Conn
+	err     chan error
+	done    chan struct{}
+	close   sync.Once
+}
+
+// ProxyListener returns a listener that takes the client's address from
+// the PROXY protocol header sent by load balancers in trusted. Headers
+// are read concurrently, so a slow proxy doesn't hold up Accept.
+func ProxyListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxylistener{
+		Listener: l,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *proxylistener) Accept() (net.Conn, error) {
+	l.once.Do(func() { go l.accept() })
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.err:
+		l.err <- err
+		return nil, err
+	}
+}
+
+func (l *proxylistener) Close() error {
+	l.close.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *proxylistener) accept() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.err <- err
+			return
+		}
+		go func() {
+			if l.istrusted(c.RemoteAddr()) {
+				pc, err := readproxy(c)
+				if err != nil {
+					log.Printf("%s: PROXY: %v", c.RemoteAddr(), err)
+					c.Close()
+					return
+				}
+				c = pc
+			}
+			select {
+			case l.conns <- c:
+			case <-l.done:
+				c.Close()
+			}
+		}()
+	}
+}
+
+// istrusted reports whether a is a trusted proxy.
+func (l *proxylistener) istrusted(a net.Addr) bool {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyconn is a connection with the addresses from its PROXY header.
+type proxyconn struct {
+	net.Conn
+	r             *bufio.Reader
+	local, remote net.Addr
+}
+
+func (c *proxyconn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *proxyconn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyconn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readproxy reads the PROXY header from c. The proxy's own health checks
+// send the UNKNOWN or LOCAL forms, which keep c's addresses.
+func readproxy(c net.Conn) (*proxyconn, error) {
+	c.SetReadDeadline(time.Now().Add(proxytimeout))
+	defer c.SetReadDeadline(time.Time{})
+	pc := &proxyconn{Conn: c, r: bufio.NewReader(c)}
+	sig, err := pc.r.Peek(len(proxysig))
+	if bytes.Equal(sig, proxysig) {
+		err = pc.readv2()
+	} else if len(sig) >= 6 && string(sig[:6]) == "PROXY " {
+		err = pc.readv1()
+	} else if err == nil {
+		err = errproxy
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readv1 reads the human-readable header, such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n".
+func (c *proxyconn) readv1() error {
+	var line []byte
+	for len(line) < 107 {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errproxy
+	}
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return errproxy
+	}
+	src, dst := net.ParseIP(f[2]), net.ParseIP(f[3])
+	sport, err1 := strconv.ParseUint(f[4], 10, 16)
+	dport, err2 := strconv.ParseUint(f[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil ||
+		(src.To4() != nil) != (f[1] == "TCP4") || (dst.To4() != nil) != (f[1] == "TCP4") {
+		return errproxy
+	}
+	c.remote = &net.TCPAddr{IP: src, Port: int(sport)}
+	c.local = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return nil
+}
+
+// readv2 reads the binary header. Its TLVs are skipped.
+func (c *proxyconn) readv2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return err
+	}
+	if hdr[12]>>4 != 2 {
+		return errproxy
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL
+		return nil
+	case 1: // PROXY
+	default:
+		return errproxy
+	}
+	var n int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		n = net.IPv4len
+	case 0x21: // TCP over IPv6
+		n = net.IPv6len
+	default: // UNSPEC, UDP or Unix sockets
+		return nil
+	}
+	if len(body) < 2*n+4 {
+		return errproxy
+	}
+	c.remote = &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(body[2*n:]))}
+	c.local = &net.TCPAddr{IP: net.IP(body[n : 2*n]), Port: int(binary.BigEndian.Uint16(body[2*n+2:]))}
+	return nil
+}
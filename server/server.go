@@ -1,8 +1,11 @@
 package server
 
 import (
+	"context"
 	"net"
 	"net/textproto"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lvgophers/smtpd/config"
@@ -14,9 +17,24 @@ import (
 
 var log = logging.Logger
 
+// Config is the part of the configuration a server needs.
+type Config interface {
+	session.Config
+	config.Concurrency
+}
+
 type server struct {
-	cfg  config.Interface
-	mdir maildir.Interface
+	cfg      Config
+	mdir     maildir.Interface
+	opts     []session.Option
+	resolver hostresolver
+}
+
+// hostresolver looks up client hostnames. *net.Resolver is a
+// hostresolver.
+type hostresolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
 }
 
 func panics() {
@@ -25,31 +43,127 @@ func panics() {
 	}
 }
 
-func (s *server) handle(c net.Conn) {
+// environ returns the ucspi-tcp environment for c.
+func environ(c net.Conn) map[string]string {
+	env := map[string]string{"PROTO": "TCP"}
+	if _, ok := c.LocalAddr().(*net.UnixAddr); ok {
+		env["PROTO"] = "UNIX"
+	}
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		env["TCPREMOTEIP"] = a.IP.String()
+		env["TCPREMOTEPORT"] = strconv.Itoa(a.Port)
+	}
+	if a, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		env["TCPLOCALIP"] = a.IP.String()
+		env["TCPLOCALPORT"] = strconv.Itoa(a.Port)
+	}
+	return env
+}
+
+// lookuphost returns the reverse hostname of ip, or an empty string.
+// A name is only believed if it resolves back to ip, as whoever holds
+// the reverse zone for ip can claim any name.
+func (s *server) lookuphost(ip net.IP) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	names, err := s.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return ""
+	}
+	for _, name := range names {
+		addrs, err := s.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(ip) {
+				return strings.TrimSuffix(name, ".")
+			}
+		}
+	}
+	return ""
+}
+
+func (s *server) handle(c net.Conn, ip string) {
+	defer conns.release(ip)
+	s.session(c, environ(c))
+}
+
+// session greets the client on c and runs a session, unless the access
+// rules deny it. env is the connection's environment, to which the
+// matching rule's settings are added.
+func (s *server) session(c net.Conn, env map[string]string) {
 	defer panics()
 	c.SetReadDeadline(time.Now().Add(10 * time.Second))
 	tp := textproto.NewConn(c)
+	ip := net.ParseIP(env["TCPREMOTEIP"])
+	rule := s.cfg.Access(ip, func() string {
+		if host, ok := env["TCPREMOTEHOST"]; ok {
+			return host
+		}
+		if ip == nil {
+			return ""
+		}
+		host := s.lookuphost(ip)
+		if host != "" {
+			env["TCPREMOTEHOST"] = host
+		}
+		return host
+	})
+	if rule.Deny {
+		log.Printf("%s: denied by tcprules %q", c.RemoteAddr(), rule.Pattern)
+		tp.PrintfLine("554 5.7.1 %s access denied", s.cfg.DefaultHost())
+		tp.Close()
+		return
+	}
+	for k, v := range rule.Env {
+		env[k] = v
+	}
 	err := tp.PrintfLine("220 %s", s.cfg.DefaultHost())
 	if err != nil {
 		tp.Close()
 		return
 	}
-	ses := session.New(&types.NetConn{Conn: tp, C: c}, s.cfg, s.mdir)
+	ses := session.New(&types.NetConn{Conn: tp, C: c, Env: env}, s.cfg, s.mdir, s.opts...)
 	ses.Start()
 }
 
+// ServeConn runs a single session on c, as under tcpserver or inetd.
+// env is the connection's ucspi-tcp environment, such as TCPREMOTEIP
+// and RELAYCLIENT; if nil, it is derived from c.
+func ServeConn(cfg Config, mdir maildir.Interface, c net.Conn, env map[string]string, opts ...session.Option) {
+	if env == nil {
+		env = environ(c)
+	}
+	s := &server{cfg: cfg, mdir: mdir, opts: opts, resolver: net.DefaultResolver}
+	s.session(c, env)
+}
+
+// reject turns away a connection over the concurrency limits.
+func reject(c net.Conn) {
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	textproto.NewConn(c).PrintfLine("421 4.7.0 too many connections")
+}
+
 // START OMIT
 
 // Serve spawns handlers for connections.
-func Serve(cfg config.Interface, mdir maildir.Interface, l net.Listener) (err error) {
+func Serve(cfg Config, mdir maildir.Interface, l net.Listener, opts ...session.Option) (err error) {
 	// END OMIT
 	var c net.Conn
-	s := &server{cfg: cfg, mdir: mdir}
+	s := &server{cfg: cfg, mdir: mdir, opts: opts, resolver: net.DefaultResolver}
 	for {
 		c, err = l.Accept()
 		if err != nil {
 			return
 		}
-		go s.handle(c)
+		ip := clientip(c)
+		if !conns.acquire(ip, cfg.ConcurrencyIncoming(), cfg.ConcurrencyPerIP()) {
+			log.Printf("%s: too many connections", c.RemoteAddr())
+			go reject(c)
+			continue
+		}
+		go s.handle(c, ip)
 	}
 }
@@ -0,0 +1,618 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lvgophers/smtpd/config"
+	"github.com/lvgophers/smtpd/maildir"
+	"github.com/lvgophers/smtpd/queue"
+	"github.com/lvgophers/smtpd/server/session"
+)
+
+// serve starts a server using a control directory holding the given
+// files, returning its address.
+func serve(t *testing.T, files map[string]string, opts ...session.Option) (addr string, cleanup func()) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cleanup = servel(t, l, files, opts...)
+	return l.Addr().String(), cleanup
+}
+
+// servel is serve on l, returning the maildir's new directory.
+func servel(t *testing.T, l net.Listener, files map[string]string, opts ...session.Option) (newdir string, cleanup func()) {
+	conf, mdir, td := setup(t, files)
+	go Serve(conf, mdir, l, opts...)
+	return mdir.NewDir(), func() {
+		l.Close()
+		os.RemoveAll(td)
+	}
+}
+
+// setup returns a config from a control directory holding the given
+// files, and a maildir, both in the temporary directory td.
+func setup(t *testing.T, files map[string]string) (conf config.Interface, mdir maildir.Interface, td string) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["rcpthosts"] = "example.com\n"
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(td, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conf, err = config.New(td); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(td, "mail"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if mdir, err = maildir.New(filepath.Join(td, "mail")); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// greet connects to addr from local and returns the connection and the
+// greeting line.
+func greet(t *testing.T, local, addr string) (net.Conn, string) {
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}, Timeout: 5 * time.Second}
+	c, err := d.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, strings.TrimSpace(line)
+}
+
+func waitconns(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for Connections() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d connections got %d", n, Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConcurrencyIncoming(t *testing.T) {
+	addr, cleanup := serve(t, map[string]string{"concurrencyincoming": "3\n"})
+	defer cleanup()
+	var open []net.Conn
+	for i := 0; i < 3; i++ {
+		c, line := greet(t, "127.0.0.1", addr)
+		if !strings.HasPrefix(line, "220 ") {
+			t.Fatalf("connection %d: unexpected greeting %q", i, line)
+		}
+		open = append(open, c)
+	}
+	waitconns(t, 3)
+	for i := 0; i < 5; i++ {
+		c, line := greet(t, "127.0.0.1", addr)
+		if line != "421 4.7.0 too many connections" {
+			t.Fatalf("excess connection %d: unexpected greeting %q", i, line)
+		}
+		c.Close()
+	}
+	open[0].Close()
+	waitconns(t, 2)
+	c, line := greet(t, "127.0.0.1", addr)
+	if !strings.HasPrefix(line, "220 ") {
+		t.Fatalf("unexpected greeting after close %q", line)
+	}
+	open = append(open[1:], c)
+	for _, c := range open {
+		c.Close()
+	}
+	waitconns(t, 0)
+}
+
+func TestConcurrencyPerIP(t *testing.T) {
+	addr, cleanup := serve(t, map[string]string{"concurrencyperip": "2\n"})
+	defer cleanup()
+	var open []net.Conn
+	for i := 0; i < 2; i++ {
+		c, line := greet(t, "127.0.0.1", addr)
+		if !strings.HasPrefix(line, "220 ") {
+			t.Fatalf("connection %d: unexpected greeting %q", i, line)
+		}
+		open = append(open, c)
+	}
+	c, line := greet(t, "127.0.0.1", addr)
+	if line != "421 4.7.0 too many connections" {
+		t.Fatalf("excess connection: unexpected greeting %q", line)
+	}
+	c.Close()
+	c, line = greet(t, "127.0.0.2", addr)
+	if !strings.HasPrefix(line, "220 ") {
+		t.Fatalf("other address: unexpected greeting %q", line)
+	}
+	open = append(open, c)
+	for _, c := range open {
+		c.Close()
+	}
+	waitconns(t, 0)
+}
+
+func TestAccessRules(t *testing.T) {
+	qdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(qdir)
+	q, err := queue.New(qdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, cleanup := serve(t, map[string]string{
+		"tcprules": "127.0.0.2:deny\n127.0.0.1:allow,RELAYCLIENT=\"\"\n:allow\n",
+	}, session.WithQueue(q))
+	defer cleanup()
+	c, line := greet(t, "127.0.0.2", addr)
+	c.Close()
+	if !strings.HasPrefix(line, "554 ") {
+		t.Fatalf("denied address: unexpected greeting %q", line)
+	}
+	waitconns(t, 0)
+
+	// RELAYCLIENT lets 127.0.0.1 relay, but not 127.0.0.3.
+	for _, tt := range []struct {
+		local, reply string
+	}{
+		{"127.0.0.1", "250 "},
+		{"127.0.0.3", "553 "},
+	} {
+		c, line = greet(t, tt.local, addr)
+		if !strings.HasPrefix(line, "220 ") {
+			t.Fatalf("%s: unexpected greeting %q", tt.local, line)
+		}
+		r := bufio.NewReader(c)
+		for _, cmd := range []string{"HELO test", "MAIL FROM:<a@example.com>", "RCPT TO:<b@elsewhere.example>"} {
+			c.Write([]byte(cmd + "\r\n"))
+			if line, err := r.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			} else if cmd[0] == 'R' && !strings.HasPrefix(line, tt.reply) {
+				t.Errorf("%s: got %q want %q", tt.local, strings.TrimSpace(line), tt.reply)
+			}
+		}
+		c.Close()
+	}
+	waitconns(t, 0)
+}
+
+func TestLMTPUnix(t *testing.T) {
+	sd, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sd)
+	l, err := net.Listen("unix", filepath.Join(sd, "lmtp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newdir, cleanup := servel(t, l, map[string]string{}, session.WithLMTP())
+	defer cleanup()
+	c, err := textproto.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err = c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []struct {
+		code int
+		line string
+	}{
+		{250, "LHLO mta.example.com"},
+		{250, "MAIL FROM:<a@example.net>"},
+		{250, "RCPT TO:<b@example.com>"},
+		{250, "RCPT TO:<c@example.com>"},
+		{354, "DATA"},
+	} {
+		if _, err = c.Cmd("%s", cmd.line); err == nil {
+			_, _, err = c.ReadResponse(cmd.code)
+		}
+		if err != nil {
+			t.Fatal(cmd.line, err)
+		}
+	}
+	w := c.DotWriter()
+	w.Write([]byte("Subject: hai\n\nHai!\n"))
+	w.Close()
+	for _, addr := range []string{"b@example.com", "c@example.com"} {
+		_, msg, err := c.ReadResponse(250)
+		if err != nil || !strings.Contains(msg, "<"+addr+">") {
+			t.Errorf("%s: unexpected reply %q %v", addr, msg, err)
+		}
+	}
+	if names, _ := filepath.Glob(filepath.Join(newdir, "*")); len(names) != 1 {
+		t.Error("expected a delivery, got", names)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	qdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(qdir)
+	q, err := queue.New(qdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, mdir, td := setup(t, map[string]string{"tcprules": "192.0.2.1:deny\n:allow\n"})
+	defer os.RemoveAll(td)
+	for _, tt := range []struct {
+		env   map[string]string
+		reply string
+	}{
+		// As from tcpserver, whose rules set RELAYCLIENT.
+		{map[string]string{"PROTO": "TCP", "TCPREMOTEIP": "198.51.100.1", "RELAYCLIENT": ""}, "250 "},
+		{map[string]string{"PROTO": "TCP", "TCPREMOTEIP": "198.51.100.1"}, "553 "},
+		// The rules in the control directory apply too.
+		{map[string]string{"PROTO": "TCP", "TCPREMOTEIP": "192.0.2.1", "RELAYCLIENT": ""}, "554 "},
+	} {
+		client, c := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ServeConn(conf, mdir, c, tt.env, session.WithQueue(q))
+		}()
+		tp := textproto.NewConn(client)
+		line, err := tp.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "554 ") {
+			if tt.reply != "554 " {
+				t.Errorf("%v: unexpected greeting %q", tt.env, line)
+			}
+			<-done
+			continue
+		}
+		for _, cmd := range []string{"HELO test", "MAIL FROM:<a@example.com>", "RCPT TO:<b@elsewhere.example>"} {
+			tp.PrintfLine("%s", cmd)
+			if line, err = tp.ReadLine(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !strings.HasPrefix(line, tt.reply) {
+			t.Errorf("%v: got %q want %q", tt.env, line, tt.reply)
+		}
+		tp.PrintfLine("QUIT")
+		tp.ReadLine()
+		<-done
+		client.Close()
+	}
+}
+
+// ptrzone is a stub DNS zone of PTR and A records.
+type ptrzone struct {
+	ptr, a map[string]string
+}
+
+func (z ptrzone) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if name, ok := z.ptr[addr]; ok {
+		return []string{name}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (z ptrzone) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip, ok := z.a[host]; ok {
+		return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestAccessHostname(t *testing.T) {
+	qdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(qdir)
+	q, err := queue.New(qdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, mdir, td := setup(t, map[string]string{"tcprules": "=mx.example.com:allow,RELAYCLIENT=\"\"\n:allow\n"})
+	defer os.RemoveAll(td)
+	zone := ptrzone{
+		ptr: map[string]string{"192.0.2.1": "mx.example.com.", "198.51.100.1": "mx.example.com."},
+		a:   map[string]string{"mx.example.com.": "192.0.2.1"},
+	}
+	s := &server{cfg: conf, mdir: mdir, opts: []session.Option{session.WithQueue(q)}, resolver: zone}
+	for _, tt := range []struct {
+		ip, reply string
+	}{
+		{"192.0.2.1", "250 "},
+		// The PTR record of 198.51.100.1 isn't confirmed by an A record.
+		{"198.51.100.1", "553 "},
+	} {
+		client, c := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.session(c, map[string]string{"PROTO": "TCP", "TCPREMOTEIP": tt.ip})
+		}()
+		tp := textproto.NewConn(client)
+		line, err := tp.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cmd := range []string{"HELO test", "MAIL FROM:<a@example.com>", "RCPT TO:<b@elsewhere.example>"} {
+			tp.PrintfLine("%s", cmd)
+			if line, err = tp.ReadLine(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !strings.HasPrefix(line, tt.reply) {
+			t.Errorf("%s: got %q want %q", tt.ip, line, tt.reply)
+		}
+		tp.PrintfLine("QUIT")
+		tp.ReadLine()
+		<-done
+		client.Close()
+	}
+}
+
+func TestProxy(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	newdir, cleanup := servel(t, ProxyListener(l, []*net.IPNet{loopback}),
+		map[string]string{"tcprules": "192.0.2.7:deny\n:allow\n"})
+	defer cleanup()
+	v2 := func(src net.IP) string {
+		return string(proxysig) + "\x21\x11\x00\x0c" + string(src.To4()) + "\x7f\x00\x00\x01\xd2\x04\x00\x19"
+	}
+	for _, tt := range []struct{ header, greeting string }{
+		{"PROXY TCP4 192.0.2.7 127.0.0.1 53764 25\r\n", "554 "},
+		{"PROXY TCP4 198.51.100.1 127.0.0.1 53764 25\r\n", "220 "},
+		{"PROXY UNKNOWN\r\n", "220 "},
+		{v2(net.ParseIP("192.0.2.7")), "554 "},
+		{v2(net.ParseIP("198.51.100.1")), "220 "},
+	} {
+		c, err := net.Dial("tcp4", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		tp := textproto.NewConn(c)
+		c.Write([]byte(tt.header))
+		line, err := tp.ReadLine()
+		if err != nil || !strings.HasPrefix(line, tt.greeting) {
+			t.Errorf("%q: got %q %v, want %q", tt.header, line, err, tt.greeting)
+		}
+		tp.Close()
+	}
+
+	// The client's address is recorded in the Received header.
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("PROXY TCP6 2001:db8::1 ::1 53764 25\r\n"))
+	tp := textproto.NewConn(c)
+	if _, _, err = tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []struct {
+		code int
+		line string
+	}{
+		{250, "HELO client.example.net"},
+		{250, "MAIL FROM:<a@example.net>"},
+		{250, "RCPT TO:<b@example.com>"},
+		{354, "DATA"},
+	} {
+		if _, err = tp.Cmd("%s", cmd.line); err == nil {
+			_, _, err = tp.ReadResponse(cmd.code)
+		}
+		if err != nil {
+			t.Fatal(cmd.line, err)
+		}
+	}
+	w := tp.DotWriter()
+	w.Write([]byte("Subject: hai\n\nHai!\n"))
+	w.Close()
+	if _, _, err = tp.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := filepath.Glob(filepath.Join(newdir, "*"))
+	if len(names) != 1 {
+		t.Fatal("expected a delivery, got", names)
+	}
+	b, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "Received: from client.example.net ([2001:db8::1])\n") {
+		t.Errorf("unexpected Received header:\n%s", b)
+	}
+}
+
+// policy is a hook that refuses some of each stage.
+type policy struct{}
+
+func (policy) OnConnect(c session.Conn) error {
+	if c.Env()["TCPREMOTEIP"] == "127.0.0.2" {
+		return Reject
+	}
+	return nil
+}
+
+func (policy) OnHelo(c session.Conn, name string) error {
+	if name == "spammer" {
+		return &textproto.Error{Code: 550, Msg: "5.7.1 go away"}
+	}
+	return nil
+}
+
+func (policy) OnMailFrom(c session.Conn, from string) error {
+	if from == "later@example.net" {
+		return TempFail
+	}
+	return nil
+}
+
+func (policy) OnRcptTo(c session.Conn, to string) error {
+	if to == "broken@example.com" {
+		return errors.New("lookup failed")
+	}
+	return nil
+}
+
+func (policy) OnData(c session.Conn, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("Subject: spam")) {
+		return &textproto.Error{Code: 554, Msg: "5.7.1 spam"}
+	}
+	return nil
+}
+
+// journal is a hook that records the stages it sees.
+type journal struct {
+	mu   sync.Mutex
+	seen []string
+}
+
+func (j *journal) see(format string, args ...interface{}) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seen = append(j.seen, fmt.Sprintf(format, args...))
+	return nil
+}
+
+func (j *journal) OnConnect(c session.Conn) error { return j.see("connect") }
+func (j *journal) OnHelo(c session.Conn, name string) error {
+	return j.see("helo %s", name)
+}
+func (j *journal) OnMailFrom(c session.Conn, from string) error {
+	return j.see("mail %s", from)
+}
+func (j *journal) OnRcptTo(c session.Conn, to string) error {
+	return j.see("rcpt %s %d", to, len(c.Envelope().Rcpt))
+}
+func (j *journal) OnData(c session.Conn, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return j.see("data %t", bytes.HasPrefix(b, []byte("Received: ")) && bytes.HasSuffix(b, []byte("Hai!\n")))
+}
+func (j *journal) OnDelivered(c session.Conn, id string) {
+	j.see("delivered %t", id != "")
+}
+
+func TestHooks(t *testing.T) {
+	j := &journal{}
+	addr, cleanup := serve(t, map[string]string{}, WithHooks(policy{}, j))
+	defer cleanup()
+	c, err := textproto.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err = c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	cmd := func(code int, line string) {
+		t.Helper()
+		id, err := c.Cmd("%s", line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.StartResponse(id)
+		defer c.EndResponse(id)
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			t.Errorf("%s: got %v %q, want %d", line, err, msg, code)
+		}
+	}
+	message := func(code int, body string) {
+		t.Helper()
+		cmd(354, "DATA")
+		w := c.DotWriter()
+		w.Write([]byte(body))
+		w.Close()
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			t.Errorf("DATA: got %v %q, want %d", err, msg, code)
+		}
+	}
+	cmd(550, "HELO spammer")
+	cmd(250, "HELO test")
+	cmd(451, "MAIL FROM:<later@example.net>")
+	cmd(250, "MAIL FROM:<a@example.net>")
+	cmd(451, "RCPT TO:<broken@example.com>")
+	cmd(250, "RCPT TO:<b@example.com>")
+	message(554, "Subject: spam\n\nHai!\n")
+	cmd(250, "MAIL FROM:<a@example.net>")
+	cmd(250, "RCPT TO:<b@example.com>")
+	message(250, "Subject: ham\n\nHai!\n")
+	cmd(221, "QUIT")
+	want := []string{"connect", "helo test", "mail a@example.net", "rcpt b@example.com 0",
+		"mail a@example.net", "rcpt b@example.com 0", "data true", "delivered true"}
+	j.mu.Lock()
+	if strings.Join(j.seen, "\n") != strings.Join(want, "\n") {
+		t.Errorf("hooks saw %q, want %q", j.seen, want)
+	}
+	j.mu.Unlock()
+
+	// A refused client is refused at every command.
+	rc, line := greet(t, "127.0.0.2", addr)
+	defer rc.Close()
+	if !strings.HasPrefix(line, "220 ") {
+		t.Fatalf("unexpected greeting %q", line)
+	}
+	tp := textproto.NewConn(rc)
+	for _, line := range []string{"HELO test", "NOOP"} {
+		if _, err = tp.Cmd("%s", line); err == nil {
+			_, _, err = tp.ReadResponse(550)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", line, err)
+		}
+	}
+}
+
+// misspelt has no hook methods, only one that looks like one.
+type misspelt struct{}
+
+func (misspelt) OnMail(c session.Conn, from string) error { return Reject }
+
+func TestHookCheck(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "server.misspelt") {
+			t.Errorf("expected a panic for a hook with no hook methods, got %v", r)
+		}
+	}()
+	WithHooks(policy{}, misspelt{})
+}
@@ -0,0 +1,62 @@
+package session
+
+import (
+	"io"
+	"net/textproto"
+	"os"
+)
+
+// Filter sees each stage of a session, and can refuse it. Returning nil
+// accepts the stage; a *textproto.Error is the reply that refuses it,
+// with an enhanced status code such as "5.7.1".
+// Any other error is logged, and the client told to try again later.
+type Filter interface {
+	// Connect is called before the first command. A refused client
+	// gets the reply to every command but QUIT, as from rblsmtpd.
+	Connect(c Conn) error
+	Helo(c Conn, name string) error
+	Mail(c Conn, from string) error
+	Rcpt(c Conn, to string) error
+	// Data reads the message, as it will be delivered, from r.
+	Data(c Conn, r io.Reader) error
+	// Delivered is told the message was delivered or queued as id,
+	// for all its recipients.
+	Delivered(c Conn, id string)
+}
+
+// WithFilter adds filters, which see each stage in turn until one
+// refuses it.
+func WithFilter(filters ...Filter) Option {
+	return func(s *session) {
+		s.filters = append(s.filters, filters...)
+	}
+}
+
+// filter runs stage on the filters in turn, returning the reply of the
+// first to refuse.
+func (s *session) filter(stage func(f Filter) error) error {
+	for _, f := range s.filters {
+		err := stage(f)
+		if err == nil {
+			continue
+		}
+		if e, ok := err.(*textproto.Error); ok {
+			return e
+		}
+		log.Printf("%s: filter: %v", s.C.RemoteAddr(), err)
+		return code451
+	}
+	return nil
+}
+
+// filterdata shows the message in name to the filters in turn.
+func (s *session) filterdata(name string) error {
+	return s.filter(func(f Filter) error {
+		m, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+		return f.Data(conn{s}, m)
+	})
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/lvgophers/smtpd/types"
+)
+
+// Conn is the session as a command handler sees it.
+type Conn interface {
+	// Reply writes a reply. A message of several lines makes a
+	// multiline reply.
+	Reply(code int, msg string) error
+	// ReadLine reads a line from the client, for commands that take
+	// more than one, within the configured timeout.
+	ReadLine() (string, error)
+	RemoteAddr() net.Addr
+	// Env is the connection's environment, such as TCPREMOTEIP and
+	// RELAYCLIENT.
+	Env() map[string]string
+	Helo() string // empty before HELO, EHLO or LHLO
+	Auth() string // the authenticated user, if any
+	TLS() bool
+	// Envelope returns the transaction's sender and recipients, or nil
+	// before MAIL.
+	Envelope() *types.Envelope
+	// Reset ends the transaction, as RSET does.
+	Reset()
+}
+
+// Handler handles a command. args is the rest of the command line after
+// the verb, as the client sent it. A *textproto.Error it returns is the
+// reply; a handler that replies itself returns nil. Any other error
+// ends the session. As ENHANCEDSTATUSCODES is advertised, replies other
+// than to HELO, EHLO and LHLO, and 3xx ones, start with an enhanced
+// status code, such as "2.0.0".
+type Handler func(c Conn, args string) error
+
+// WithCommand handles verb with h, in any state of the session, in place
+// of any built-in handler. Verbs are case-insensitive.
+func WithCommand(verb string, h Handler) Option {
+	return func(s *session) {
+		if s.handlers == nil {
+			s.handlers = make(map[string]Handler)
+		}
+		s.handlers[strings.ToLower(verb)] = h
+	}
+}
+
+// WithExtension advertises keyword, such as "SIZE 10485760", in reply to
+// EHLO and LHLO. It replaces a built-in keyword of the same name.
+func WithExtension(keyword string) Option {
+	return func(s *session) {
+		s.extensions = append(s.extensions, keyword)
+	}
+}
+
+// extend adds the registered extensions to the keywords in ext.
+func (s *session) extend(ext []string) []string {
+	for _, kw := range s.extensions {
+		name := strings.ToUpper(strings.Fields(kw + " ")[0])
+		i := 0
+		for i < len(ext) && strings.ToUpper(strings.Fields(ext[i] + " ")[0]) != name {
+			i++
+		}
+		if i < len(ext) {
+			ext[i] = kw
+		} else {
+			ext = append(ext, kw)
+		}
+	}
+	return ext
+}
+
+// conn is the Conn of a session.
+type conn struct {
+	s *session
+}
+
+func (c conn) Reply(code int, msg string) error {
+	return c.s.reply(&textproto.Error{Code: code, Msg: msg})
+}
+
+func (c conn) ReadLine() (string, error) { return c.s.readline() }
+func (c conn) RemoteAddr() net.Addr      { return c.s.C.RemoteAddr() }
+func (c conn) Env() map[string]string    { return c.s.Env }
+func (c conn) Helo() string              { return c.s.helo }
+func (c conn) Auth() string              { return c.s.auth }
+func (c conn) TLS() bool                 { return c.s.encrypted() }
+func (c conn) Reset()                    { c.s.reset() }
+func (c conn) Envelope() *types.Envelope {
+	if c.s.env == nil {
+		return nil
+	}
+	return c.s.envelope(c.s.recipients())
+}
@@ -0,0 +1,589 @@
+package session
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// miltertimeout bounds each exchange with a milter.
+var miltertimeout = 30 * time.Second
+
+// maxmilter bounds the packets read from a milter, and the body chunks
+// sent to it.
+const (
+	maxmilter = 1 << 20
+	maxchunk  = 65535
+)
+
+var errmilter = errors.New("bad milter packet")
+
+// Actions a milter may take at the end of a message. We offer adding
+// and changing headers, and quarantine.
+const (
+	milteraddhdrs    = 0x01
+	milterchghdrs    = 0x10
+	milterquarantine = 0x20
+	milteractions    = milteraddhdrs | milterchghdrs | milterquarantine
+)
+
+// Protocol flags, by which a milter skips events (no), or doesn't reply
+// to them (nr).
+const (
+	milternoconnect = 1 << iota
+	milternohelo
+	milternomail
+	milternorcpt
+	milternobody
+	milternohdrs
+	milternoeoh
+	milternrhdr
+	milternounknown
+	milternodata
+	milterskip
+	milterrcptrej
+	milternrconn
+	milternrhelo
+	milternrmail
+	milternrrcpt
+	milternrdata
+	milternrunknown
+	milternreoh
+	milternrbody
+	milterleadspc
+)
+
+// milterprotocol is the protocol flags we offer: all but sending the
+// recipients we reject.
+const milterprotocol = (milterleadspc<<1 - 1) &^ milterrcptrej
+
+var milterreject = &textproto.Error{Code: 550, Msg: "5.7.1 rejected by mail filter"}
+var miltertempfail = &textproto.Error{Code: 451, Msg: "4.7.1 try again later"}
+
+// WithMilter has each session filtered by the milter listening at
+// address on network, such as rspamd or OpenDKIM, over version 6 of
+// Sendmail's milter protocol. The milter may reject or tempfail the
+// connection, the transaction, a recipient or the message, and add or
+// change the message's headers or quarantine it. A milter that can't be
+// reached tempfails the session.
+func WithMilter(network, address string) Option {
+	return func(s *session) {
+		m := &milter{network: network, address: address, s: s}
+		s.milters = append(s.milters, m)
+		s.filters = append(s.filters, m)
+	}
+}
+
+// milter is a session's connection to a milter, and the Filter that
+// passes it each stage.
+type milter struct {
+	network, address  string
+	s                 *session
+	c                 net.Conn
+	err               error  // the milter failed, and tempfails the session
+	actions, protocol uint32 // as negotiated
+	done              bool   // the milter accepted the session
+	skip              bool   // the milter accepted the message
+	skipbody          bool   // the milter has seen enough of the body
+	intx              bool   // the milter has seen MAIL, but not the message's end
+	discard           bool
+	quarantine        string // the reason to quarantine the message
+	changes           []headerchange
+}
+
+// headerchange is a change to the message's header: adding (h),
+// inserting (i) or changing (m) a field. An empty field deletes the
+// one changed.
+type headerchange struct {
+	cmd   byte
+	index int
+	name  string
+	field string
+}
+
+// cstrings encodes ss as the protocol does, each ended by a NUL.
+func cstrings(ss ...string) []byte {
+	var b []byte
+	for _, s := range ss {
+		b = append(append(b, s...), 0)
+	}
+	return b
+}
+
+func (m *milter) send(cmd byte, data []byte) error {
+	b := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)+1))
+	b[4] = cmd
+	m.c.SetDeadline(time.Now().Add(miltertimeout))
+	_, err := m.c.Write(append(b, data...))
+	return err
+}
+
+func (m *milter) recv() (cmd byte, data []byte, err error) {
+	var hdr [5]byte
+	m.c.SetDeadline(time.Now().Add(miltertimeout))
+	if _, err = io.ReadFull(m.c, hdr[:]); err != nil {
+		return
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > maxmilter {
+		return 0, nil, errmilter
+	}
+	data = make([]byte, n-1)
+	_, err = io.ReadFull(m.c, data)
+	return hdr[4], data, err
+}
+
+// fail ends the conversation with the milter after err.
+func (m *milter) fail(err error) error {
+	m.err = err
+	m.c.Close()
+	return fmt.Errorf("milter %s: %w", m.address, err)
+}
+
+// close ends the conversation with the milter.
+func (m *milter) close() {
+	if m.c != nil && m.err == nil {
+		m.send('Q', nil)
+		m.c.Close()
+	}
+}
+
+// negotiate agrees the protocol version, actions and flags.
+func (m *milter) negotiate() error {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b, 6)
+	binary.BigEndian.PutUint32(b[4:], milteractions)
+	binary.BigEndian.PutUint32(b[8:], milterprotocol)
+	if err := m.send('O', b); err != nil {
+		return err
+	}
+	cmd, data, err := m.recv()
+	if err != nil {
+		return err
+	}
+	if cmd != 'O' || len(data) < 12 {
+		return errmilter
+	}
+	if v := binary.BigEndian.Uint32(data); v < 2 || v > 6 {
+		return fmt.Errorf("unsupported version %d", v)
+	}
+	m.actions = binary.BigEndian.Uint32(data[4:]) & milteractions
+	m.protocol = binary.BigEndian.Uint32(data[8:])
+	if m.protocol&^milterprotocol != 0 {
+		return fmt.Errorf("unsupported protocol flags %#x", m.protocol&^milterprotocol)
+	}
+	return nil
+}
+
+// macros sends the macros for the event cmd, as name and value pairs.
+// Empty values are left out.
+func (m *milter) macros(cmd byte, nv ...string) error {
+	if m.err != nil || m.done || m.skip {
+		return nil
+	}
+	data := []byte{cmd}
+	for i := 0; i+1 < len(nv); i += 2 {
+		if nv[i+1] != "" {
+			data = append(data, cstrings(nv[i], nv[i+1])...)
+		}
+	}
+	if err := m.send('D', data); err != nil {
+		return m.fail(err)
+	}
+	return nil
+}
+
+// skips reports whether the milter is to miss events with the protocol
+// flag skip.
+func (m *milter) skips(skip uint32) bool {
+	return m.err != nil || m.done || m.skip || m.protocol&skip != 0
+}
+
+// step sends the event cmd, unless the milter skips it, and returns its
+// verdict: nil to go on, or the reply refusing the stage.
+func (m *milter) step(cmd byte, data []byte, skip, noreply uint32) error {
+	switch {
+	case m.err != nil:
+		return miltertempfail
+	case m.skips(skip):
+		return nil
+	}
+	if err := m.send(cmd, data); err != nil {
+		return m.fail(err)
+	}
+	if m.protocol&noreply != 0 {
+		return nil
+	}
+	for {
+		r, data, err := m.recv()
+		if err != nil {
+			return m.fail(err)
+		}
+		switch r {
+		case 'p': // progress: still working
+		case 'c':
+			return nil
+		case 'a':
+			if cmd == 'C' || cmd == 'H' {
+				m.done = true
+			} else {
+				m.skip = true
+			}
+			return nil
+		case 'd':
+			m.discard, m.skip = true, true
+			return nil
+		case 's':
+			if cmd != 'B' {
+				return m.fail(errmilter)
+			}
+			m.skipbody = true
+			return nil
+		case 'r':
+			return milterreject
+		case 't':
+			return miltertempfail
+		case 'y':
+			e, ok := replycode(data)
+			if !ok {
+				return m.fail(fmt.Errorf("bad reply %q", data))
+			}
+			return e
+		case 'h', 'i', 'm', 'q':
+			if cmd != 'E' {
+				return m.fail(errmilter)
+			}
+			if err = m.change(r, data); err != nil {
+				return m.fail(err)
+			}
+		default:
+			return m.fail(fmt.Errorf("unexpected reply %q", r))
+		}
+	}
+}
+
+// replycode parses a reply the milter gave, such as
+// "550 5.7.1 go away", which may have several lines.
+func replycode(data []byte) (*textproto.Error, bool) {
+	lines := strings.Split(strings.TrimRight(string(data), "\x00"), "\r\n")
+	var msg []string
+	for _, line := range lines {
+		if len(line) < 4 || line[:3] != lines[0][:3] {
+			return nil, false
+		}
+		msg = append(msg, line[4:])
+	}
+	code, err := strconv.Atoi(lines[0][:3])
+	if err != nil || code < 400 || code > 599 {
+		return nil, false
+	}
+	return enhanced(&textproto.Error{Code: code, Msg: strings.Join(msg, "\n")}), true
+}
+
+// change records a change the milter makes to the message.
+func (m *milter) change(cmd byte, data []byte) error {
+	if cmd == 'q' {
+		if m.actions&milterquarantine == 0 {
+			return errors.New("quarantine not negotiated")
+		}
+		m.quarantine = strings.TrimRight(string(data), "\x00")
+		return nil
+	}
+	want := uint32(milteraddhdrs)
+	if cmd == 'm' {
+		want = milterchghdrs
+	}
+	if m.actions&want == 0 {
+		return fmt.Errorf("action %q not negotiated", cmd)
+	}
+	c := headerchange{cmd: cmd}
+	if cmd != 'h' {
+		if len(data) < 4 {
+			return errmilter
+		}
+		c.index, data = int(binary.BigEndian.Uint32(data)), data[4:]
+	}
+	f := strings.Split(string(data), "\x00")
+	if len(f) < 2 || f[0] == "" {
+		return errmilter
+	}
+	c.name = f[0]
+	if value := strings.Replace(f[1], "\r\n", "\n", -1); value != "" || cmd != 'm' {
+		if m.protocol&milterleadspc == 0 {
+			value = " " + value
+		}
+		c.field = c.name + ":" + value + "\n"
+	}
+	m.changes = append(m.changes, c)
+	return nil
+}
+
+func (m *milter) Connect(c Conn) error {
+	var err error
+	if m.c, err = net.DialTimeout(m.network, m.address, miltertimeout); err != nil {
+		m.err = err
+		return fmt.Errorf("milter %s: %w", m.address, err)
+	}
+	if err = m.negotiate(); err != nil {
+		return m.fail(err)
+	}
+	env := c.Env()
+	ip := net.ParseIP(env["TCPREMOTEIP"])
+	host := env["TCPREMOTEHOST"]
+	var data []byte
+	switch {
+	case ip == nil:
+		data = append(cstrings("localhost"), 'U')
+	default:
+		if host == "" {
+			host = "[" + ip.String() + "]"
+		}
+		family := byte('6')
+		if ip.To4() != nil {
+			family = '4'
+		}
+		port, _ := strconv.ParseUint(env["TCPREMOTEPORT"], 10, 16)
+		data = append(cstrings(host), family, byte(port>>8), byte(port))
+		data = append(data, cstrings(ip.String())...)
+	}
+	if err = m.macros('C', "j", m.s.cfg.DefaultHost(), "{daemon_name}", "smtpd",
+		"{client_addr}", env["TCPREMOTEIP"], "{client_name}", host); err != nil {
+		return err
+	}
+	return m.step('C', data, milternoconnect, milternrconn)
+}
+
+func (m *milter) Helo(c Conn, name string) error {
+	return m.step('H', cstrings(name), milternohelo, milternrhelo)
+}
+
+func (m *milter) Mail(c Conn, from string) error {
+	if m.intx && m.err == nil && !m.done {
+		if err := m.send('A', nil); err != nil {
+			return m.fail(err)
+		}
+	}
+	m.intx, m.skip, m.skipbody, m.discard, m.quarantine, m.changes = true, false, false, false, "", nil
+	tls := ""
+	if c.TLS() {
+		tls = "TLS"
+	}
+	if err := m.macros('M', "{mail_addr}", from, "{auth_authen}", c.Auth(), "{tls_version}", tls); err != nil {
+		return err
+	}
+	return m.step('M', cstrings("<"+from+">"), milternomail, milternrmail)
+}
+
+func (m *milter) Rcpt(c Conn, to string) error {
+	if err := m.macros('R', "{rcpt_addr}", to); err != nil {
+		return err
+	}
+	return m.step('R', cstrings("<"+to+">"), milternorcpt, milternrrcpt)
+}
+
+// Data passes the milter the message's header fields, unfolded, then
+// its body in CRLF lines.
+func (m *milter) Data(c Conn, r io.Reader) error {
+	if err := m.step('T', nil, milternodata, milternrdata); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	for {
+		name, value, err := readfield(br)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			break
+		}
+		if m.protocol&milterleadspc == 0 {
+			value = strings.TrimLeft(value, " \t")
+		}
+		if err = m.step('L', cstrings(name, value), milternohdrs, milternrhdr); err != nil {
+			return err
+		}
+	}
+	if err := m.step('N', nil, milternoeoh, milternreoh); err != nil {
+		return err
+	}
+	var body []byte
+	for !m.skipbody && !m.skips(milternobody) {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n := len(line); n > 0 && line[n-1] == '\n' && (n == 1 || line[n-2] != '\r') {
+			line = append(line[:n-1], "\r\n"...)
+		}
+		body = append(body, line...)
+		for !m.skipbody && (len(body) >= maxchunk || err == io.EOF && len(body) > 0) {
+			n := len(body)
+			if n > maxchunk {
+				n = maxchunk
+			}
+			if serr := m.step('B', body[:n], milternobody, milternrbody); serr != nil {
+				return serr
+			}
+			body = body[n:]
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	defer func() { m.intx = false }()
+	return m.step('E', nil, 0, 0)
+}
+
+// readfield reads a header field, returning its name and value with any
+// continuation lines. The name is empty at the end of the header.
+func readfield(br *bufio.Reader) (name, value string, err error) {
+	line, err := br.ReadString('\n')
+	if err == io.EOF {
+		err = nil
+	}
+	line = strings.TrimRight(line, "\r\n")
+	i := strings.IndexByte(line, ':')
+	if err != nil || i <= 0 {
+		return "", "", err
+	}
+	name, value = line[:i], line[i+1:]
+	for {
+		b, err := br.Peek(1)
+		if err != nil || (b[0] != ' ' && b[0] != '\t') {
+			return name, value, nil
+		}
+		line, _ = br.ReadString('\n')
+		value += "\n" + strings.TrimRight(line, "\r\n")
+	}
+}
+
+func (m *milter) Delivered(c Conn, id string) {}
+
+// milted applies the milters' header changes to the message in name. A
+// message a milter discards or quarantines is held back from delivery,
+// and held is the reply to give.
+func (s *session) milted(name string) (held *textproto.Error, err error) {
+	var changes []headerchange
+	var quarantine string
+	for _, m := range s.milters {
+		if m.discard {
+			log.Printf("%s: message discarded by milter %s", s.C.RemoteAddr(), m.address)
+			os.Remove(name)
+			return replyf(250, "2.6.0 discarded"), nil
+		}
+		if m.quarantine != "" && quarantine == "" {
+			quarantine = m.quarantine
+		}
+		changes = append(changes, m.changes...)
+	}
+	if len(changes) > 0 {
+		if err = rewrite(name, changes); err != nil {
+			log.Printf("%s: milter: %v", s.C.RemoteAddr(), err)
+			return nil, code451
+		}
+	}
+	if quarantine == "" {
+		return nil, nil
+	}
+	dir := filepath.Join(filepath.Dir(s.mdir.NewDir()), "quarantine")
+	if err = os.MkdirAll(dir, 0700); err == nil {
+		err = os.Rename(name, filepath.Join(dir, filepath.Base(name)))
+	}
+	if err != nil {
+		log.Printf("%s: quarantine: %v", s.C.RemoteAddr(), err)
+		return nil, code451
+	}
+	log.Printf("%s: message %s quarantined: %s", s.C.RemoteAddr(), filepath.Base(name), quarantine)
+	return replyf(250, "2.6.0 held for review"), nil
+}
+
+// rewrite applies changes to the header of the message in name.
+func rewrite(name string, changes []headerchange) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var fields []string
+	var sep string
+	for {
+		line, err := br.ReadString('\n')
+		if len(fields) > 0 && len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] += line
+		} else if strings.TrimRight(line, "\r\n") != "" {
+			fields = append(fields, line)
+		} else {
+			sep = line
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	for _, c := range changes {
+		switch c.cmd {
+		case 'h':
+			fields = append(fields, c.field)
+		case 'i':
+			i := c.index
+			if i > len(fields) {
+				i = len(fields)
+			}
+			fields = append(fields[:i], append([]string{c.field}, fields[i:]...)...)
+		case 'm':
+			n, i := 0, 0
+			for ; i < len(fields); i++ {
+				if j := strings.IndexByte(fields[i], ':'); j > 0 && strings.EqualFold(strings.TrimSpace(fields[i][:j]), c.name) {
+					if n++; n == c.index {
+						break
+					}
+				}
+			}
+			switch {
+			case i == len(fields):
+				if c.field != "" {
+					fields = append(fields, c.field)
+				}
+			case c.field == "":
+				fields = append(fields[:i], fields[i+1:]...)
+			default:
+				fields[i] = c.field
+			}
+		}
+	}
+	tf, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tf)
+	for _, field := range fields {
+		w.WriteString(field)
+	}
+	w.WriteString(sep)
+	_, err = io.Copy(w, br)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tf.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakemilter is an in-process milter. It records the events it's sent,
+// and answers each with the packets verdict returns.
+type fakemilter struct {
+	l        net.Listener
+	protocol uint32
+	verdict  func(cmd byte, data []byte, body string) [][]byte
+
+	mu     sync.Mutex
+	events []string
+	macros map[string]string
+	quit   chan struct{} // a session quit
+}
+
+// packet encodes a milter packet.
+func packet(cmd byte, data ...[]byte) []byte {
+	b := bytes.Join(data, nil)
+	p := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(p, uint32(len(b)+1))
+	p[4] = cmd
+	return append(p, b...)
+}
+
+func newfakemilter(t *testing.T, protocol uint32, verdict func(cmd byte, data []byte, body string) [][]byte) *fakemilter {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakemilter{l: l, protocol: protocol, verdict: verdict, macros: map[string]string{},
+		quit: make(chan struct{}, 1)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakemilter) serve(c net.Conn) {
+	defer c.Close()
+	var body string
+	for {
+		var hdr [5]byte
+		if _, err := io.ReadFull(c, hdr[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(hdr[:])-1)
+		if _, err := io.ReadFull(c, data); err != nil {
+			return
+		}
+		cmd := hdr[4]
+		f.mu.Lock()
+		switch cmd {
+		case 'O':
+			opt := make([]byte, 12)
+			binary.BigEndian.PutUint32(opt, 6)
+			binary.BigEndian.PutUint32(opt[4:], milteractions)
+			binary.BigEndian.PutUint32(opt[8:], f.protocol)
+			c.Write(packet('O', opt))
+		case 'D':
+			nv := strings.Split(string(data[1:]), "\x00")
+			for i := 0; i+1 < len(nv); i += 2 {
+				f.macros[nv[i]] = nv[i+1]
+			}
+		case 'A':
+			f.events, body = append(f.events, "A "), ""
+		case 'Q':
+			f.events = append(f.events, "Q")
+			f.mu.Unlock()
+			f.quit <- struct{}{}
+			return
+		default:
+			f.events = append(f.events, string(cmd)+" "+strings.Replace(string(data), "\x00", "|", -1))
+			if cmd == 'B' {
+				body += string(data)
+			}
+			for _, p := range f.verdict(cmd, data, body) {
+				c.Write(p)
+			}
+			if cmd == 'E' {
+				body = ""
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// seen returns the events the milter was sent of the kinds in cmds.
+func (f *fakemilter) seen(cmds string) (events []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.events {
+		if strings.IndexByte(cmds, e[0]) >= 0 {
+			events = append(events, e)
+		}
+	}
+	return
+}
+
+func TestMilter(t *testing.T) {
+	index := func(i uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, i)
+		return b
+	}
+	f := newfakemilter(t, milternrhdr|milterskip, func(cmd byte, data []byte, body string) [][]byte {
+		cont := [][]byte{packet('c')}
+		switch {
+		case cmd == 'L':
+			return nil
+		case cmd == 'H' && string(data) == "spammer\x00":
+			return [][]byte{packet('y', []byte("550-5.7.1 go away\r\n550 5.7.1 far away\x00"))}
+		case cmd == 'M' && bytes.Contains(data, []byte("later@")):
+			return [][]byte{packet('t')}
+		case cmd == 'R' && bytes.Contains(data, []byte("bad@")):
+			return [][]byte{packet('r')}
+		case cmd == 'B':
+			return [][]byte{packet('s')}
+		case cmd != 'E':
+			return cont
+		case strings.Contains(body, "reject"):
+			return [][]byte{packet('y', []byte("554 5.7.1 no thanks\x00"))}
+		case strings.Contains(body, "discard"):
+			return [][]byte{packet('d')}
+		case strings.Contains(body, "quarantine"):
+			return [][]byte{packet('q', []byte("looks odd\x00")), packet('c')}
+		}
+		return [][]byte{
+			packet('p'),
+			packet('h', []byte("X-Milter\x00yes\x00")),
+			packet('m', index(1), []byte("Subject\x00[SPAM] hai\x00")),
+			packet('i', index(0), []byte("X-First\x001\x00")),
+			packet('m', index(1), []byte("X-Gone\x00\x00")),
+			packet('a'),
+		}
+	})
+	defer f.l.Close()
+	env := map[string]string{"TCPREMOTEIP": "192.0.2.1", "TCPREMOTEPORT": "2525"}
+	tp, mdir, done := pipe(&testconfig{}, env, nil, WithMilter("tcp", f.l.Addr().String()))
+	defer os.RemoveAll(mdir.basedir)
+	expect(t, tp, 550, "HELO spammer")
+	expect(t, tp, 250, "HELO test")
+	expect(t, tp, 451, "MAIL FROM:<later@example.net>")
+	expect(t, tp, 250, "MAIL FROM:<a@example.net>")
+	expect(t, tp, 550, "RCPT TO:<bad@example.com>")
+	expect(t, tp, 250, "RCPT TO:<b@example.com>")
+	message := func(code int, body string) {
+		t.Helper()
+		expect(t, tp, 354, "DATA")
+		w := tp.DotWriter()
+		io.WriteString(w, body)
+		w.Close()
+		if _, msg, err := tp.ReadResponse(code); err != nil {
+			t.Errorf("DATA: %v %q", err, msg)
+		}
+	}
+	message(250, "Subject: hai\nX-Gone: x\n\treally\n\nHello\n")
+	names, _ := filepath.Glob(filepath.Join(mdir.NewDir(), "*"))
+	if len(names) != 1 {
+		t.Fatalf("expected a delivery, got %v", names)
+	}
+	b, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := string(b)
+	if !strings.HasPrefix(m, "X-First: 1\nReceived: from test ([192.0.2.1])") ||
+		!strings.Contains(m, "\nSubject: [SPAM] hai\n") || strings.Contains(m, "X-Gone") ||
+		!strings.HasSuffix(m, "\nX-Milter: yes\n\nHello\n") {
+		t.Errorf("unexpected message %q", m)
+	}
+	os.Remove(names[0])
+	for _, tt := range []struct {
+		code int
+		body string
+	}{
+		{554, "reject"},
+		{250, "discard"},
+		{250, "quarantine"},
+	} {
+		expect(t, tp, 250, "MAIL FROM:<a@example.net>")
+		expect(t, tp, 250, "RCPT TO:<b@example.com>")
+		message(tt.code, "Subject: "+tt.body+"\n\n"+tt.body+"\n")
+	}
+	empty(t, mdir)
+	if names, _ = filepath.Glob(filepath.Join(mdir.basedir, "quarantine", "*")); len(names) != 1 {
+		t.Errorf("expected a quarantined message, got %v", names)
+	}
+	expect(t, tp, 221, "QUIT")
+	wait(t, done)
+	select {
+	case <-f.quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("milter not told to quit")
+	}
+	want := []string{
+		"C [192.0.2.1]|4\x09\xdd192.0.2.1|",
+		"H spammer|", "H test|",
+		"M <later@example.net>|", "A ", "M <a@example.net>|",
+		"R <bad@example.com>|", "R <b@example.com>|",
+		"B Hello\r\n", "E ",
+		"M <a@example.net>|", "R <b@example.com>|", "B reject\r\n", "E ",
+		"M <a@example.net>|", "R <b@example.com>|", "B discard\r\n", "E ",
+		"M <a@example.net>|", "R <b@example.com>|", "B quarantine\r\n", "E ",
+		"Q",
+	}
+	if got := f.seen("CHMARBEQ"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("milter saw %q, want %q", got, want)
+	}
+	if got := f.seen("L")[:3]; !strings.HasPrefix(got[0], "L Received|from test") ||
+		got[1] != "L Subject|hai|" || got[2] != "L X-Gone|x\n\treally|" {
+		t.Errorf("milter saw headers %q", got)
+	}
+	if f.macros["j"] != "none" || f.macros["{client_addr}"] != "192.0.2.1" || f.macros["{rcpt_addr}"] != "b@example.com" {
+		t.Errorf("unexpected macros %v", f.macros)
+	}
+}
+
+func TestMilterUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	tp, _, done := pipe(&testconfig{}, nil, nil, WithMilter("tcp", l.Addr().String()))
+	expect(t, tp, 451, "HELO test")
+	expect(t, tp, 451, "MAIL FROM:<a@example.net>")
+	expect(t, tp, 221, "QUIT")
+	wait(t, done)
+}
@@ -1,6 +1,11 @@
 package session
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,13 +15,16 @@ import (
 	"net/textproto"
 	"os"
 	"path/filepath"
-	"runtime/debug"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/lvgophers/smtpd/config"
 	"github.com/lvgophers/smtpd/logging"
 	"github.com/lvgophers/smtpd/maildir"
+	"github.com/lvgophers/smtpd/queue"
+	"github.com/lvgophers/smtpd/spf"
 	"github.com/lvgophers/smtpd/types"
 )
 
@@ -32,56 +40,124 @@ func (e errstr) Error() string {
 
 var log = logging.Logger
 
-var code211 = &textproto.Error{Code: 211, Msg: "System status, or system help reply"}
-var code214 = &textproto.Error{Code: 214, Msg: "Help message"}
-var code220 = &textproto.Error{Code: 220, Msg: "Service ready"}
-var code221 = &textproto.Error{Code: 221, Msg: "Service closing transmission channel"}
-var code250 = &textproto.Error{Code: 250, Msg: "Requested mail action okay, completed"}
-var code251 = &textproto.Error{Code: 251, Msg: "User not local"}
+var code211 = &textproto.Error{Code: 211, Msg: "2.0.0 System status, or system help reply"}
+var code214 = &textproto.Error{Code: 214, Msg: "2.0.0 Help message"}
+var code220 = &textproto.Error{Code: 220, Msg: "2.0.0 Service ready"}
+var code221 = &textproto.Error{Code: 221, Msg: "2.0.0 Service closing transmission channel"}
+var code250 = &textproto.Error{Code: 250, Msg: "2.0.0 Requested mail action okay, completed"}
+var code251 = &textproto.Error{Code: 251, Msg: "2.1.5 User not local"}
 var code354 = &textproto.Error{Code: 354, Msg: "Start mail input; end with <CRLF>.<CRLF>"}
-var code421 = &textproto.Error{Code: 421, Msg: "Service not available, closing transmission channel"}
-var code450 = &textproto.Error{Code: 450, Msg: "Requested mail action not taken: mailbox unavailable"}
-var code451 = &textproto.Error{Code: 451, Msg: "Requested action aborted: error in processing"}
-var code452 = &textproto.Error{Code: 452, Msg: "Requested action not taken: insufficient system storage"}
-var code500 = &textproto.Error{Code: 500, Msg: "Syntax error, command unrecognized"}
-var code501 = &textproto.Error{Code: 501, Msg: "Syntax error in parameters or arguments"}
-var code502 = &textproto.Error{Code: 502, Msg: "Command not implemented"}
-var code503 = &textproto.Error{Code: 503, Msg: "Bad sequence of commands"}
-var code504 = &textproto.Error{Code: 504, Msg: "Command parameter not implemented"}
-var code550 = &textproto.Error{Code: 550, Msg: "Requested action not taken: mailbox unavailable"}
-var code551 = &textproto.Error{Code: 551, Msg: "User not local"}
-var code552 = &textproto.Error{Code: 552, Msg: "Requested mail action aborted: exceeded storage allocation"}
-var code553 = &textproto.Error{Code: 553, Msg: "Requested action not taken: mailbox name not allowed"}
-var code554 = &textproto.Error{Code: 554, Msg: "Transaction failed"}
-
-var toomanyrcpt = &textproto.Error{Code: 452, Msg: "too many recipients"}
-var norelay = &textproto.Error{Code: 553, Msg: "no relay"}
-
-func (s *session) panic() {
-	defer s.Close()
-	if r := recover(); r != nil {
-		if tpe, ok := r.(*textproto.Error); ok {
-			if tpe.Code != 421 {
-				s.PrintfLine(tpe.Error())
-				s.PrintfLine(code421.Error())
-			} else {
-				s.PrintfLine(tpe.Error())
-			}
-			return
+var code421 = &textproto.Error{Code: 421, Msg: "4.3.0 Service not available, closing transmission channel"}
+var code450 = &textproto.Error{Code: 450, Msg: "4.2.0 Requested mail action not taken: mailbox unavailable"}
+var code451 = &textproto.Error{Code: 451, Msg: "4.3.0 Requested action aborted: error in processing"}
+var code452 = &textproto.Error{Code: 452, Msg: "4.3.1 Requested action not taken: insufficient system storage"}
+var code500 = &textproto.Error{Code: 500, Msg: "5.5.2 Syntax error, command unrecognized"}
+var code501 = &textproto.Error{Code: 501, Msg: "5.5.4 Syntax error in parameters or arguments"}
+var code502 = &textproto.Error{Code: 502, Msg: "5.5.1 Command not implemented"}
+var code503 = &textproto.Error{Code: 503, Msg: "5.5.1 Bad sequence of commands"}
+var code504 = &textproto.Error{Code: 504, Msg: "5.5.4 Command parameter not implemented"}
+var code550 = &textproto.Error{Code: 550, Msg: "5.1.1 Requested action not taken: mailbox unavailable"}
+var code551 = &textproto.Error{Code: 551, Msg: "5.1.6 User not local"}
+var code552 = &textproto.Error{Code: 552, Msg: "5.3.4 Requested mail action aborted: exceeded storage allocation"}
+var code553 = &textproto.Error{Code: 553, Msg: "5.1.3 Requested action not taken: mailbox name not allowed"}
+var code554 = &textproto.Error{Code: 554, Msg: "5.0.0 Transaction failed"}
+var code555 = &textproto.Error{Code: 555, Msg: "5.5.4 MAIL FROM/RCPT TO parameters not recognized or not implemented"}
+
+var toomanyrcpt = &textproto.Error{Code: 452, Msg: "4.5.3 too many recipients"}
+var norelay = &textproto.Error{Code: 553, Msg: "5.7.1 no relay"}
+var nouser = &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+var badmailfrom = &textproto.Error{Code: 553, Msg: "5.7.1 sender rejected"}
+var badrcptto = &textproto.Error{Code: 553, Msg: "5.7.1 recipient rejected"}
+var authrequired = &textproto.Error{Code: 530, Msg: "5.7.0 authentication required"}
+var tlsrequired = &textproto.Error{Code: 530, Msg: "5.7.0 must issue a STARTTLS command first"}
+var notowner = &textproto.Error{Code: 553, Msg: "5.7.1 From: not owned by the authenticated user"}
+var bouncercpt = &textproto.Error{Code: 550, Msg: "5.5.3 bounces must have a single recipient"}
+var notxclient = &textproto.Error{Code: 550, Msg: "5.7.0 insufficient authorization"}
+var authok = &textproto.Error{Code: 235, Msg: "2.7.0 authentication successful"}
+var authfailed = &textproto.Error{Code: 535, Msg: "5.7.8 authentication credentials invalid"}
+var authcancelled = &textproto.Error{Code: 501, Msg: "5.7.0 authentication cancelled"}
+
+// replyf returns a reply with a formatted message.
+func replyf(code int, format string, args ...interface{}) *textproto.Error {
+	return &textproto.Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// statusre matches an enhanced status code (RFC 3463).
+var statusre = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}( |$)`)
+
+// enhanced returns e with the generic enhanced status code of its class
+// on each line that lacks one, as ENHANCEDSTATUSCODES promises.
+func enhanced(e *textproto.Error) *textproto.Error {
+	if e.Code/100 != 2 && e.Code/100 != 4 && e.Code/100 != 5 {
+		return e
+	}
+	lines := strings.Split(e.Msg, "\n")
+	for i, line := range lines {
+		if !statusre.MatchString(line) {
+			lines[i] = fmt.Sprintf("%d.0.0 %s", e.Code/100, line)
 		}
-		if oe, ok := r.(net.OpError); ok {
-			if oe.Timeout() {
-				s.PrintfLine("%v %s", 421, "timeout")
-			}
-			return
+	}
+	return &textproto.Error{Code: e.Code, Msg: strings.Join(lines, "\n")}
+}
+
+// closing is a reply after which the session ends.
+type closing struct {
+	reply *textproto.Error
+}
+
+func (c closing) Error() string {
+	return c.reply.Error()
+}
+
+// reply writes e to the client, a line of e.Msg at a time.
+// textproto.Error's Error method quotes the message, so it isn't
+// suitable for the wire.
+func (s *session) reply(e *textproto.Error) error {
+	lines := strings.Split(e.Msg, "\n")
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if err := s.PrintfLine("%03d%s%s", e.Code, sep, line); err != nil {
+			return err
 		}
-		log.Println(r, string(debug.Stack()))
 	}
+	return nil
+}
+
+// readline reads a line from the client, who has the configured timeout
+// to send it.
+func (s *session) readline() (string, error) {
+	s.C.SetDeadline(time.Now().Add(s.cfg.Timeout()))
+	return s.ReadLine()
+}
+
+// deadlinereader extends the connection's deadline before each read, so
+// a message takes as long as it needs while the client keeps sending.
+type deadlinereader struct {
+	s *session
+	r io.Reader
 }
 
-func check(e error) {
-	if e != nil {
-		panic(e)
+func (d deadlinereader) Read(b []byte) (int, error) {
+	d.s.C.SetDeadline(time.Now().Add(d.s.cfg.Timeout()))
+	return d.r.Read(b)
+}
+
+// fail ends the session after err, an error reading from or writing to
+// the client, telling the client if it was too slow.
+func (s *session) fail(err error) {
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne) && ne.Timeout():
+		log.Printf("%s: timeout", s.C.RemoteAddr())
+		s.C.SetDeadline(time.Now().Add(time.Second))
+		s.reply(replyf(421, "4.4.2 %s timeout", s.cfg.DefaultHost()))
+	case errors.Is(err, io.EOF):
+		log.Printf("%s: connection closed without QUIT", s.C.RemoteAddr())
+	default:
+		log.Printf("%s: %v", s.C.RemoteAddr(), err)
 	}
 }
 
@@ -111,36 +187,424 @@ func parseaddr(s string) (mailbox, domain string, err error) {
 	return
 }
 
+// state is the session's place in the SMTP dialogue.
+type state int
+
+const (
+	stateconnected state = iota // awaiting HELO, EHLO or LHLO
+	stategreeted                // no mail transaction
+	statemail                   // MAIL accepted
+	statercpt                   // at least one recipient accepted
+)
+
 type session struct {
 	*types.NetConn
-	cfg  config.Interface
-	mdir maildir.Interface
-	helo string
-	from string
-	rcpt []string
+	state  state
+	cfg    Config
+	mdir   maildir.Interface
+	queue  queue.Interface
+	lmtp   bool // speaking LMTP (RFC 2033) rather than SMTP
+	submit bool // a message submission agent (RFC 6409)
+	helo   string
+	esmtp  bool              // greeted with EHLO or LHLO
+	auth   string            // authenticated user
+	env    *types.Envelope   // sender and DSN parameters, nil before MAIL
+	rcpt   []types.Recipient // local recipients
+	remote []types.Recipient // relayed recipients
+	order  []bool            // whether each accepted recipient is local, in turn
+
+	override  map[string]string // XCLIENT attributes for the session
+	forwarded map[string]string // XFORWARD attributes for the transaction
+
+	handlers   map[string]Handler // registered commands
+	extensions []string           // registered EHLO keywords
+	filters    []Filter
+	milters    []*milter
+	resolver   spf.Resolver
+	spfheader  string // Received-SPF for the transaction
+	refused    error  // the reply to every command, if a filter refused the connection
 }
 
-func (s *session) hello(parts []string) (err error) {
-	if s.helo != "" {
-		return code503
+func (s *session) hello(parts []string) error {
+	// LMTP clients greet with LHLO, and only LMTP clients do.
+	if (parts[0] == "lhlo") != s.lmtp {
+		return code500
 	}
 	if len(parts) != 2 {
 		return code501
 	}
-	s.helo = parts[1]
-	s.PrintfLine("%v Hello %s", 250, parts[1])
-	return
+	if err := s.filter(func(f Filter) error { return f.Helo(conn{s}, parts[1]) }); err != nil {
+		return err
+	}
+	s.helo, s.state = parts[1], stategreeted
+	if parts[0] == "helo" {
+		return replyf(250, "Hello %s", parts[1])
+	}
+	s.esmtp = true
+	// Every reply has an enhanced status code, which LMTP requires.
+	ext := []string{"ENHANCEDSTATUSCODES"}
+	if s.queue != nil {
+		ext = append(ext, "DSN")
+	}
+	if s.lmtp {
+		ext = append(ext, "PIPELINING")
+	}
+	if !s.encrypted() && s.cfg.TLSConfig() != nil {
+		ext = append(ext, "STARTTLS")
+	}
+	if s.authallowed() {
+		ext = append(ext, "AUTH PLAIN LOGIN")
+	}
+	if s.xclientallowed() {
+		ext = append(ext, "XCLIENT NAME ADDR PORT PROTO HELO LOGIN",
+			"XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE")
+	}
+	return replyf(250, "Hello %s\n%s", parts[1], strings.Join(s.extend(ext), "\n"))
 }
 
-func (s *session) vrfy(parts []string) error {
-	s.PrintfLine("502 send some mail, see what happens")
+// params parses the ESMTP parameters of MAIL or RCPT, which must be
+// among allowed.
+func (s *session) params(fields []string, allowed ...string) (map[string]string, error) {
+	p := make(map[string]string)
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		key := strings.ToUpper(kv[0])
+		known := false
+		for _, a := range allowed {
+			known = known || a == key
+		}
+		if !s.esmtp || !known {
+			return nil, code555
+		}
+		if _, dup := p[key]; dup || len(kv) != 2 || kv[1] == "" {
+			return nil, code501
+		}
+		p[key] = kv[1]
+	}
+	return p, nil
+}
+
+// dsnparams returns the DSN parameters keys, if there's a queue to send
+// the DSNs they ask for.
+func (s *session) dsnparams(keys ...string) []string {
+	if s.queue == nil {
+		return nil
+	}
+	return keys
+}
+
+// xtext reports whether v is a valid RFC 3461 xtext.
+func xtext(v string) bool {
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '+':
+			if i+2 >= len(v) || !strings.ContainsRune("0123456789ABCDEF", rune(v[i+1])) ||
+				!strings.ContainsRune("0123456789ABCDEF", rune(v[i+2])) {
+				return false
+			}
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return false
+		}
+	}
+	return true
+}
+
+// unxtext decodes an RFC 3461 xtext.
+func unxtext(v string) (string, bool) {
+	if !xtext(v) {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '+' {
+			n, _ := strconv.ParseUint(v[i+1:i+3], 16, 8)
+			b.WriteByte(byte(n))
+			i += 2
+		} else {
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String(), true
+}
+
+// notify parses a DSN NOTIFY parameter.
+func notify(v string) ([]string, bool) {
+	n := strings.Split(strings.ToUpper(v), ",")
+	for _, k := range n {
+		switch {
+		case k == "NEVER" && len(n) == 1:
+		case k == "SUCCESS", k == "FAILURE", k == "DELAY":
+		default:
+			return nil, false
+		}
+	}
+	return n, true
+}
+
+// encrypted reports whether the connection is over TLS.
+func (s *session) encrypted() bool {
+	_, ok := s.C.(*tls.Conn)
+	return ok
+}
+
+// starttls handles STARTTLS (RFC 3207). The session starts over on the
+// encrypted connection, forgetting what the client said before.
+func (s *session) starttls(parts []string) error {
+	conf := s.cfg.TLSConfig()
+	switch {
+	case len(parts) != 1:
+		return code501
+	case conf == nil:
+		return code502
+	case s.encrypted():
+		return code503
+	}
+	if err := s.reply(replyf(220, "2.0.0 ready to start TLS")); err != nil {
+		return err
+	}
+	tc := tls.Server(s.C, conf)
+	if err := tc.Handshake(); err != nil {
+		return fmt.Errorf("STARTTLS: %w", err)
+	}
+	s.C, s.Conn = tc, textproto.NewConn(tc)
+	s.helo, s.esmtp, s.auth = "", false, ""
+	s.reset()
+	s.state = stateconnected
 	return nil
 }
 
-func (s *session) mailfrom(parts []string) (err error) {
-	if s.helo == "" || s.from != "" {
+// authallowed reports whether AUTH is offered. PLAIN and LOGIN send the
+// password in the clear, so they're only offered over TLS or loopback.
+func (s *session) authallowed() bool {
+	if s.encrypted() {
+		return true
+	}
+	a, ok := s.C.RemoteAddr().(*net.TCPAddr)
+	return ok && a.IP.IsLoopback()
+}
+
+// challenge sends a 334 continuation and returns the decoded response.
+func (s *session) challenge(prompt string) ([]byte, error) {
+	if err := s.reply(replyf(334, "%s", base64.StdEncoding.EncodeToString([]byte(prompt)))); err != nil {
+		return nil, err
+	}
+	line, err := s.readline()
+	if err != nil {
+		return nil, err
+	}
+	if line == "*" {
+		return nil, authcancelled
+	}
+	b, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, code501
+	}
+	return b, nil
+}
+
+// authenticate handles AUTH PLAIN (RFC 4616) and AUTH LOGIN. Unlike
+// other commands, parts keeps its case.
+func (s *session) authenticate(parts []string) (err error) {
+	if s.auth != "" {
 		return code503
 	}
+	if !s.authallowed() {
+		return code502
+	}
+	if len(parts) < 2 || len(parts) > 3 {
+		return code501
+	}
+	var user, pass string
+	var b []byte
+	switch strings.ToLower(parts[1]) {
+	case "plain":
+		if len(parts) == 3 && parts[2] != "=" {
+			if b, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+				return code501
+			}
+		} else if b, err = s.challenge(""); err != nil {
+			return
+		}
+		fields := bytes.Split(b, []byte{0})
+		if len(fields) != 3 {
+			return code501
+		}
+		if len(fields[0]) > 0 && !bytes.Equal(fields[0], fields[1]) {
+			return authfailed
+		}
+		user, pass = string(fields[1]), string(fields[2])
+	case "login":
+		if len(parts) == 3 {
+			if b, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+				return code501
+			}
+		} else if b, err = s.challenge("Username:"); err != nil {
+			return
+		}
+		user = string(b)
+		if b, err = s.challenge("Password:"); err != nil {
+			return
+		}
+		pass = string(b)
+	default:
+		return code504
+	}
+	if !s.cfg.Authenticate(user, pass) {
+		log.Printf("%s: AUTH %s failed for %q", s.C.RemoteAddr(), strings.ToUpper(parts[1]), user)
+		return authfailed
+	}
+	s.auth = user
+	return authok
+}
+
+// xclientallowed reports whether the client is a mail proxy trusted
+// with XCLIENT and XFORWARD. It is the proxy's own address that counts,
+// whatever it claims with XCLIENT.
+func (s *session) xclientallowed() bool {
+	a, ok := s.C.RemoteAddr().(*net.TCPAddr)
+	return ok && s.cfg.XClient(a.IP)
+}
+
+// xattrs parses the attributes of XCLIENT or XFORWARD, which must be
+// among allowed. Values the proxy doesn't know are left out.
+func (s *session) xattrs(parts []string, allowed ...string) (map[string]string, error) {
+	if !s.xclientallowed() {
+		return nil, notxclient
+	}
+	if len(parts) < 2 {
+		return nil, code501
+	}
+	attrs := make(map[string]string)
+	for _, f := range parts[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		name := strings.ToUpper(kv[0])
+		known := false
+		for _, a := range allowed {
+			known = known || a == name
+		}
+		if !known || len(kv) != 2 {
+			return nil, code501
+		}
+		v, ok := unxtext(kv[1])
+		if !ok {
+			return nil, code501
+		}
+		if v == "[UNAVAILABLE]" || v == "[TEMPUNAVAIL]" {
+			v = ""
+		}
+		switch name {
+		case "ADDR":
+			if len(v) > 5 && strings.EqualFold(v[:5], "IPV6:") {
+				v = v[5:]
+			}
+			if v != "" && net.ParseIP(v) == nil {
+				return nil, code501
+			}
+		case "PORT":
+			if _, err := strconv.ParseUint(v, 10, 16); v != "" && err != nil {
+				return nil, code501
+			}
+		}
+		attrs[name] = v
+	}
+	return attrs, nil
+}
+
+// xclient handles the XCLIENT command of Postfix, with which a trusted
+// mail proxy hands over its client's session. The client's address and
+// login replace the proxy's for everything that follows, including the
+// access rules, and the session starts afresh with a greeting.
+func (s *session) xclient(parts []string) error {
+	attrs, err := s.xattrs(parts, "NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN")
+	if err != nil {
+		return err
+	}
+	if s.override == nil {
+		s.override = make(map[string]string)
+	}
+	for k, v := range attrs {
+		s.override[k] = v
+	}
+	env := make(map[string]string)
+	for _, k := range []string{"PROTO", "TCPLOCALIP", "TCPLOCALPORT"} {
+		if v, ok := s.Env[k]; ok {
+			env[k] = v
+		}
+	}
+	for k, name := range map[string]string{"ADDR": "TCPREMOTEIP", "PORT": "TCPREMOTEPORT", "NAME": "TCPREMOTEHOST"} {
+		if v := s.override[k]; v != "" {
+			env[name] = v
+		}
+	}
+	ip := net.ParseIP(env["TCPREMOTEIP"])
+	rule := s.cfg.Access(ip, func() string { return env["TCPREMOTEHOST"] })
+	if rule.Deny {
+		log.Printf("%s: XCLIENT %s denied by tcprules %q", s.C.RemoteAddr(), ip, rule.Pattern)
+		return closing{replyf(554, "5.7.1 %s access denied", s.cfg.DefaultHost())}
+	}
+	for k, v := range rule.Env {
+		env[k] = v
+	}
+	s.Env = env
+	s.auth = s.override["LOGIN"]
+	s.helo, s.esmtp = "", false
+	s.reset()
+	s.state = stateconnected
+	return replyf(220, "2.0.0 %s", s.cfg.DefaultHost())
+}
+
+// xforward handles the XFORWARD command of Postfix, with which a trusted
+// mail proxy passes on its client's details for the Received header of
+// the next message. Unlike XCLIENT, it doesn't affect policy.
+func (s *session) xforward(parts []string) error {
+	attrs, err := s.xattrs(parts, "NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE")
+	if err != nil {
+		return err
+	}
+	if s.forwarded == nil {
+		s.forwarded = make(map[string]string)
+	}
+	for k, v := range attrs {
+		s.forwarded[k] = v
+	}
+	return replyf(250, "2.0.0 OK")
+}
+
+// client returns the client detail k, one of NAME, ADDR, PROTO or HELO,
+// as forwarded for the transaction with XFORWARD or for the session with
+// XCLIENT, or as seen on the connection.
+func (s *session) client(k string) string {
+	if v := s.forwarded[k]; v != "" {
+		return v
+	}
+	if v := s.override[k]; v != "" && (k == "HELO" || k == "PROTO") {
+		return v
+	}
+	switch k {
+	case "NAME":
+		return s.Env["TCPREMOTEHOST"]
+	case "ADDR":
+		return s.Env["TCPREMOTEIP"]
+	case "HELO":
+		return s.helo
+	}
+	return ""
+}
+
+func (s *session) vrfy(parts []string) error {
+	return replyf(502, "5.5.1 send some mail, see what happens")
+}
+
+// mailfrom handles MAIL. Unlike most commands, parts keeps its case for
+// the DSN parameters RET and ENVID.
+func (s *session) mailfrom(parts []string) (err error) {
+	if s.submit && !s.encrypted() {
+		return tlsrequired
+	}
+	if s.submit && s.auth == "" {
+		return authrequired
+	}
 	if len(parts) < 2 {
 		return code501
 	}
@@ -148,96 +612,541 @@ func (s *session) mailfrom(parts []string) (err error) {
 	if len(newparts) != 2 {
 		return code501
 	}
-	from, fromaddr := strings.TrimSpace(newparts[0]), strings.TrimSpace(newparts[1])
-	if from != "from" {
+	from, args := strings.ToLower(strings.TrimSpace(newparts[0])), strings.Fields(newparts[1])
+	if from != "from" || len(args) == 0 {
 		return code501
 	}
+	fromaddr := strings.ToLower(args[0])
 	if !formatok(fromaddr) {
-		panic(code501)
+		return code501
 	}
-	s.from = fromaddr
-	s.PrintfLine("250 %s OK", fromaddr)
-	return
+	p, err := s.params(args[1:], s.dsnparams("RET", "ENVID")...)
+	if err != nil {
+		return
+	}
+	if ret, ok := p["RET"]; ok {
+		if ret = strings.ToUpper(ret); ret != "FULL" && ret != "HDRS" {
+			return code501
+		}
+		p["RET"] = ret
+	}
+	if envid, ok := p["ENVID"]; ok && (len(envid) > 100 || !xtext(envid)) {
+		return code501
+	}
+	env := &types.Envelope{From: strings.Trim(fromaddr, "<>"), Ret: p["RET"], EnvID: p["ENVID"]}
+	if !env.Bounce() {
+		if entry, bad := s.cfg.BadMailFrom(env.From); bad {
+			log.Printf("%s: MAIL FROM %s rejected, badmailfrom %s", s.C.RemoteAddr(), env.From, entry)
+			return badmailfrom
+		}
+	}
+	spfheader, err := s.checkspf(env)
+	if err != nil {
+		return
+	}
+	if err = s.filter(func(f Filter) error { return f.Mail(conn{s}, env.From) }); err != nil {
+		return
+	}
+	s.env, s.spfheader, s.state = env, spfheader, statemail
+	return replyf(250, "2.1.0 %s OK", fromaddr)
 }
 
+// rcptto handles RCPT. Unlike most commands, parts keeps its case for
+// the DSN parameter ORCPT.
 func (s *session) rcptto(parts []string) (err error) {
-	if s.helo == "" || s.from == "" {
-		return code503
-	}
 	if len(parts) < 2 {
 		return code501
 	}
-	if len(s.rcpt) == s.cfg.MaxRcpt() {
+	if len(s.rcpt)+len(s.remote) == s.cfg.MaxRcpt() {
 		return toomanyrcpt
 	}
+	if s.env.Bounce() && len(s.rcpt)+len(s.remote) > 0 && s.cfg.BounceOneRcpt() {
+		return bouncercpt
+	}
 	newparts := strings.SplitN(strings.Join(parts[1:], " "), ":", 2)
 	if len(newparts) != 2 {
 		return code501
 	}
-	to, rcpt := strings.TrimSpace(newparts[0]), strings.TrimSpace(newparts[1])
-	if to != "to" {
+	to, args := strings.ToLower(strings.TrimSpace(newparts[0])), strings.Fields(newparts[1])
+	if to != "to" || len(args) == 0 {
 		return code501
 	}
+	rcpt := strings.ToLower(args[0])
 	if !formatok(rcpt) {
 		return code501
 	}
+	p, err := s.params(args[1:], s.dsnparams("NOTIFY", "ORCPT")...)
+	if err != nil {
+		return
+	}
+	var n []string
+	if v, ok := p["NOTIFY"]; ok {
+		if n, ok = notify(v); !ok {
+			return code501
+		}
+	}
+	if orcpt, ok := p["ORCPT"]; ok {
+		if i := strings.IndexByte(orcpt, ';'); i <= 0 || !xtext(orcpt[i+1:]) {
+			return code501
+		}
+	}
 	mailbox, domain, err := parseaddr(rcpt)
 	if err != nil {
 		return code501
 	}
-	if !s.cfg.Host(domain) {
+	local := s.cfg.Host(domain)
+	if !local && !s.relay() {
 		return norelay
 	}
-	s.rcpt = append(s.rcpt, fmt.Sprintf("%s@%s", mailbox, domain))
-	s.PrintfLine("250 %s OK", rcpt)
-	return
+	addr := fmt.Sprintf("%s@%s", mailbox, domain)
+	if entry, bad := s.cfg.BadRcptTo(addr); bad {
+		log.Printf("%s: RCPT TO %s rejected, badrcptto %s", s.C.RemoteAddr(), addr, entry)
+		return badrcptto
+	}
+	if local && !s.cfg.Recipient(addr) {
+		return nouser
+	}
+	if err = s.filter(func(f Filter) error { return f.Rcpt(conn{s}, addr) }); err != nil {
+		return
+	}
+	r := types.Recipient{Addr: addr, Notify: n, ORcpt: p["ORCPT"]}
+	if local {
+		s.rcpt = append(s.rcpt, r)
+	} else {
+		s.remote = append(s.remote, r)
+	}
+	s.order = append(s.order, local)
+	s.state = statercpt
+	return replyf(250, "2.1.5 %s OK", rcpt)
 }
 
-func (s *session) data(parts []string) (err error) {
-	if len(s.rcpt) == 0 || s.from == "" || s.helo == "" {
-		return code503
-	}
+func (s *session) data(parts []string) error {
 	if len(parts) != 1 {
 		return code501
 	}
 	tf, err := ioutil.TempFile(s.mdir.TmpDir(),
 		fmt.Sprintf("%v.%x.", time.Now().UnixNano(), rand.Int63())) // Should be collisionproof enough
 	if err != nil {
-		panic(code452)
+		log.Printf("%s: %v", s.C.RemoteAddr(), err)
+		return code452
 	}
 	defer tf.Close()
-	check(s.PrintfLine(code354.Error()))
-	r := s.DotReader()
-	_, err = io.CopyN(tf, r, s.cfg.MaxSize())
-	if err == nil {
+	if _, err = io.WriteString(tf, s.spfheader+s.received(filepath.Base(tf.Name()))); err != nil {
+		log.Printf("%s: writing message: %v", s.C.RemoteAddr(), err)
+		os.Remove(tf.Name())
+		return code452
+	}
+	if err = s.reply(code354); err != nil {
+		os.Remove(tf.Name())
+		return err
+	}
+	var r io.Reader = deadlinereader{s, s.DotReader()}
+	var fromerr error
+	if s.submit {
+		br := bufio.NewReader(r)
+		var hdr []byte
+		hdr, fromerr = s.fixheader(br)
+		r = io.MultiReader(bytes.NewReader(hdr), br)
+	}
+	w := &filewriter{w: tf}
+	_, err = io.CopyN(w, r, s.maxsize())
+	var rej error
+	switch {
+	case w.err != nil:
+		log.Printf("%s: writing message: %v", s.C.RemoteAddr(), w.err)
+		rej = code452
+	case err == nil:
+		rej = code552
+	case err != io.EOF:
+		os.Remove(tf.Name())
+		return fmt.Errorf("DATA: %w", err)
+	}
+	if rej != nil {
+		// The client gets its reply after the end of the message.
 		os.Remove(tf.Name())
-		panic(code552)
+		if _, err = io.Copy(ioutil.Discard, r); err != nil {
+			return fmt.Errorf("DATA: %w", err)
+		}
+		return s.reject(rej)
+	}
+	if err = tf.Close(); err != nil {
+		log.Printf("%s: writing message: %v", s.C.RemoteAddr(), err)
+		os.Remove(tf.Name())
+		return s.reject(code452)
 	}
-	if err != nil && err != io.EOF {
+	if fromerr != nil {
 		os.Remove(tf.Name())
-		panic(err)
+		return s.reject(fromerr)
+	}
+	if err = s.filterdata(tf.Name()); err != nil {
+		os.Remove(tf.Name())
+		return s.reject(err)
+	}
+	switch held, err := s.milted(tf.Name()); {
+	case err != nil:
+		os.Remove(tf.Name())
+		return s.reject(err)
+	case held != nil:
+		// The client is told the message was taken.
+		return s.reject(held)
 	}
-	tf.Close()
 	basename := filepath.Base(tf.Name())
-	err = os.Rename(tf.Name(), filepath.Join(s.mdir.NewDir(), basename))
-	if err != nil {
+	var queueerr error
+	if len(s.remote) > 0 {
+		var id string
+		if id, queueerr = s.enqueue(tf.Name()); queueerr == nil {
+			basename = id
+		} else {
+			log.Printf("%s: queueing message: %v", s.C.RemoteAddr(), queueerr)
+			if !s.lmtp {
+				os.Remove(tf.Name())
+				return s.reject(code451)
+			}
+		}
+	}
+	localerr := s.deliverlocal(tf.Name())
+	defer s.reset()
+	if queueerr == nil && localerr == nil {
+		for _, f := range s.filters {
+			f.Delivered(conn{s}, basename)
+		}
+	}
+	if localerr != nil {
+		if !s.lmtp && len(s.remote) > 0 {
+			// The message is queued for the remote recipients, who'd
+			// get it again if the client retried, so the local ones
+			// get a bounce instead.
+			s.undelivered(tf.Name(), localerr)
+		}
 		os.Remove(tf.Name())
-		panic(code452)
 	}
-	s.PrintfLine("250 dirdel (%s)", basename)
-	s.from = ""
-	s.rcpt = nil
+	switch {
+	case s.lmtp:
+		return s.lmtpreplies(basename, queueerr == nil, localerr == nil)
+	case localerr != nil && len(s.remote) == 0:
+		return code452
+	}
+	return replyf(250, "2.0.0 dirdel (%s)", basename)
+}
+
+// filewriter is a writer that keeps its error, to tell failures to
+// write the message from failures to read it.
+type filewriter struct {
+	w   io.Writer
+	err error
+}
+
+func (f *filewriter) Write(b []byte) (n int, err error) {
+	if n, err = f.w.Write(b); err != nil {
+		f.err = err
+	}
+	return
+}
+
+// maxheader bounds the header fixheader reads.
+const maxheader = 64 * 1024
+
+// fixheader reads the header of a submitted message from r, returning
+// it with the Date and Message-ID fields added if they're missing, as
+// RFC 6409 section 8 allows. If the config asks, From must be the
+// authenticated user's. A header too long to hold is passed on as is.
+func (s *session) fixheader(r *bufio.Reader) (hdr []byte, err error) {
+	var date, msgid, long bool
+	var from, field string
+	for {
+		line, rerr := r.ReadString('\n')
+		hdr = append(hdr, line...)
+		if len(hdr) > maxheader {
+			long = true
+			break
+		}
+		if line == "\n" || line == "\r\n" || line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if field == "from" {
+				from += line
+			}
+		} else if i := strings.IndexByte(line, ':'); i > 0 {
+			field = strings.ToLower(strings.TrimSpace(line[:i]))
+			switch field {
+			case "date":
+				date = true
+			case "message-id":
+				msgid = true
+			case "from":
+				from += line[i+1:]
+			}
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	if s.cfg.CheckFrom() && (long || !s.owns(from)) {
+		log.Printf("%s: From: %s rejected for %q", s.C.RemoteAddr(), strings.TrimSpace(from), s.auth)
+		err = notowner
+	}
+	if long {
+		return
+	}
+	var add string
+	if !date {
+		add += "Date: " + time.Now().Format(time.RFC1123Z) + "\n"
+	}
+	if !msgid {
+		add += fmt.Sprintf("Message-ID: <%d.%x@%s>\n", time.Now().UnixNano(), rand.Int63(), s.cfg.DefaultHost())
+	}
+	return append([]byte(add), hdr...), err
+}
+
+// owns reports whether every address in the From field is the
+// authenticated user's: the login itself if it's an address, or else
+// the login at one of our domains.
+func (s *session) owns(from string) bool {
+	addrs, err := mail.ParseAddressList(strings.TrimSpace(from))
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	for _, a := range addrs {
+		i := strings.LastIndexByte(a.Address, '@')
+		switch {
+		case strings.Contains(s.auth, "@"):
+			if !strings.EqualFold(a.Address, s.auth) {
+				return false
+			}
+		case i < 0 || a.Address[:i] != s.auth || !s.cfg.Host(strings.ToLower(a.Address[i+1:])):
+			return false
+		}
+	}
+	return true
+}
+
+// received returns the Received trace header (RFC 5321 section 4.4.) for
+// the message id, naming the client by the address it connected from.
+func (s *session) received(id string) string {
+	from := s.client("HELO")
+	switch ip, host := s.client("ADDR"), s.client("NAME"); {
+	case ip != "" && host != "":
+		from += fmt.Sprintf(" (%s [%s])", host, ip)
+	case ip != "":
+		from += fmt.Sprintf(" ([%s])", ip)
+	}
+	// RFC 3848 protocol types.
+	with := s.client("PROTO")
+	if with == "" {
+		with = "SMTP"
+		if s.lmtp {
+			with = "LMTP"
+		} else if s.esmtp {
+			with = "ESMTP"
+		}
+		if s.encrypted() {
+			with += "S"
+		}
+		if s.auth != "" {
+			with += "A"
+		}
+	}
+	var rcpt string
+	if len(s.order) == 1 {
+		rcpt = append(s.rcpt, s.remote...)[0].Addr
+		rcpt = fmt.Sprintf("\n\tfor <%s>", rcpt)
+	}
+	return fmt.Sprintf("Received: from %s\n\tby %s with %s id %s%s;\n\t%s\n",
+		from, s.cfg.DefaultHost(), with, id, rcpt, time.Now().Format(time.RFC1123Z))
+}
+
+// deliverlocal moves the message in name into the maildir for the local
+// recipients, or removes it if there are none. If it can't be moved,
+// it's left in place.
+func (s *session) deliverlocal(name string) error {
+	if len(s.rcpt) == 0 {
+		os.Remove(name)
+		return nil
+	}
+	dest := filepath.Join(s.mdir.NewDir(), filepath.Base(name))
+	if err := os.Rename(name, dest); err != nil {
+		log.Printf("%s: delivering message: %v", s.C.RemoteAddr(), err)
+		return err
+	}
+	s.delivered(dest)
+	return nil
+}
+
+// lmtpreplies gives LMTP's reply for each recipient, in the order they
+// were accepted, after the message is delivered or queued as id.
+func (s *session) lmtpreplies(id string, queued, delivered bool) error {
+	var local, remote int
+	for _, islocal := range s.order {
+		var r types.Recipient
+		ok := queued
+		if islocal {
+			r, ok = s.rcpt[local], delivered
+			local++
+		} else {
+			r = s.remote[remote]
+			remote++
+		}
+		var e *textproto.Error
+		switch {
+		case ok && islocal:
+			e = replyf(250, "2.1.5 <%s> delivered (%s)", r.Addr, id)
+		case ok:
+			e = replyf(250, "2.1.5 <%s> queued (%s)", r.Addr, id)
+		case islocal:
+			e = replyf(452, "4.3.1 <%s> insufficient system storage", r.Addr)
+		default:
+			e = replyf(451, "4.3.0 <%s> error in processing", r.Addr)
+		}
+		if err := s.reply(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reject ends the transaction with e after DATA. LMTP clients expect a
+// reply for each recipient, the last of which is returned.
+func (s *session) reject(e error) error {
+	defer s.reset()
+	if tpe, ok := e.(*textproto.Error); ok && s.lmtp {
+		for i := 1; i < len(s.order); i++ {
+			if err := s.reply(tpe); err != nil {
+				return err
+			}
+		}
+	}
+	return e
+}
+
+// envelope returns the transaction's envelope with rcpt.
+func (s *session) envelope(rcpt []types.Recipient) *types.Envelope {
+	env := *s.env
+	env.Rcpt = rcpt
+	return &env
+}
+
+// recipients returns the accepted recipients, local and relayed, in
+// turn.
+func (s *session) recipients() (rcpt []types.Recipient) {
+	var local, remote int
+	for _, islocal := range s.order {
+		if islocal {
+			rcpt = append(rcpt, s.rcpt[local])
+			local++
+		} else {
+			rcpt = append(rcpt, s.remote[remote])
+			remote++
+		}
+	}
 	return
 }
 
-func (s *session) rset(parts []string) (err error) {
+// enqueue hands the message in name to the outbound queue for the
+// relayed recipients.
+func (s *session) enqueue(name string) (id string, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return s.queue.Enqueue(s.envelope(s.remote), f)
+}
+
+// delivered sends a DSN for local recipients that asked for one on
+// success, if there's a queue to send it with and the message isn't
+// itself a bounce.
+func (s *session) delivered(name string) {
+	if s.queue == nil || s.env.Bounce() {
+		return
+	}
+	rep := &queue.Report{Envelope: s.envelope(nil), Arrival: time.Now()}
+	for _, r := range s.rcpt {
+		rep.Results = append(rep.Results, queue.Result{Rcpt: r, Action: queue.Delivered})
+	}
+	f, err := os.Open(name)
+	if err == nil {
+		err = s.queue.Notify(rep, f)
+		f.Close()
+	}
+	if err != nil {
+		log.Printf("%s: DSN: %v", s.C.RemoteAddr(), err)
+	}
+}
+
+// undelivered bounces the message in name to the local recipients,
+// whose delivery failed with err.
+func (s *session) undelivered(name string, err error) {
+	rep := &queue.Report{Envelope: s.envelope(nil), Arrival: time.Now()}
+	for _, r := range s.rcpt {
+		rep.Results = append(rep.Results, queue.Result{Rcpt: r, Action: queue.Failed, Status: "5.3.0", Detail: err.Error()})
+	}
+	f, err := os.Open(name)
+	if err == nil {
+		err = s.queue.Notify(rep, f)
+		f.Close()
+	}
+	if err != nil {
+		log.Printf("%s: bouncing local recipients: %v", s.C.RemoteAddr(), err)
+	}
+}
+
+func (s *session) rset(parts []string) error {
 	if len(parts) != 1 {
 		return code501
 	}
-	s.from = ""
-	s.rcpt = nil
-	s.PrintfLine("250 OK")
-	return
+	s.reset()
+	return replyf(250, "2.0.0 OK")
+}
+
+// reset ends the mail transaction.
+func (s *session) reset() {
+	if s.state > stategreeted {
+		s.state = stategreeted
+	}
+	s.env = nil
+	s.rcpt, s.remote, s.order = nil, nil, nil
+	s.forwarded, s.spfheader = nil, ""
+}
+
+// relayclient reports whether the access rules permit the client to
+// relay, as qmail-smtpd does when RELAYCLIENT is set.
+func (s *session) relayclient() bool {
+	_, ok := s.Env["RELAYCLIENT"]
+	return ok
+}
+
+// relay reports whether mail may be relayed to domains outside rcpthosts:
+// the client must be trusted by the access rules or authenticated, and
+// there must be an outbound queue to hand relayed mail to.
+func (s *session) relay() bool {
+	if !s.relayclient() && s.auth == "" {
+		return false
+	}
+	if s.queue == nil {
+		log.Printf("%s: can't relay without a queue", s.C.RemoteAddr())
+		return false
+	}
+	return true
+}
+
+// maxsize returns the maximum message size, which DATABYTES in the
+// connection's environment overrides.
+func (s *session) maxsize() int64 {
+	if n, err := strconv.ParseInt(s.Env["DATABYTES"], 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return s.cfg.MaxSize()
+}
+
+// Config is the part of the configuration a session needs. One that's
+// also a config.SPF has SPF checked as it asks.
+type Config interface {
+	config.Hosts
+	config.Limits
+	config.Access
+	config.Policy
+	config.TLS
 }
 
 // Interface is the interface to a greeted SMTP session.
@@ -245,44 +1154,130 @@ type Interface interface {
 	Start() // Starts the mail session.
 }
 
+// Option configures a session.
+type Option func(*session)
+
+// WithQueue hands relayed mail to q. Without a queue, mail is never
+// relayed.
+func WithQueue(q queue.Interface) Option {
+	return func(s *session) {
+		s.queue = q
+	}
+}
+
+// WithLMTP speaks LMTP (RFC 2033) instead of SMTP: clients greet with
+// LHLO, and get a reply for each recipient after the message.
+func WithLMTP() Option {
+	return func(s *session) {
+		s.lmtp = true
+	}
+}
+
+// WithSubmission makes the session a message submission agent, which
+// only takes mail from authenticated clients.
+func WithSubmission() Option {
+	return func(s *session) {
+		s.submit = true
+	}
+}
+
 // New returns a mail session Interface.
-func New(c *types.NetConn, cfg config.Interface, mdir maildir.Interface) Interface {
-	return &session{NetConn: c, cfg: cfg, mdir: mdir}
+func New(c *types.NetConn, cfg Config, mdir maildir.Interface, opts ...Option) Interface {
+	s := &session{NetConn: c, cfg: cfg, mdir: mdir, resolver: net.DefaultResolver}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// command is a command's handler, and the states it's allowed in.
+type command struct {
+	handler func(s *session, args []string) error
+	states  []state
+	raw     bool // the arguments keep their case
 }
 
+var (
+	anystate = []state{stateconnected, stategreeted, statemail, statercpt}
+	idle     = []state{stateconnected, stategreeted}
+)
+
+var commands = map[string]command{
+	"helo":     {handler: (*session).hello, states: []state{stateconnected}},
+	"ehlo":     {handler: (*session).hello, states: []state{stateconnected}},
+	"lhlo":     {handler: (*session).hello, states: []state{stateconnected}},
+	"starttls": {handler: (*session).starttls, states: []state{stategreeted}},
+	"auth":     {handler: (*session).authenticate, states: []state{stategreeted}, raw: true},
+	"xclient":  {handler: (*session).xclient, states: idle, raw: true},
+	"xforward": {handler: (*session).xforward, states: idle, raw: true},
+	"mail":     {handler: (*session).mailfrom, states: []state{stategreeted}, raw: true},
+	"rcpt":     {handler: (*session).rcptto, states: []state{statemail, statercpt}, raw: true},
+	"data":     {handler: (*session).data, states: []state{statercpt}},
+	"rset":     {handler: (*session).rset, states: anystate},
+	"vrfy":     {handler: (*session).vrfy, states: anystate},
+	"help": {handler: func(*session, []string) error {
+		return replyf(211, "2.0.0 https://tools.ietf.org/html/rfc821")
+	}, states: anystate},
+	"noop": {handler: func(*session, []string) error {
+		return replyf(250, "2.0.0 NOOP")
+	}, states: anystate},
+	"quit": {handler: func(*session, []string) error {
+		return closing{code221}
+	}, states: anystate},
+}
+
+// next reads and handles a command, returning its reply.
+func (s *session) next() error {
+	line, err := s.readline()
+	if err != nil {
+		return err
+	}
+	args := strings.Split(line, " ")
+	verb := strings.ToLower(args[0])
+	if s.refused != nil && verb != "quit" {
+		return s.refused
+	}
+	if h, ok := s.handlers[verb]; ok {
+		return h(conn{s}, strings.TrimPrefix(line[len(args[0]):], " "))
+	}
+	cmd, ok := commands[verb]
+	if !ok {
+		return code500
+	}
+	allowed := false
+	for _, st := range cmd.states {
+		allowed = allowed || st == s.state
+	}
+	if !allowed {
+		return code503
+	}
+	if !cmd.raw {
+		args = strings.Split(strings.ToLower(line), " ")
+	}
+	return cmd.handler(s, args)
+}
+
+// Start runs the session until the client quits or the connection
+// fails.
 func (s *session) Start() {
 	defer s.Close()
-	defer s.panic()
+	for _, m := range s.milters {
+		defer m.close()
+	}
+	s.refused = s.filter(func(f Filter) error { return f.Connect(conn{s}) })
 	for {
-		// s.C.SetReadDeadline(time.Now().Add(s.cfg.Timeout()))
-		cmd, err := s.ReadLine()
-		check(err)
-		parts := strings.Split(strings.ToLower(cmd), " ")
-		switch parts[0] {
-		case "ehlo", "helo":
-			err = s.hello(parts)
-		case "mail":
-			err = s.mailfrom(parts)
-		case "rcpt":
-			err = s.rcptto(parts)
-		case "data":
-			err = s.data(parts)
-		case "rset":
-			err = s.rset(parts)
-		case "vrfy":
-			err = s.vrfy(parts)
-		case "help":
-			s.PrintfLine("211 https://tools.ietf.org/html/rfc821")
-		case "noop":
-			s.PrintfLine("250 NOOP")
-		case "quit":
-			s.PrintfLine("%s", code221.Error())
+		err := s.next()
+		switch e := err.(type) {
+		case nil:
+		case *textproto.Error:
+			err = s.reply(e)
+		case closing:
+			s.reply(e.reply)
 			return
-		default:
-			err = code500
 		}
 		if err != nil {
-			s.PrintfLine("%s", err.Error())
+			s.fail(err)
+			return
 		}
 	}
 }
@@ -2,16 +2,30 @@ package session
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/smtp"
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/lvgophers/smtpd/config"
+	"github.com/lvgophers/smtpd/queue"
 	"github.com/lvgophers/smtpd/types"
 )
 
@@ -20,13 +34,40 @@ const email = `Subject: hai
 Hai!
 `
 
+// unreceived returns the message b without the Received header the
+// session prepends.
+func unreceived(t *testing.T, b []byte) []byte {
+	if !bytes.HasPrefix(b, []byte("Received: from ")) {
+		t.Fatalf("no Received header: %q", b)
+	}
+	for i := bytes.IndexByte(b, '\n'); i >= 0; i = bytes.IndexByte(b, '\n') {
+		b = b[i+1:]
+		if len(b) == 0 || (b[0] != ' ' && b[0] != '\t') {
+			break
+		}
+	}
+	return b
+}
+
 type testconfig struct{}
 
 func (t *testconfig) Host(name string) bool {
 	return true
 }
-func (t *testconfig) Reload() (err error) {
-	return nil
+func (t *testconfig) Recipient(addr string) bool {
+	return true
+}
+func (t *testconfig) BadMailFrom(addr string) (string, bool) {
+	return "", false
+}
+func (t *testconfig) BadRcptTo(addr string) (string, bool) {
+	return "", false
+}
+func (t *testconfig) Access(ip net.IP, lookup func() string) config.AccessRule {
+	return config.AccessRule{}
+}
+func (t *testconfig) Authenticate(user, password string) bool {
+	return false
 }
 func (t *testconfig) DefaultHost() string {
 	return "none"
@@ -40,6 +81,18 @@ func (t *testconfig) MaxRcpt() int {
 func (t *testconfig) MaxSize() int64 {
 	return 1024 * 1024
 }
+func (t *testconfig) TLSConfig() *tls.Config {
+	return nil
+}
+func (t *testconfig) BounceOneRcpt() bool {
+	return false
+}
+func (t *testconfig) XClient(ip net.IP) bool {
+	return false
+}
+func (t *testconfig) CheckFrom() bool {
+	return false
+}
 
 type testmaildir struct {
 	basedir string
@@ -78,7 +131,7 @@ func TestSession(t *testing.T) {
 		var err error
 		client, err = smtp.Dial(l.Addr().String())
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 	c, err := l.Accept()
@@ -151,7 +204,7 @@ func TestSession(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if c := bytes.Compare(b, []byte(email)); c != 0 {
+	if c := bytes.Compare(unreceived(t, b), []byte(email)); c != 0 {
 		t.Fatalf("email and %s unexpectedly different: %v", names[0], c)
 	}
 	err = client.Quit()
@@ -159,3 +212,994 @@ func TestSession(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// dial starts a session using cfg and returns a client connected to it.
+func dial(t *testing.T, cfg Config) *smtp.Client {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		tp := textproto.NewConn(c)
+		tp.PrintfLine("220 hi")
+		New(&types.NetConn{C: c, Conn: tp}, cfg, td()).Start()
+	}()
+	client, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+type badconfig struct {
+	testconfig
+}
+
+func (b *badconfig) BadMailFrom(addr string) (string, bool) {
+	return "@spam.example", strings.HasSuffix(addr, "@spam.example")
+}
+
+func (b *badconfig) BadRcptTo(addr string) (string, bool) {
+	return "honeypot@example.com", addr == "honeypot@example.com"
+}
+
+func TestBadMailFromRcptTo(t *testing.T) {
+	client := dial(t, &badconfig{})
+	defer client.Close()
+	err := client.Mail("nobody@spam.example")
+	if tpe, ok := err.(*textproto.Error); !ok || tpe.Code != 553 || !strings.HasPrefix(tpe.Msg, "5.7.1") {
+		t.Fatal("expected 553 5.7.1 for badmailfrom, got", err)
+	}
+	if err = client.Mail("somebody@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	err = client.Rcpt("honeypot@example.com")
+	if tpe, ok := err.(*textproto.Error); !ok || tpe.Code != 553 || !strings.HasPrefix(tpe.Msg, "5.7.1") {
+		t.Fatal("expected 553 5.7.1 for badrcptto, got", err)
+	}
+	if err = client.Rcpt("somebody@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Quit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type bounceconfig struct {
+	testconfig
+}
+
+func (b *bounceconfig) BounceOneRcpt() bool {
+	return true
+}
+
+func (b *bounceconfig) MaxRcpt() int {
+	return 10
+}
+
+func TestBounce(t *testing.T) {
+	client := dial(t, &bounceconfig{})
+	defer client.Close()
+	if err := client.Mail(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	err := client.Rcpt("b@example.com")
+	if tpe, ok := err.(*textproto.Error); !ok || tpe.Code != 550 || !strings.HasPrefix(tpe.Msg, "5.5.3") {
+		t.Fatal("expected 550 5.5.3 for a second bounce recipient, got", err)
+	}
+	if err = client.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	// Only bounces are limited.
+	if err = client.Mail("somebody@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"a@example.com", "b@example.com"} {
+		if err = client.Rcpt(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Quit()
+
+	// Bounces are queued with the null reverse-path, and never get a
+	// DSN of their own.
+	q := &testqueue{}
+	client, _ = relaydial(t, map[string]string{"RELAYCLIENT": ""}, WithQueue(q))
+	send(t, client, "", "b@example.net", "c@example.com")
+	if q.env == nil || !q.env.Bounce() || strings.Join(q.rcpt, ",") != "b@example.net" {
+		t.Errorf("unexpected queued envelope %+v", q.env)
+	}
+	if q.rep != nil {
+		t.Errorf("unexpected report on a bounce %+v", q.rep)
+	}
+	client.Quit()
+}
+
+type relayconfig struct {
+	testconfig
+}
+
+func (r *relayconfig) Host(name string) bool {
+	return name == "example.com"
+}
+
+func (r *relayconfig) Authenticate(user, password string) bool {
+	return user == "alice" && password == "s3cret"
+}
+
+func (r *relayconfig) MaxRcpt() int {
+	return 10
+}
+
+type testqueue struct {
+	from string
+	rcpt []string
+	msg  []byte
+	env  *types.Envelope
+	rep  *queue.Report
+	err  error // returned by Enqueue
+}
+
+func (q *testqueue) Enqueue(env *types.Envelope, r io.Reader) (string, error) {
+	if q.err != nil {
+		return "", q.err
+	}
+	b, err := ioutil.ReadAll(r)
+	q.from, q.rcpt, q.msg, q.env = env.From, nil, b, env
+	for _, rcpt := range env.Rcpt {
+		q.rcpt = append(q.rcpt, rcpt.Addr)
+	}
+	return "1", err
+}
+
+func (q *testqueue) Notify(rep *queue.Report, r io.Reader) error {
+	q.rep = rep
+	return nil
+}
+
+func (q *testqueue) Run(done <-chan struct{}) {}
+
+// relaydial starts a session with the relay config and returns a client
+// connected to it and the session's maildir.
+func relaydial(t *testing.T, env map[string]string, opts ...Option) (*smtp.Client, *testmaildir) {
+	return dialenv(t, &relayconfig{}, env, opts...)
+}
+
+// dialenv is dial with env as the connection's environment.
+func dialenv(t *testing.T, cfg Config, env map[string]string, opts ...Option) (*smtp.Client, *testmaildir) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	mdir := td()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		tp := textproto.NewConn(c)
+		tp.PrintfLine("220 hi")
+		New(&types.NetConn{C: c, Conn: tp, Env: env}, cfg, mdir, opts...).Start()
+	}()
+	client, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, mdir
+}
+
+func send(t *testing.T, client *smtp.Client, from string, rcpt ...string) {
+	if err := client.Mail(from); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range rcpt {
+		if err := client.Rcpt(addr); err != nil {
+			t.Fatal(addr, err)
+		}
+	}
+	wc, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(wc, email)
+	if err = wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func isnorelay(err error) bool {
+	tpe, ok := err.(*textproto.Error)
+	return ok && tpe.Code == 553 && tpe.Msg == norelay.Msg
+}
+
+func TestRelay(t *testing.T) {
+	q := &testqueue{}
+
+	// Neither trusted nor authenticated.
+	client, _ := relaydial(t, nil, WithQueue(q))
+	if err := client.Mail("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("b@example.net"); !isnorelay(err) {
+		t.Fatal("expected no relay, got", err)
+	}
+	err := client.Auth(smtp.PlainAuth("", "alice", "s3cret", "127.0.0.1"))
+	if tpe, ok := err.(*textproto.Error); !ok || tpe.Code != 503 {
+		t.Fatal("expected 503 for AUTH during a transaction, got", err)
+	}
+	client.Close()
+
+	// Trusted by the access rules, but no queue.
+	client, _ = relaydial(t, map[string]string{"RELAYCLIENT": ""})
+	client.Mail("a@example.com")
+	if err := client.Rcpt("b@example.net"); !isnorelay(err) {
+		t.Fatal("expected no relay without a queue, got", err)
+	}
+	client.Close()
+
+	// Trusted, with a queue: remote recipients are queued and local
+	// ones delivered.
+	client, mdir := relaydial(t, map[string]string{"RELAYCLIENT": ""}, WithQueue(q))
+	send(t, client, "a@example.com", "b@example.net", "c@example.com")
+	if q.from != "a@example.com" || strings.Join(q.rcpt, ",") != "b@example.net" || string(unreceived(t, q.msg)) != email {
+		t.Errorf("unexpected queued message %+v", q)
+	}
+	if names, _ := filepath.Glob(filepath.Join(mdir.NewDir(), "*")); len(names) != 1 {
+		t.Error("expected local delivery, got", names)
+	}
+	client.Quit()
+
+	// Authenticated. The client quits after a failed AUTH.
+	client, _ = relaydial(t, nil, WithQueue(q))
+	err = client.Auth(smtp.PlainAuth("", "alice", "wrong", "127.0.0.1"))
+	if tpe, ok := err.(*textproto.Error); !ok || tpe.Code != 535 {
+		t.Fatal("expected 535 for a bad password, got", err)
+	}
+	*q = testqueue{}
+	client, mdir = relaydial(t, nil, WithQueue(q))
+	if err := client.Auth(smtp.PlainAuth("", "alice", "s3cret", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	send(t, client, "alice@example.com", "b@example.net")
+	if strings.Join(q.rcpt, ",") != "b@example.net" {
+		t.Errorf("unexpected queued message %+v", q)
+	}
+	if names, _ := filepath.Glob(filepath.Join(mdir.NewDir(), "*")); len(names) != 0 {
+		t.Error("unexpected local delivery", names)
+	}
+	names, _ := filepath.Glob(filepath.Join(mdir.TmpDir(), "*"))
+	if len(names) != 0 {
+		t.Error("unexpected files left in tmp", names)
+	}
+	client.Quit()
+}
+
+// loginauth is the client side of AUTH LOGIN.
+type loginauth struct {
+	user, pass string
+}
+
+func (a *loginauth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginauth) Next(fromServer []byte, more bool) ([]byte, error) {
+	switch {
+	case !more:
+		return nil, nil
+	case string(fromServer) == "Username:":
+		return []byte(a.user), nil
+	case string(fromServer) == "Password:":
+		return []byte(a.pass), nil
+	}
+	return nil, fmt.Errorf("unexpected challenge %q", fromServer)
+}
+
+// Once the message is queued for the remote recipients, local ones
+// whose delivery fails are bounced rather than the whole message
+// deferred.
+func TestLocalFailure(t *testing.T) {
+	q := &testqueue{}
+	client, mdir := relaydial(t, map[string]string{"RELAYCLIENT": ""}, WithQueue(q))
+	defer os.RemoveAll(mdir.basedir)
+	os.RemoveAll(mdir.NewDir())
+	send(t, client, "a@example.com", "b@example.net", "c@example.com")
+	if strings.Join(q.rcpt, ",") != "b@example.net" {
+		t.Errorf("unexpected queued recipients %v", q.rcpt)
+	}
+	if q.rep == nil || len(q.rep.Results) != 1 || q.rep.Results[0].Rcpt.Addr != "c@example.com" ||
+		q.rep.Results[0].Action != queue.Failed {
+		t.Errorf("unexpected report %+v", q.rep)
+	}
+	// With nothing queued, the client can try again.
+	q.rcpt, q.rep = nil, nil
+	if err := client.Mail("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("c@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	wc, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(wc, email)
+	if err = wc.Close(); err == nil || err.(*textproto.Error).Code != 452 {
+		t.Errorf("expected 452, got %v", err)
+	}
+	if q.rcpt != nil || q.rep != nil {
+		t.Errorf("unexpected queued message %v %+v", q.rcpt, q.rep)
+	}
+	client.Quit()
+	if names, _ := filepath.Glob(filepath.Join(mdir.TmpDir(), "*")); len(names) != 0 {
+		t.Errorf("unexpected files %v", names)
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	client, _ := relaydial(t, nil)
+	defer client.Close()
+	if ok, mechs := client.Extension("AUTH"); !ok || !strings.Contains(mechs, "LOGIN") {
+		t.Fatal("expected AUTH LOGIN to be offered, got", mechs)
+	}
+	if err := client.Auth(&loginauth{"alice", "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Auth(&loginauth{"alice", "s3cret"}); err == nil {
+		t.Fatal("expected a second AUTH to fail")
+	}
+}
+
+// expect sends a command and checks the reply code.
+func expect(t *testing.T, tp *textproto.Conn, code int, format string, args ...interface{}) {
+	id, err := tp.Cmd(format, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.StartResponse(id)
+	defer tp.EndResponse(id)
+	if _, _, err = tp.ReadResponse(code); err != nil {
+		t.Errorf("%s: %v", fmt.Sprintf(format, args...), err)
+	}
+}
+
+func TestDSN(t *testing.T) {
+	q := &testqueue{}
+	client, _ := relaydial(t, map[string]string{"RELAYCLIENT": ""}, WithQueue(q))
+	if err := client.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.Extension("DSN"); !ok {
+		t.Error("DSN not advertised")
+	}
+	tp := client.Text
+	for _, tc := range []struct {
+		code int
+		cmd  string
+	}{
+		{555, "MAIL FROM:<a@example.com> SIZE=10"},
+		{501, "MAIL FROM:<a@example.com> RET=BODY"},
+		{501, "MAIL FROM:<a@example.com> RET=FULL RET=HDRS"},
+		{501, "MAIL FROM:<a@example.com> ENVID=a=b"},
+		{250, "MAIL FROM:<a@example.com> ret=full ENVID=QQ+2B314"},
+		{555, "RCPT TO:<b@example.net> FOO=BAR"},
+		{501, "RCPT TO:<b@example.net> NOTIFY=NEVER,SUCCESS"},
+		{501, "RCPT TO:<b@example.net> NOTIFY=SOMETIMES"},
+		{501, "RCPT TO:<b@example.net> ORCPT=B@example.net"},
+		{250, "RCPT TO:<b@example.net> NOTIFY=FAILURE,DELAY ORCPT=rfc822;B+40example.net"},
+		{250, "RCPT TO:<c@example.com> NOTIFY=SUCCESS"},
+	} {
+		expect(t, tp, tc.code, "%s", tc.cmd)
+	}
+	wc, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(wc, email)
+	if err = wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	env := q.env
+	if env == nil || env.Ret != "FULL" || env.EnvID != "QQ+2B314" || len(env.Rcpt) != 1 {
+		t.Fatalf("unexpected queued envelope %+v", env)
+	}
+	if r := env.Rcpt[0]; r.Addr != "b@example.net" || strings.Join(r.Notify, ",") != "FAILURE,DELAY" ||
+		r.ORcpt != "rfc822;B+40example.net" {
+		t.Errorf("unexpected queued recipient %+v", r)
+	}
+	// Local delivery is reported to the queue, which sends the DSNs
+	// that were asked for.
+	if q.rep == nil || len(q.rep.Results) != 1 {
+		t.Fatalf("unexpected report %+v", q.rep)
+	}
+	if res := q.rep.Results[0]; res.Rcpt.Addr != "c@example.com" || res.Action != queue.Delivered ||
+		q.rep.Envelope.Ret != "FULL" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	client.Quit()
+
+	// No extensions after HELO.
+	client, _ = relaydial(t, nil, WithQueue(q))
+	tp = client.Text
+	expect(t, tp, 250, "HELO localhost")
+	expect(t, tp, 555, "MAIL FROM:<a@example.com> RET=HDRS")
+	client.Close()
+
+	// No DSNs without a queue to send them.
+	client, _ = relaydial(t, nil)
+	if err := client.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.Extension("DSN"); ok {
+		t.Error("DSN advertised without a queue")
+	}
+	tp = client.Text
+	expect(t, tp, 555, "MAIL FROM:<a@example.com> RET=HDRS")
+	expect(t, tp, 250, "MAIL FROM:<a@example.com>")
+	expect(t, tp, 555, "RCPT TO:<c@example.com> NOTIFY=SUCCESS")
+	client.Close()
+}
+
+func TestLMTP(t *testing.T) {
+	q := &testqueue{}
+	client, mdir := relaydial(t, map[string]string{"RELAYCLIENT": ""}, WithQueue(q), WithLMTP())
+	defer client.Close()
+	tp := client.Text
+	expect(t, tp, 500, "EHLO localhost")
+	id, err := tp.Cmd("LHLO localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.StartResponse(id)
+	_, msg, err := tp.ReadResponse(250)
+	tp.EndResponse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both are required of LMTP servers (RFC 2033 section 5).
+	for _, kw := range []string{"PIPELINING", "ENHANCEDSTATUSCODES"} {
+		if !strings.Contains("\n"+msg+"\n", "\n"+kw+"\n") {
+			t.Errorf("LHLO: %s not in %q", kw, msg)
+		}
+	}
+	for _, tc := range []struct {
+		queueerr error
+		replies  []string
+	}{
+		{nil, []string{"250 c@example.com", "250 b@example.net", "250 d@example.com"}},
+		{fmt.Errorf("disk full"), []string{"250 c@example.com", "451 b@example.net", "250 d@example.com"}},
+	} {
+		q.err = tc.queueerr
+		expect(t, tp, 250, "MAIL FROM:<a@example.com>")
+		for _, addr := range []string{"c@example.com", "b@example.net", "d@example.com"} {
+			expect(t, tp, 250, "RCPT TO:<%s>", addr)
+		}
+		expect(t, tp, 354, "DATA")
+		wc := tp.DotWriter()
+		io.WriteString(wc, email)
+		wc.Close()
+		// A reply for each recipient, in order.
+		for _, want := range tc.replies {
+			code, msg, err := tp.ReadResponse(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%d %s", code, msg); !strings.HasPrefix(want, got[:3]) ||
+				!strings.Contains(got, "<"+want[4:]+">") {
+				t.Errorf("got %q want %q", got, want)
+			}
+		}
+	}
+	if names, _ := filepath.Glob(filepath.Join(mdir.NewDir(), "*")); len(names) != 2 {
+		t.Error("expected two local deliveries, got", names)
+	}
+	expect(t, tp, 221, "QUIT")
+
+	// SMTP clients can't use LHLO.
+	client, _ = relaydial(t, nil)
+	expect(t, client.Text, 500, "LHLO localhost")
+	client.Close()
+}
+
+type submitconfig struct {
+	relayconfig
+	tls *tls.Config
+}
+
+func (c *submitconfig) TLSConfig() *tls.Config {
+	return c.tls
+}
+
+func (c *submitconfig) CheckFrom() bool {
+	return true
+}
+
+// selfsigned returns a server config with a throwaway certificate.
+func selfsigned(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "none"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestSubmission(t *testing.T) {
+	q := &testqueue{}
+	client, mdir := dialenv(t, &submitconfig{tls: selfsigned(t)}, map[string]string{"RELAYCLIENT": ""},
+		WithQueue(q), WithSubmission())
+	defer client.Close()
+	tp := client.Text
+	if err := client.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, tp, 530, "MAIL FROM:<alice@example.com>")
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	tp = client.Text
+	expect(t, tp, 503, "STARTTLS")
+	err := client.Mail("alice@example.com")
+	if tpe, ok := err.(*textproto.Error); !ok || tpe.Code != 530 {
+		t.Fatal("expected 530 for MAIL before AUTH, got", err)
+	}
+	if err = client.Auth(smtp.PlainAuth("", "alice", "s3cret", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing Date and Message-ID fields are added.
+	expect(t, tp, 250, "MAIL FROM:<alice@example.com>")
+	expect(t, tp, 250, "RCPT TO:<b@example.net>")
+	expect(t, tp, 354, "DATA")
+	w := tp.DotWriter()
+	io.WriteString(w, "From: Alice <alice@example.com>\nSubject: hai\n\nHai!\n")
+	w.Close()
+	if _, _, err = tp.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	msg := string(unreceived(t, q.msg))
+	if strings.Join(q.rcpt, ",") != "b@example.net" || !strings.HasPrefix(msg, "Date: ") ||
+		!strings.Contains(msg, "\nMessage-ID: <") || !strings.HasSuffix(msg, "\nFrom: Alice <alice@example.com>\nSubject: hai\n\nHai!\n") {
+		t.Errorf("unexpected queued message %q", msg)
+	}
+
+	// Others' mail is turned away, and the session goes on.
+	for _, from := range []string{"From: bob@example.com", "From: alice@example.net", "Subject: no from"} {
+		expect(t, tp, 250, "MAIL FROM:<alice@example.com>")
+		expect(t, tp, 250, "RCPT TO:<c@example.com>")
+		expect(t, tp, 354, "DATA")
+		w = tp.DotWriter()
+		io.WriteString(w, from+"\n\nHai!\n")
+		w.Close()
+		if _, _, err = tp.ReadResponse(553); err != nil {
+			t.Errorf("%s: %v", from, err)
+		}
+	}
+	if names, _ := filepath.Glob(filepath.Join(mdir.NewDir(), "*")); len(names) != 0 {
+		t.Error("unexpected delivery", names)
+	}
+	client.Quit()
+}
+
+type xclientconfig struct {
+	relayconfig
+}
+
+func (x *xclientconfig) XClient(ip net.IP) bool {
+	return ip.IsLoopback()
+}
+
+func (x *xclientconfig) Access(ip net.IP, lookup func() string) config.AccessRule {
+	switch ip.String() {
+	case "192.0.2.1":
+		return config.AccessRule{Env: map[string]string{"RELAYCLIENT": ""}}
+	case "192.0.2.66":
+		return config.AccessRule{Deny: true}
+	}
+	return config.AccessRule{}
+}
+
+// senddata sends the message after DATA on tp.
+func senddata(t *testing.T, tp *textproto.Conn) {
+	expect(t, tp, 354, "DATA")
+	w := tp.DotWriter()
+	io.WriteString(w, email)
+	w.Close()
+	if _, _, err := tp.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXClient(t *testing.T) {
+	// Only trusted proxies may use XCLIENT.
+	client, _ := dialenv(t, &relayconfig{}, nil)
+	if err := client.Hello("proxy.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.Extension("XCLIENT"); ok {
+		t.Error("XCLIENT offered to an untrusted client")
+	}
+	expect(t, client.Text, 550, "XCLIENT ADDR=192.0.2.1")
+	expect(t, client.Text, 550, "XFORWARD ADDR=192.0.2.1")
+	client.Close()
+
+	// The access rules for the client's address apply, and the session
+	// starts over.
+	q := &testqueue{}
+	client, _ = dialenv(t, &xclientconfig{}, map[string]string{"TCPREMOTEIP": "127.0.0.1"}, WithQueue(q))
+	tp := client.Text
+	if err := client.Hello("proxy.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.Extension("XCLIENT"); !ok {
+		t.Error("XCLIENT not offered to a trusted proxy")
+	}
+	expect(t, tp, 250, "MAIL FROM:<a@example.net>")
+	expect(t, tp, 503, "XCLIENT ADDR=192.0.2.1")
+	expect(t, tp, 250, "RSET")
+	expect(t, tp, 501, "XCLIENT ADDR=bogus")
+	expect(t, tp, 220, "XCLIENT NAME=mx.example.net ADDR=192.0.2.1 HELO=client.example.net")
+	expect(t, tp, 250, "EHLO proxy.example.com")
+	expect(t, tp, 250, "MAIL FROM:<a@example.net>")
+	expect(t, tp, 250, "RCPT TO:<b@example.net>")
+	senddata(t, tp)
+	want := "Received: from client.example.net (mx.example.net [192.0.2.1])\n"
+	if !strings.HasPrefix(string(q.msg), want) {
+		t.Errorf("queued message lacks %q:\n%s", want, q.msg)
+	}
+
+	// A login counts as authentication.
+	expect(t, tp, 220, "XCLIENT ADDR=198.51.100.1 NAME=[UNAVAILABLE] LOGIN=alice")
+	expect(t, tp, 250, "EHLO proxy.example.com")
+	expect(t, tp, 250, "MAIL FROM:<a@example.net>")
+	expect(t, tp, 250, "RCPT TO:<b@example.net>")
+	expect(t, tp, 250, "RSET")
+
+	// A denied client is turned away.
+	expect(t, tp, 554, "XCLIENT ADDR=192.0.2.66 LOGIN=[UNAVAILABLE]")
+	if line, err := tp.ReadLine(); err == nil {
+		t.Errorf("expected the connection to close, got %q", line)
+	}
+	client.Close()
+}
+
+func TestXForward(t *testing.T) {
+	client, mdir := dialenv(t, &xclientconfig{}, map[string]string{"TCPREMOTEIP": "127.0.0.1"})
+	defer client.Close()
+	tp := client.Text
+	if err := client.Hello("proxy.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, tp, 501, "XFORWARD LOGIN=alice")
+	expect(t, tp, 250, "XFORWARD ADDR=IPV6:2001:db8::1 NAME=[UNAVAILABLE]")
+	expect(t, tp, 250, "XFORWARD HELO=far.example.net PROTO=ESMTP")
+	expect(t, tp, 250, "MAIL FROM:<a@example.net>")
+	expect(t, tp, 503, "XFORWARD ADDR=192.0.2.1")
+	// Forwarded details don't affect policy.
+	expect(t, tp, 553, "RCPT TO:<b@example.net>")
+	expect(t, tp, 250, "RCPT TO:<c@example.com>")
+	senddata(t, tp)
+	names, _ := filepath.Glob(filepath.Join(mdir.NewDir(), "*"))
+	if len(names) != 1 {
+		t.Fatal("expected a delivery, got", names)
+	}
+	b, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Received: from far.example.net ([2001:db8::1])\n\tby none with ESMTP id "
+	if !strings.HasPrefix(string(b), want) {
+		t.Errorf("message lacks %q:\n%s", want, b)
+	}
+}
+
+// logbuf collects the package's log output.
+type logbuf struct {
+	l   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logbuf) Write(p []byte) (int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logbuf) String() string {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.buf.String()
+}
+
+func capturelog() (*logbuf, func()) {
+	b := &logbuf{}
+	log.SetOutput(b)
+	return b, func() { log.SetOutput(os.Stderr) }
+}
+
+type timeoutconfig struct {
+	testconfig
+}
+
+func (c *timeoutconfig) Timeout() time.Duration {
+	return 100 * time.Millisecond
+}
+
+// pipe runs a session on one end of a pipe, whose other end is
+// returned. done is closed when the session ends.
+func pipe(cfg Config, env map[string]string, wrap func(net.Conn) net.Conn, opts ...Option) (
+	tp *textproto.Conn, mdir *testmaildir, done chan struct{}) {
+	client, c := net.Pipe()
+	if wrap != nil {
+		c = wrap(c)
+	}
+	mdir, done = td(), make(chan struct{})
+	go func() {
+		defer close(done)
+		New(&types.NetConn{C: c, Conn: textproto.NewConn(c), Env: env}, cfg, mdir, opts...).Start()
+	}()
+	return textproto.NewConn(client), mdir, done
+}
+
+// wait waits for the session to end.
+func wait(t *testing.T, done chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still running")
+	}
+}
+
+// empty checks that no message was left in mdir.
+func empty(t *testing.T, mdir *testmaildir) {
+	for _, dir := range []string{mdir.TmpDir(), mdir.NewDir()} {
+		if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 0 {
+			t.Errorf("unexpected files %v", names)
+		}
+	}
+}
+
+// begin starts a transaction on tp, up to DATA.
+func begin(t *testing.T, tp *textproto.Conn) {
+	for _, cmd := range []struct {
+		code int
+		line string
+	}{
+		{250, "HELO client.example.com"},
+		{250, "MAIL FROM:<a@example.net>"},
+		{250, "RCPT TO:<b@example.com>"},
+		{354, "DATA"},
+	} {
+		expect(t, tp, cmd.code, "%s", cmd.line)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	logs, restore := capturelog()
+	defer restore()
+	for _, data := range []bool{false, true} {
+		tp, mdir, done := pipe(&timeoutconfig{}, nil, nil)
+		if data {
+			begin(t, tp)
+			tp.PrintfLine("Subject: hai")
+		}
+		line, err := tp.ReadLine()
+		if err != nil || line != "421 4.4.2 none timeout" {
+			t.Errorf("DATA %v: got %q %v, want a timeout", data, line, err)
+		}
+		if _, err = tp.ReadLine(); err == nil {
+			t.Errorf("DATA %v: connection still open", data)
+		}
+		wait(t, done)
+		empty(t, mdir)
+		tp.Close()
+	}
+	if n := strings.Count(logs.String(), ": timeout\n"); n != 2 {
+		t.Errorf("expected 2 timeouts logged, got:\n%s", logs)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	logs, restore := capturelog()
+	defer restore()
+	tp, mdir, done := pipe(&testconfig{}, nil, nil)
+	begin(t, tp)
+	tp.PrintfLine("Subject: hai")
+	tp.Close()
+	wait(t, done)
+	empty(t, mdir)
+	if !strings.Contains(logs.String(), ": DATA: unexpected EOF\n") {
+		t.Errorf("disconnect not logged:\n%s", logs)
+	}
+}
+
+// brokenconn fails every write.
+type brokenconn struct {
+	net.Conn
+}
+
+var errbroken = errors.New("broken pipe")
+
+func (brokenconn) Write([]byte) (int, error) {
+	return 0, errbroken
+}
+
+func TestWriteError(t *testing.T) {
+	logs, restore := capturelog()
+	defer restore()
+	tp, _, done := pipe(&testconfig{}, nil, func(c net.Conn) net.Conn { return brokenconn{c} })
+	defer tp.Close()
+	tp.PrintfLine("HELO client.example.com")
+	wait(t, done)
+	if !strings.Contains(logs.String(), ": broken pipe\n") {
+		t.Errorf("write error not logged:\n%s", logs)
+	}
+}
+
+func TestTooBig(t *testing.T) {
+	tp, mdir, done := pipe(&testconfig{}, map[string]string{"DATABYTES": "10"}, nil)
+	defer tp.Close()
+	begin(t, tp)
+	w := tp.DotWriter()
+	io.WriteString(w, email)
+	w.Close()
+	if _, _, err := tp.ReadResponse(552); err != nil {
+		t.Fatal(err)
+	}
+	// The session goes on, without the transaction.
+	expect(t, tp, 503, "DATA")
+	expect(t, tp, 250, "NOOP")
+	expect(t, tp, 221, "QUIT")
+	wait(t, done)
+	empty(t, mdir)
+}
+
+func TestCommand(t *testing.T) {
+	var env *types.Envelope
+	xsite := func(c Conn, args string) error {
+		if c.Helo() == "" {
+			return &textproto.Error{Code: 503, Msg: "5.5.1 greet first"}
+		}
+		if err := c.Reply(334, "go on"); err != nil {
+			return err
+		}
+		line, err := c.ReadLine()
+		if err != nil {
+			return err
+		}
+		env = c.Envelope()
+		return &textproto.Error{Code: 250, Msg: args + "\n" + line}
+	}
+	vrfy := func(c Conn, args string) error {
+		return &textproto.Error{Code: 252, Msg: "2.1.5 " + args}
+	}
+	tp, _, done := pipe(&testconfig{}, nil, nil, WithCommand("XSITE", xsite), WithCommand("vrfy", vrfy),
+		WithExtension("XSITE"), WithExtension("dsn FULL"))
+	defer tp.Close()
+	expect(t, tp, 503, "XSITE")
+	id, err := tp.Cmd("EHLO client.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.StartResponse(id)
+	_, msg, err := tp.ReadResponse(250)
+	tp.EndResponse(id)
+	if want := "Hello client.example.com\nENHANCEDSTATUSCODES\ndsn FULL\nXSITE"; err != nil || msg != want {
+		t.Errorf("EHLO: got %q %v, want %q", msg, err, want)
+	}
+	expect(t, tp, 250, "MAIL FROM:<a@example.net>")
+	expect(t, tp, 250, "RCPT TO:<b@example.com>")
+	expect(t, tp, 334, "xsite Some  Args")
+	tp.PrintfLine("more")
+	if _, msg, err = tp.ReadResponse(250); err != nil || msg != "Some  Args\nmore" {
+		t.Errorf("XSITE: got %q %v", msg, err)
+	}
+	if env == nil || env.From != "a@example.net" || len(env.Rcpt) != 1 || env.Rcpt[0].Addr != "b@example.com" {
+		t.Errorf("unexpected envelope %+v", env)
+	}
+	expect(t, tp, 252, "VRFY Bob")
+	expect(t, tp, 221, "QUIT")
+	wait(t, done)
+}
+
+// spfzone is a stub DNS zone holding TXT records.
+type spfzone map[string]string
+
+func (z spfzone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := z[name]; ok {
+		return []string{txt}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (z spfzone) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (z spfzone) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (z spfzone) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+type spfconfig struct {
+	testconfig
+}
+
+func (c *spfconfig) SPF(result string) string {
+	switch result {
+	case "fail":
+		return "reject"
+	case "softfail":
+		return "tag"
+	}
+	return "accept"
+}
+
+func TestSPF(t *testing.T) {
+	zone := spfzone{
+		"example.net":  "v=spf1 ip4:192.0.2.0/24 -all",
+		"soft.example": "v=spf1 ~all",
+	}
+	for _, tt := range []struct {
+		env        map[string]string
+		from, want string
+	}{
+		{map[string]string{"TCPREMOTEIP": "192.0.2.1"}, "a@example.net",
+			"Received-SPF: pass (none: domain of a@example.net designates 192.0.2.1 as permitted sender)\n" +
+				"\tclient-ip=192.0.2.1; envelope-from=\"a@example.net\"; helo=client.example.com;\n" +
+				"\tidentity=mailfrom; receiver=none;\nReceived: "},
+		{map[string]string{"TCPREMOTEIP": "192.0.2.1"}, "a@soft.example",
+			"Received-SPF: softfail (none: domain of a@soft.example does not designate 192.0.2.1 as permitted sender)\n" +
+				"\tclient-ip=192.0.2.1; envelope-from=\"a@soft.example\"; helo=client.example.com;\n" +
+				"\tidentity=mailfrom; receiver=none;\nX-Spam-Flag: YES\nReceived: "},
+		{map[string]string{"TCPREMOTEIP": "198.51.100.1"}, "a@example.net", "550"},
+		// Bounces are checked at the HELO name.
+		{map[string]string{"TCPREMOTEIP": "198.51.100.1"}, "",
+			"Received-SPF: none (none: domain of postmaster@client.example.com does not publish SPF records)\n" +
+				"\tclient-ip=198.51.100.1; envelope-from=\"postmaster@client.example.com\"; helo=client.example.com;\n" +
+				"\tidentity=helo; receiver=none;\nReceived: "},
+		// Our own clients aren't checked.
+		{map[string]string{"TCPREMOTEIP": "198.51.100.1", "RELAYCLIENT": ""}, "a@example.net", "Received: "},
+	} {
+		tp, mdir, done := pipe(&spfconfig{}, tt.env, nil, WithResolver(zone))
+		expect(t, tp, 250, "HELO client.example.com")
+		if tt.want == "550" {
+			expect(t, tp, 550, "MAIL FROM:<%s>", tt.from)
+		} else {
+			expect(t, tp, 250, "MAIL FROM:<%s>", tt.from)
+			expect(t, tp, 250, "RCPT TO:<b@example.com>")
+			senddata(t, tp)
+			names, _ := filepath.Glob(filepath.Join(mdir.NewDir(), "*"))
+			if len(names) != 1 {
+				t.Fatalf("%s: expected a delivery, got %v", tt.from, names)
+			}
+			if b, _ := ioutil.ReadFile(names[0]); !strings.HasPrefix(string(b), tt.want) {
+				t.Errorf("%s from %s: got %q, want %q", tt.from, tt.env["TCPREMOTEIP"], b, tt.want)
+			}
+		}
+		expect(t, tp, 221, "QUIT")
+		wait(t, done)
+		os.RemoveAll(mdir.basedir)
+	}
+}
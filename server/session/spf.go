@@ -0,0 +1,75 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/lvgophers/smtpd/config"
+	"github.com/lvgophers/smtpd/spf"
+	"github.com/lvgophers/smtpd/types"
+)
+
+// spftimeout bounds the DNS lookups of an SPF check.
+var spftimeout = 20 * time.Second
+
+// WithResolver looks up SPF policies with r rather than the system's
+// resolver.
+func WithResolver(r spf.Resolver) Option {
+	return func(s *session) {
+		s.resolver = r
+	}
+}
+
+// checkspf checks the SPF policy for the sender of env, or for the HELO
+// name if it's a bounce, when the config asks and the client isn't our
+// own. It returns the Received-SPF header (RFC 7208 section 9.1.), with
+// any tag, for the message; or the reply, if the config rejects the
+// result.
+func (s *session) checkspf(env *types.Envelope) (hdr string, err error) {
+	cfg, ok := s.cfg.(config.SPF)
+	ip := net.ParseIP(s.client("ADDR"))
+	if !ok || ip == nil || s.submit || s.relayclient() || s.auth != "" || cfg.SPF(string(spf.None)) == "" {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), spftimeout)
+	defer cancel()
+	helo := s.client("HELO")
+	res, cerr := spf.Check(ctx, s.resolver, ip, env.From, helo)
+	identity, sender := "mailfrom", env.From
+	if env.Bounce() {
+		identity, sender = "helo", "postmaster@"+helo
+	}
+	// RFC 7372 status codes.
+	status := "7.23"
+	if res == spf.TempError || res == spf.PermError {
+		status = "7.24"
+	}
+	switch cfg.SPF(string(res)) {
+	case "reject":
+		log.Printf("%s: MAIL FROM %s rejected, SPF %s", s.C.RemoteAddr(), sender, res)
+		return "", replyf(550, "5.%s SPF %s for %s", status, res, sender)
+	case "tempfail":
+		log.Printf("%s: MAIL FROM %s deferred, SPF %s", s.C.RemoteAddr(), sender, res)
+		return "", replyf(451, "4.%s SPF %s for %s", status, res, sender)
+	case "tag":
+		hdr = "X-Spam-Flag: YES\n"
+	}
+	var comment string
+	switch res {
+	case spf.Pass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", sender, ip)
+	case spf.Fail, spf.SoftFail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", sender, ip)
+	case spf.Neutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", ip, sender)
+	case spf.None:
+		comment = fmt.Sprintf("domain of %s does not publish SPF records", sender)
+	default:
+		comment = fmt.Sprintf("error checking %s: %v", sender, cerr)
+	}
+	host := s.cfg.DefaultHost()
+	return fmt.Sprintf("Received-SPF: %s (%s: %s)\n\tclient-ip=%s; envelope-from=\"%s\"; helo=%s;\n\tidentity=%s; receiver=%s;\n",
+		res, host, comment, ip, sender, helo, identity, host) + hdr, nil
+}
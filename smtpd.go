@@ -2,15 +2,20 @@ package main
 
 import (
 	"flag"
-	"net"
+	"fmt"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/lvgophers/smtpd/config"
 	"github.com/lvgophers/smtpd/logging"
 	"github.com/lvgophers/smtpd/maildir"
+	"github.com/lvgophers/smtpd/queue"
 	"github.com/lvgophers/smtpd/server"
+	"github.com/lvgophers/smtpd/server/session"
 )
 
 var log = logging.Logger
@@ -31,23 +36,155 @@ func getwd() string {
 	return d
 }
 
-var listenaddr = flag.String("addr", ":2525", "Listen address")
+var listenaddr = flag.String("addr", ":2525", "Listen addresses, separated by commas")
 var configdir = flag.String("config", filepath.Join(homedir(), ".smtpd"), "Configuration directory")
 var mdir = flag.String("maildir", getwd(), "Maildir directory")
+var conffile = flag.String("file", "", "Config file, taking precedence over the configuration directory")
+var queuedir = flag.String("queue", "", "Outbound queue directory, required for relaying")
+var watch = flag.Bool("watch", true, "Reload config when the configuration directory changes")
+var stdiomode = flag.Bool("stdio", false, "Run one session on stdin and stdout, as under tcpserver or inetd")
+var milters = flag.String("milter", "", "Milters to filter mail with, such as inet:localhost:11332 or unix:/run/milter.sock, separated by commas")
+
+// flagset reports whether the named flag was given on the command line.
+// Flags take precedence over the config file.
+func flagset(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
+// sources returns the config file and configuration directory to read.
+// The directory is read unless only a config file was asked for.
+func sources() (file, dir string) {
+	if *conffile == "" || flagset("config") {
+		dir = *configdir
+	}
+	return *conffile, dir
+}
+
+func loadconfig() (config.Interface, error) {
+	file, dir := sources()
+	if file == "" {
+		return config.New(dir)
+	}
+	return config.NewFile(file, dir)
+}
+
+// reload re-reads the configuration on SIGHUP. A configuration that
+// fails to load leaves the running one in place.
+func reload(conf config.Interface) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Println("SIGHUP received, reloading config")
+		if err := conf.Reload(); err != nil {
+			log.Println("config reload failed, keeping current config:", err)
+		}
+	}
+}
+
+// miltersocket returns the network and address of a milter given as
+// Postfix does, such as inet:localhost:11332 or unix:/run/milter.sock.
+func miltersocket(spec string) (network, address string, err error) {
+	switch i := strings.IndexByte(spec, ':'); {
+	case i < 0:
+	case spec[:i] == "unix" || spec[:i] == "local":
+		return "unix", spec[i+1:], nil
+	case spec[:i] == "inet" || spec[:i] == "inet6":
+		return "tcp", spec[i+1:], nil
+	}
+	return "", "", fmt.Errorf("milter %q: want inet:host:port or unix:path", spec)
+}
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: smtpd [flags]\n       smtpd [flags] check-config [-dump]")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
-	conf, err := config.New(*configdir)
+	switch flag.Arg(0) {
+	case "":
+	case "check-config":
+		os.Exit(checkconfig(flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	conf, err := loadconfig()
 	if err != nil {
 		log.Fatal(err)
 	}
+	go reload(conf)
+	if *watch && !*stdiomode {
+		file, dir := sources()
+		if dir != "" {
+			go config.Watch(conf, dir, nil)
+		}
+		if file != "" {
+			go config.Watch(conf, filepath.Dir(file), nil)
+		}
+	}
+	if !flagset("maildir") && conf.Maildir() != "" {
+		*mdir = conf.Maildir()
+	}
 	maild, err := maildir.New(*mdir)
 	if err != nil {
 		log.Fatal(err)
 	}
-	l, err := net.Listen("tcp",*listenaddr)
+	if !flagset("queue") && conf.Queue() != "" {
+		*queuedir = conf.Queue()
+	}
+	var opts []session.Option
+	if *queuedir != "" {
+		q, err := queue.New(*queuedir,
+			queue.WithHostname(conf.DefaultHost()),
+			queue.WithLifetime(conf.QueueLifetime()),
+			queue.WithRoutes(conf.Route),
+			queue.WithDoubleBounceTo(conf.DoubleBounceTo))
+		if err != nil {
+			log.Fatal(err)
+		}
+		// A long-running smtpd delivers what a stdio session queues.
+		if !*stdiomode {
+			go q.Run(nil)
+		}
+		opts = append(opts, session.WithQueue(q))
+	}
+	if *milters != "" {
+		for _, m := range strings.Split(*milters, ",") {
+			network, address, err := miltersocket(m)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts = append(opts, session.WithMilter(network, address))
+		}
+	}
+	if *stdiomode {
+		c, env, err := stdio()
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.ServeConn(conf, maild, c, env, opts...)
+		return
+	}
+	ls, err := listen(conf)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Fatal(server.Serve(conf, maild, l))
+	for _, l := range ls {
+		// Submitted mail is relayed through the outbound queue.
+		if l.conf.Profile == "submission" && *queuedir == "" {
+			log.Fatalf("listener %s: submission needs an outbound queue", l.conf)
+		}
+	}
+	errs := make(chan error)
+	for _, l := range ls {
+		go func(l *listener) {
+			errs <- server.Serve(conf, maild, l, append(opts[:len(opts):len(opts)], l.options()...)...)
+		}(l)
+	}
+	log.Fatal(<-errs)
 }
@@ -0,0 +1,543 @@
+// Package spf checks whether a host may send mail for a domain, by the
+// Sender Policy Framework of RFC 7208.
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Result is the outcome of a check (RFC 7208 section 2.6.).
+type Result string
+
+// Results.
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Resolver looks up the records a policy refers to. *net.Resolver is a
+// Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Limits on the DNS lookups a check may cause (RFC 7208 section 4.6.4.).
+const (
+	maxlookups = 10
+	maxvoids   = 2
+	maxnames   = 10 // MX or PTR names considered
+)
+
+// Check evaluates the SPF policy of sender's domain for mail from ip.
+// helo is the client's HELO name. A null sender is checked as the
+// postmaster at the HELO name. The error explains a TempError or
+// PermError.
+func Check(ctx context.Context, r Resolver, ip net.IP, sender, helo string) (Result, error) {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	i := strings.LastIndexByte(sender, '@')
+	if i < 0 {
+		sender, i = "postmaster@"+sender, len("postmaster")
+	} else if i == 0 {
+		sender, i = "postmaster"+sender, len("postmaster")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	c := &checker{ctx: ctx, r: r, ip: ip, sender: sender, local: sender[:i], helo: helo}
+	return c.check(sender[i+1:])
+}
+
+type checker struct {
+	ctx           context.Context
+	r             Resolver
+	ip            net.IP
+	sender, local string
+	helo          string
+	lookups       int
+	voids         int
+}
+
+// perm is a PermError's explanation.
+type perm struct {
+	error
+}
+
+func permf(format string, args ...interface{}) error {
+	return perm{fmt.Errorf(format, args...)}
+}
+
+// result turns the error that ended a check into its result.
+func result(err error) (Result, error) {
+	var p perm
+	if errors.As(err, &p) {
+		return PermError, p.error
+	}
+	return TempError, err
+}
+
+// validdomain reports whether d is a multi-label domain name with no
+// empty or overlong labels.
+func validdomain(d string) bool {
+	d = strings.TrimSuffix(d, ".")
+	labels := strings.Split(d, ".")
+	if len(d) > 253 || len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if l == "" || len(l) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// notfound reports whether err means the name has no such records.
+func notfound(err error) bool {
+	var dnserr *net.DNSError
+	return errors.As(err, &dnserr) && dnserr.IsNotFound
+}
+
+// void counts a lookup that found nothing.
+func (c *checker) void() error {
+	if c.voids++; c.voids > maxvoids {
+		return permf("too many void lookups")
+	}
+	return nil
+}
+
+// lookup counts a term that causes DNS lookups.
+func (c *checker) lookup() error {
+	if c.lookups++; c.lookups > maxlookups {
+		return permf("too many DNS lookups")
+	}
+	return nil
+}
+
+// record returns domain's SPF record, or an empty string if it has none.
+func (c *checker) record(domain string) (string, error) {
+	txts, err := c.r.LookupTXT(c.ctx, domain)
+	if notfound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	var rec string
+	for _, txt := range txts {
+		if v := strings.ToLower(txt); v == "v=spf1" || strings.HasPrefix(v, "v=spf1 ") {
+			if rec != "" {
+				return "", permf("%s has several SPF records", domain)
+			}
+			rec = txt
+		}
+	}
+	return rec, nil
+}
+
+// term is a directive or a modifier of a record.
+type term struct {
+	qualifier byte   // for directives, one of "+-~?"
+	name      string // mechanism or modifier name, in lower case
+	spec      string // the domain-spec or address, if any
+	cidr4     int
+	cidr6     int
+	modifier  bool
+}
+
+// parse parses the terms of rec.
+func parse(rec string) (terms []term, err error) {
+	for _, f := range strings.Fields(rec)[1:] {
+		if i := strings.IndexAny(f, "=:/"); i > 0 && f[i] == '=' {
+			name := strings.ToLower(f[:i])
+			for _, t := range terms {
+				if t.modifier && t.name == name && (name == "redirect" || name == "exp") {
+					return nil, permf("repeated %s modifier", name)
+				}
+			}
+			terms = append(terms, term{name: name, spec: f[i+1:], modifier: true})
+			continue
+		}
+		t := term{qualifier: '+', cidr4: 32, cidr6: 128}
+		if strings.IndexByte("+-~?", f[0]) >= 0 {
+			t.qualifier, f = f[0], f[1:]
+		}
+		name := f
+		if i := strings.IndexAny(f, ":/"); i >= 0 {
+			name, f = f[:i], f[i:]
+		} else {
+			f = ""
+		}
+		t.name = strings.ToLower(name)
+		switch t.name {
+		case "all":
+			if f != "" {
+				return nil, permf("bad term %q", name+f)
+			}
+		case "include", "exists":
+			if !strings.HasPrefix(f, ":") || len(f) == 1 {
+				return nil, permf("%s needs a domain", t.name)
+			}
+			t.spec = f[1:]
+		case "a", "mx":
+			if t.spec, t.cidr4, t.cidr6, err = dualcidr(f); err != nil {
+				return
+			}
+		case "ptr":
+			t.spec = strings.TrimPrefix(f, ":")
+		case "ip4", "ip6":
+			if !strings.HasPrefix(f, ":") {
+				return nil, permf("%s needs an address", t.name)
+			}
+			spec := f[1:]
+			if !strings.Contains(spec, "/") {
+				if t.name == "ip4" {
+					spec += "/32"
+				} else {
+					spec += "/128"
+				}
+			}
+			ip, n, perr := net.ParseCIDR(spec)
+			if perr != nil || (ip.To4() != nil) != (t.name == "ip4") {
+				return nil, permf("bad %s address %q", t.name, f[1:])
+			}
+			t.spec = n.String()
+		default:
+			return nil, permf("unknown mechanism %q", name)
+		}
+		terms = append(terms, t)
+	}
+	return
+}
+
+// dualcidr parses the optional domain-spec and prefix lengths of the a
+// and mx mechanisms, such as ":example.com/24//64".
+func dualcidr(f string) (spec string, cidr4, cidr6 int, err error) {
+	cidr4, cidr6 = 32, 128
+	if strings.HasPrefix(f, ":") {
+		spec, f = f[1:], f[1:]
+		if i := strings.IndexByte(f, '/'); i >= 0 {
+			spec, f = f[:i], f[i:]
+		} else {
+			f = ""
+		}
+		if spec == "" {
+			return "", 0, 0, permf("empty domain")
+		}
+	}
+	if i := strings.Index(f, "//"); i >= 0 {
+		if cidr6, err = strconv.Atoi(f[i+2:]); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, permf("bad prefix length %q", f)
+		}
+		f = f[:i]
+	}
+	if strings.HasPrefix(f, "/") {
+		if cidr4, err = strconv.Atoi(f[1:]); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, permf("bad prefix length %q", f)
+		}
+	} else if f != "" {
+		return "", 0, 0, permf("bad term %q", f)
+	}
+	return spec, cidr4, cidr6, nil
+}
+
+// check is check_host() (RFC 7208 section 4.).
+func (c *checker) check(domain string) (Result, error) {
+	if !validdomain(domain) {
+		return None, nil
+	}
+	rec, err := c.record(domain)
+	if err != nil {
+		return result(err)
+	}
+	if rec == "" {
+		return None, nil
+	}
+	terms, err := parse(rec)
+	if err != nil {
+		return result(err)
+	}
+	var redirect string
+	for _, t := range terms {
+		if t.modifier {
+			if t.name == "redirect" {
+				redirect = t.spec
+			}
+			continue
+		}
+		match, err := c.match(t, domain)
+		if err != nil {
+			return result(err)
+		}
+		if match {
+			switch t.qualifier {
+			case '-':
+				return Fail, nil
+			case '~':
+				return SoftFail, nil
+			case '?':
+				return Neutral, nil
+			}
+			return Pass, nil
+		}
+	}
+	if redirect == "" {
+		return Neutral, nil
+	}
+	if err = c.lookup(); err != nil {
+		return result(err)
+	}
+	target, err := c.expand(redirect, domain)
+	if err != nil {
+		return result(err)
+	}
+	res, err := c.check(target)
+	if res == None {
+		return PermError, fmt.Errorf("redirect to %s, which has no SPF record", target)
+	}
+	return res, err
+}
+
+// match reports whether the mechanism t matches the client.
+func (c *checker) match(t term, domain string) (bool, error) {
+	switch t.name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		_, n, _ := net.ParseCIDR(t.spec)
+		return n.Contains(c.ip), nil
+	}
+	if err := c.lookup(); err != nil {
+		return false, err
+	}
+	target := domain
+	if t.spec != "" {
+		var err error
+		if target, err = c.expand(t.spec, domain); err != nil {
+			return false, err
+		}
+	}
+	switch t.name {
+	case "include":
+		res, err := c.check(target)
+		switch res {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, err
+		case None:
+			return false, permf("include of %s, which has no SPF record", target)
+		}
+		if err == nil {
+			err = fmt.Errorf("include of %s", target)
+		}
+		return false, perm{err}
+	case "a":
+		return c.matchhost(target, t.cidr4, t.cidr6, true)
+	case "mx":
+		mxs, err := c.r.LookupMX(c.ctx, target)
+		if notfound(err) || err == nil && len(mxs) == 0 {
+			return false, c.void()
+		} else if err != nil {
+			return false, err
+		}
+		if len(mxs) > maxnames {
+			return false, permf("%s has too many MX records", target)
+		}
+		for _, mx := range mxs {
+			if ok, err := c.matchhost(strings.TrimSuffix(mx.Host, "."), t.cidr4, t.cidr6, false); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		names, err := c.r.LookupAddr(c.ctx, c.ip.String())
+		if notfound(err) || err == nil && len(names) == 0 {
+			return false, c.void()
+		} else if err != nil {
+			return false, nil // a PTR lookup failure is no match
+		}
+		if len(names) > maxnames {
+			names = names[:maxnames]
+		}
+		target = strings.ToLower(strings.TrimSuffix(target, "."))
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name != target && !strings.HasSuffix(name, "."+target) {
+				continue
+			}
+			if ok, _ := c.matchhost(name, 32, 128, false); ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "exists":
+		addrs, err := c.r.LookupIPAddr(c.ctx, target)
+		if notfound(err) {
+			return false, c.void()
+		} else if err != nil {
+			return false, err
+		}
+		for _, a := range addrs {
+			if a.IP.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, c.void()
+	}
+	return false, nil
+}
+
+// matchhost reports whether the client is in the network of the given
+// prefix length around one of host's addresses. Only the lookups of
+// the a mechanism itself count as void.
+func (c *checker) matchhost(host string, cidr4, cidr6 int, counts bool) (bool, error) {
+	addrs, err := c.r.LookupIPAddr(c.ctx, host)
+	if notfound(err) {
+		if counts {
+			return false, c.void()
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		var n net.IPNet
+		if ip4 := a.IP.To4(); ip4 != nil {
+			n = net.IPNet{IP: ip4, Mask: net.CIDRMask(cidr4, 32)}
+		} else {
+			n = net.IPNet{IP: a.IP, Mask: net.CIDRMask(cidr6, 128)}
+		}
+		if len(n.IP) == len(c.ip) && n.Contains(c.ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// expand expands the macros in a domain-spec (RFC 7208 section 7.).
+func (c *checker) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i++; i == len(spec) {
+			return "", permf("bad macro in %q", spec)
+		}
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", permf("bad macro in %q", spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", permf("bad macro in %q", spec)
+		}
+		v, err := c.macro(spec[i+1:i+end], domain)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+		i += end
+	}
+	s := b.String()
+	// Long names lose labels from the left.
+	for len(s) > 253 {
+		i := strings.IndexByte(s, '.')
+		if i < 0 {
+			return "", permf("domain %q too long", s)
+		}
+		s = s[i+1:]
+	}
+	return s, nil
+}
+
+// macro expands the body of a macro, such as "ir" in "%{ir}".
+func (c *checker) macro(m, domain string) (string, error) {
+	var v string
+	switch m[0] {
+	case 's', 'S':
+		v = c.sender
+	case 'l', 'L':
+		v = c.local
+	case 'o', 'O':
+		v = c.sender[strings.LastIndexByte(c.sender, '@')+1:]
+	case 'd', 'D':
+		v = domain
+	case 'i', 'I':
+		if len(c.ip) == net.IPv4len {
+			v = c.ip.String()
+		} else {
+			hex := fmt.Sprintf("%x", []byte(c.ip))
+			v = strings.Join(strings.Split(hex, ""), ".")
+		}
+	case 'v', 'V':
+		v = "ip6"
+		if len(c.ip) == net.IPv4len {
+			v = "in-addr"
+		}
+	case 'h', 'H':
+		v = c.helo
+	case 'p', 'P':
+		v = "unknown"
+	default:
+		return "", permf("unknown macro %q", m)
+	}
+	rest := m[1:]
+	n := 0
+	for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+		n, rest = n*10+int(rest[0]-'0'), rest[1:]
+	}
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse, rest = true, rest[1:]
+	}
+	delims := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", permf("bad macro delimiters %q", m)
+		}
+		delims = rest
+	}
+	parts := strings.FieldsFunc(v, func(r rune) bool { return strings.ContainsRune(delims, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if n > 0 && n < len(parts) {
+		parts = parts[len(parts)-n:]
+	}
+	v = strings.Join(parts, ".")
+	if m[0] >= 'A' && m[0] <= 'Z' {
+		v = url.PathEscape(v)
+	}
+	return v, nil
+}
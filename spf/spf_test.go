@@ -0,0 +1,175 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// zone is a stub DNS zone. Lookups of names in broken time out.
+type zone struct {
+	txt    map[string][]string
+	ip     map[string][]string
+	mx     map[string][]string
+	ptr    map[string][]string
+	broken map[string]bool
+}
+
+func (z zone) lookup(m map[string][]string, name string) ([]string, error) {
+	if z.broken[name] {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}
+	if v, ok := m[name]; ok {
+		return v, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (z zone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return z.lookup(z.txt, name)
+}
+
+func (z zone) LookupIPAddr(ctx context.Context, host string) (addrs []net.IPAddr, err error) {
+	ips, err := z.lookup(z.ip, host)
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return
+}
+
+func (z zone) LookupMX(ctx context.Context, name string) (mxs []*net.MX, err error) {
+	hosts, err := z.lookup(z.mx, name)
+	for i, h := range hosts {
+		mxs = append(mxs, &net.MX{Host: h + ".", Pref: uint16(10 * i)})
+	}
+	return
+}
+
+func (z zone) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return z.lookup(z.ptr, addr)
+}
+
+var testzone = zone{
+	txt: map[string][]string{
+		"example.com":   {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all", "some other record"},
+		"soft.example":  {"v=spf1 ~all"},
+		"maybe.example": {"v=spf1 ?all"},
+		"plain.example": {"hello"},
+		"a.example":     {"v=spf1 a a:host.a.example/24 -all"},
+		"mx.example":    {"v=spf1 mx//64 -all"},
+		"inc.example":   {"v=spf1 include:example.com -all"},
+		"noinc.example": {"v=spf1 include:plain.example -all"},
+		"redir.example": {"v=spf1 redirect=soft.example"},
+		"macro.example": {"v=spf1 exists:%{ir}.%{l1r-}._spf.%{d} -all"},
+		"ptr.example":   {"v=spf1 ptr -all"},
+		"twice.example": {"v=spf1 -all", "v=spf1 +all"},
+		"bad.example":   {"v=spf1 foo:bar -all"},
+		"loop.example":  {"v=spf1 include:loop.example -all"},
+		"void.example":  {"v=spf1 a:n1.void.example a:n2.void.example a:n3.void.example -all"},
+		"helo.example":  {"v=spf1 a -all"},
+		"slow.example":  {"v=spf1 include:broken.example -all"},
+	},
+	ip: map[string][]string{
+		"a.example":                           {"192.0.2.10"},
+		"host.a.example":                      {"198.51.100.1"},
+		"mail.mx.example":                     {"2001:db8:25::1"},
+		"1.2.0.192.strong._spf.macro.example": {"127.0.0.2"},
+		"mail.ptr.example":                    {"192.0.2.8"},
+		"helo.example":                        {"192.0.2.9"},
+	},
+	mx: map[string][]string{
+		"mx.example": {"mail.mx.example"},
+	},
+	ptr: map[string][]string{
+		"192.0.2.8": {"mail.ptr.example."},
+		"192.0.2.9": {"mail.ptr.example."},
+	},
+	broken: map[string]bool{"broken.example": true},
+}
+
+func TestCheck(t *testing.T) {
+	for _, tt := range []struct {
+		ip, sender, helo string
+		want             Result
+	}{
+		{"192.0.2.5", "a@example.com", "", Pass},
+		{"2001:db8::1", "a@example.com", "", Pass},
+		{"198.51.100.1", "a@example.com", "", Fail},
+		{"198.51.100.1", "a@soft.example", "", SoftFail},
+		{"198.51.100.1", "a@maybe.example", "", Neutral},
+		{"198.51.100.1", "a@plain.example", "", None},
+		{"198.51.100.1", "a@nowhere.example", "", None},
+		{"198.51.100.1", "a@localhost", "", None},
+		{"192.0.2.10", "a@a.example", "", Pass},
+		{"198.51.100.200", "a@a.example", "", Pass},
+		{"198.51.101.1", "a@a.example", "", Fail},
+		{"2001:db8:25::99", "a@mx.example", "", Pass},
+		{"2001:db8:26::1", "a@mx.example", "", Fail},
+		{"192.0.2.5", "a@inc.example", "", Pass},
+		{"198.51.100.1", "a@inc.example", "", Fail},
+		{"198.51.100.1", "a@noinc.example", "", PermError},
+		{"198.51.100.1", "a@redir.example", "", SoftFail},
+		{"192.0.2.1", "strong-bad@macro.example", "", Pass},
+		{"192.0.2.1", "weak-bad@macro.example", "", Fail},
+		{"192.0.2.8", "a@ptr.example", "", Pass},
+		{"192.0.2.9", "a@ptr.example", "", Fail},
+		{"192.0.2.1", "a@twice.example", "", PermError},
+		{"192.0.2.1", "a@bad.example", "", PermError},
+		{"192.0.2.1", "a@loop.example", "", PermError},
+		{"192.0.2.1", "a@void.example", "", PermError},
+		{"192.0.2.1", "a@slow.example", "", TempError},
+		{"192.0.2.1", "a@broken.example", "", TempError},
+		// The null sender is checked at the HELO name.
+		{"192.0.2.9", "", "helo.example", Pass},
+		{"192.0.2.1", "", "helo.example", Fail},
+	} {
+		got, err := Check(context.Background(), testzone, net.ParseIP(tt.ip), tt.sender, tt.helo)
+		if got != tt.want {
+			t.Errorf("%s from %s: got %s (%v), want %s", tt.sender, tt.ip, got, err, tt.want)
+		}
+		if (err != nil) != (got == TempError || got == PermError) {
+			t.Errorf("%s from %s: %s with error %v", tt.sender, tt.ip, got, err)
+		}
+	}
+}
+
+// The examples of RFC 7208 section 7.4.
+func TestExpand(t *testing.T) {
+	c := &checker{ip: net.ParseIP("192.0.2.3").To4(), sender: "strong-bad@email.example.com", local: "strong-bad"}
+	for spec, want := range map[string]string{
+		"%{s}":                   "strong-bad@email.example.com",
+		"%{o}":                   "email.example.com",
+		"%{d}":                   "email.example.com",
+		"%{d4}":                  "email.example.com",
+		"%{d3}":                  "email.example.com",
+		"%{d2}":                  "example.com",
+		"%{d1}":                  "com",
+		"%{dr}":                  "com.example.email",
+		"%{d2r}":                 "example.email",
+		"%{l}":                   "strong-bad",
+		"%{l-}":                  "strong.bad",
+		"%{lr}":                  "strong-bad",
+		"%{lr-}":                 "bad.strong",
+		"%{l1r-}":                "strong",
+		"%{ir}.%{v}._spf.%{d2}":  "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":   "bad.strong.lp._spf.example.com",
+		"%{lr-}.lp.%{ir}.%{v}.x": "bad.strong.lp.3.2.0.192.in-addr.x",
+		"%{ir}.%{v}.%{l1r-}.lp":  "3.2.0.192.in-addr.strong.lp",
+		"%{d2}.trusted-domains":  "example.com.trusted-domains",
+		"a%%b%_c%-d":             "a%b c%20d",
+	} {
+		if got, err := c.expand(spec, "email.example.com"); err != nil || got != want {
+			t.Errorf("%s: got %q %v, want %q", spec, got, err, want)
+		}
+	}
+	c.ip = net.ParseIP("2001:db8::cb01")
+	want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if got, err := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com"); err != nil || got != want {
+		t.Errorf("IPv6: got %q %v, want %q", got, err, want)
+	}
+	for _, spec := range []string{"%", "%{", "%{}", "%{x}", "%{d2!}"} {
+		if _, err := c.expand(spec, "email.example.com"); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
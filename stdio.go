@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// stdioconn is a connection read from stdin and written to stdout, as
+// tcpserver and inetd run servers, with the addresses from its
+// environment.
+type stdioconn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *stdioconn) LocalAddr() net.Addr  { return c.local }
+func (c *stdioconn) RemoteAddr() net.Addr { return c.remote }
+
+// fileconn is a connection read from one file and written to another,
+// such as a pair of pipes.
+type fileconn struct {
+	in, out *os.File
+}
+
+func (c *fileconn) Read(b []byte) (int, error) {
+	n, err := c.in.Read(b)
+	return n, c.operror("read", err)
+}
+
+func (c *fileconn) Write(b []byte) (int, error) {
+	n, err := c.out.Write(b)
+	return n, c.operror("write", err)
+}
+
+// operror returns err as a net.Conn's, so timeouts are net.Errors.
+func (c *fileconn) operror(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &net.OpError{Op: op, Net: "stdio", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+func (c *fileconn) LocalAddr() net.Addr  { return stdioaddr(c.out.Name()) }
+func (c *fileconn) RemoteAddr() net.Addr { return stdioaddr(c.in.Name()) }
+
+func (c *fileconn) Close() error {
+	c.in.Close()
+	return c.out.Close()
+}
+
+func (c *fileconn) SetDeadline(t time.Time) error {
+	if err := c.in.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.out.SetWriteDeadline(t)
+}
+
+func (c *fileconn) SetReadDeadline(t time.Time) error  { return c.in.SetReadDeadline(t) }
+func (c *fileconn) SetWriteDeadline(t time.Time) error { return c.out.SetWriteDeadline(t) }
+
+// fileconns returns a connection reading copies of in and writing
+// copies of out, on which deadlines work. They only do on descriptors
+// the runtime polls, which inherited ones, being blocking, aren't: a
+// socket on in is used as a net.Conn, and otherwise the copies are made
+// nonblocking.
+func fileconns(in, out *os.File) (net.Conn, error) {
+	if c, err := net.FileConn(in); err == nil {
+		return c, nil
+	}
+	var files [2]*os.File
+	for i, f := range []*os.File{in, out} {
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err == nil {
+			syscall.CloseOnExec(fd)
+			if err = syscall.SetNonblock(fd, true); err != nil {
+				syscall.Close(fd)
+			}
+		}
+		if err != nil {
+			if i > 0 {
+				files[0].Close()
+			}
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		files[i] = os.NewFile(uintptr(fd), f.Name())
+	}
+	return &fileconn{in: files[0], out: files[1]}, nil
+}
+
+// stdioaddr stands in for an unknown address.
+type stdioaddr string
+
+func (a stdioaddr) Network() string { return "stdio" }
+func (a stdioaddr) String() string  { return string(a) }
+
+// tcpaddr returns the address in env's ip and port variables, or the
+// fallback.
+func tcpaddr(env map[string]string, ip, port string, fallback net.Addr) net.Addr {
+	a := &net.TCPAddr{IP: net.ParseIP(env[ip])}
+	if a.IP == nil {
+		return fallback
+	}
+	a.Port, _ = strconv.Atoi(env[port])
+	return a
+}
+
+// stdio returns stdin and stdout as a connection, along with its
+// environment. tcpserver sets the ucspi-tcp variables, such as
+// TCPREMOTEIP and RELAYCLIENT; systemd sets REMOTE_ADDR and REMOTE_PORT
+// for sockets with Accept=yes. Failing both, as under inetd, the
+// addresses come from the socket on stdin.
+func stdio() (*stdioconn, map[string]string, error) {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	fc, err := fileconns(os.Stdin, os.Stdout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := env["TCPREMOTEIP"]; !ok {
+		if addr, ok := env["REMOTE_ADDR"]; ok {
+			env["PROTO"] = "TCP"
+			env["TCPREMOTEIP"], env["TCPREMOTEPORT"] = addr, env["REMOTE_PORT"]
+		} else {
+			if a, ok := fc.RemoteAddr().(*net.TCPAddr); ok {
+				env["PROTO"] = "TCP"
+				env["TCPREMOTEIP"], env["TCPREMOTEPORT"] = a.IP.String(), strconv.Itoa(a.Port)
+			}
+			if a, ok := fc.LocalAddr().(*net.TCPAddr); ok {
+				env["TCPLOCALIP"], env["TCPLOCALPORT"] = a.IP.String(), strconv.Itoa(a.Port)
+			}
+		}
+	}
+	c := &stdioconn{
+		Conn:   fc,
+		local:  tcpaddr(env, "TCPLOCALIP", "TCPLOCALPORT", stdioaddr("stdout")),
+		remote: tcpaddr(env, "TCPREMOTEIP", "TCPREMOTEPORT", stdioaddr("stdin")),
+	}
+	return c, env, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// readtimeout checks that a read on c gives up at its deadline.
+func readtimeout(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("expected a timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read deadline ignored")
+	}
+}
+
+func TestFileConnsSocket(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A blocking descriptor, as inherited from inetd.
+	f, err := sc.(*net.TCPConn).File()
+	sc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c, err := fileconns(f, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); !ok || a.String() != client.LocalAddr().String() {
+		t.Errorf("unexpected remote address %v", c.RemoteAddr())
+	}
+	readtimeout(t, c)
+}
+
+func TestFileConnsPipe(t *testing.T) {
+	inr, inw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inw.Close()
+	outr, outw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outr.Close()
+	c, err := fileconns(inr, outw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	readtimeout(t, c)
+	if _, err = c.Write([]byte("220 hi\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 8)
+	if n, err := outr.Read(b); err != nil || string(b[:n]) != "220 hi\r\n" {
+		t.Errorf("read %q %v", b[:n], err)
+	}
+}
@@ -3,10 +3,52 @@ package types
 import (
 	"net"
 	"net/textproto"
+	"strings"
 )
 
 // NetConn is a textproto.Conn and the underlying connection
 type NetConn struct {
 	*textproto.Conn
 	C net.Conn
+	// Env is the connection's environment in the style of ucspi-tcp:
+	// TCPREMOTEIP, TCPREMOTEHOST and the like, along with settings from
+	// the matching access rule such as RELAYCLIENT and DATABYTES.
+	Env map[string]string
+}
+
+// Envelope is a message's reverse-path and recipients, with the DSN
+// parameters of RFC 3461.
+type Envelope struct {
+	From  string // without angle brackets; empty for the null reverse-path
+	Ret   string // "FULL" or "HDRS", or empty if not given
+	EnvID string // as given, in xtext
+	Rcpt  []Recipient
+}
+
+// Bounce reports whether the message has the null reverse-path, as
+// bounces and other delivery status notifications do.
+func (e *Envelope) Bounce() bool {
+	return e.From == ""
+}
+
+// Recipient is an envelope recipient.
+type Recipient struct {
+	Addr   string
+	Notify []string // "NEVER", or some of "SUCCESS", "FAILURE" and "DELAY"
+	ORcpt  string   // as given: an address type, ";" and xtext
+}
+
+// Notifies reports whether the recipient asked for a DSN on event,
+// one of "SUCCESS", "FAILURE" or "DELAY". Without NOTIFY, failures and
+// delays are reported.
+func (r Recipient) Notifies(event string) bool {
+	if r.Notify == nil {
+		return event != "SUCCESS"
+	}
+	for _, n := range r.Notify {
+		if strings.EqualFold(n, event) {
+			return true
+		}
+	}
+	return false
 }